@@ -86,10 +86,10 @@ func newBackend(c *logical.BackendConfig) (*backend, error) {
 			return b.PeriodicTask(ctx, req.Storage)
 		},
 		PathsSpecial: &logical.Paths{
-			SealWrapStorage: []string{
+			SealWrapStorage: append([]string{
 				vault_client.StorageKeyConfiguration,
 				git.StorageKeyConfigurationGitCredential,
-			},
+			}, eng.SealWrapStorage()...),
 		},
 		RunningVersion: projectVersion,
 	}
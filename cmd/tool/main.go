@@ -6,13 +6,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/trublast/vault-plugin-gitops/pkg/gitops"
 )
 
-// fileStateWriter saves state to a file on each SaveState.
+// fileStateWriter saves state to a file on each SaveState, without sensitive response fields.
 type fileStateWriter struct {
 	filename string
 }
@@ -23,7 +24,7 @@ func (w fileStateWriter) SaveState(ctx context.Context, state *gitops.State) err
 	if state == nil || w.filename == "" {
 		return nil
 	}
-	data, err := json.MarshalIndent(state, "", "  ")
+	data, err := json.MarshalIndent(gitops.RedactSensitive(state), "", "  ")
 	if err != nil {
 		return err
 	}
@@ -38,14 +39,7 @@ func loadStateFromFile(filename string) (*gitops.State, error) {
 		}
 		return nil, err
 	}
-	var state gitops.State
-	if err := json.Unmarshal(data, &state); err != nil {
-		return nil, err
-	}
-	if state.Resources == nil {
-		state.Resources = make(map[string]gitops.StateResource)
-	}
-	return &state, nil
+	return gitops.UnmarshalState(data)
 }
 
 func main() {
@@ -61,27 +55,104 @@ func main() {
 	}
 
 	var err error
+	quiet := false // machine-readable output on stdout: no status line
 
 	switch cmd {
 	case "lint":
-		if len(os.Args) != 3 {
+		fs := flag.NewFlagSet("lint", flag.ExitOnError)
+		varsFile := fs.String("vars", "", "YAML file with template variables")
+		overlay := fs.String("overlay", "", "name of the overlay (overlays/<name>/) to apply")
+		ignore := fs.String("ignore", "", "comma-separated glob patterns of files under the path that are not resources")
+		printResources := fs.Bool("print", false, "print resources after generator expansion and template rendering")
+		format := fs.String("format", gitops.FormatText, "diagnostics format: text, json or sarif")
+		openapiFile := fs.String("openapi", "", "Vault OpenAPI document (JSON) to validate data against")
+		severity := fs.String("severity", "", "rule severity overrides: rule=error|warning|off,...")
+		_ = fs.Parse(os.Args[2:])
+		path := fs.Arg(0)
+		if path == "" || fs.NArg() != 1 {
+			printUsage()
+			os.Exit(1)
+		}
+		switch *format {
+		case gitops.FormatText:
+		case gitops.FormatJSON, gitops.FormatSARIF:
+			if *printResources {
+				fmt.Fprintln(os.Stderr, "lint: -print can only be used with -format text")
+				os.Exit(1)
+			}
+			quiet = true
+		default:
+			fmt.Fprintf(os.Stderr, "lint: unknown format %q; use text, json or sarif\n", *format)
+			os.Exit(1)
+		}
+		err = runLint(path, gitops.LoadOptions{VarsFile: *varsFile, Overlay: *overlay, Ignore: splitList(*ignore)}, *printResources, *format, *openapiFile, *severity)
+	case "plan":
+		fs := flag.NewFlagSet("plan", flag.ExitOnError)
+		stateFile := fs.String("state", "", "load state from file")
+		varsFile := fs.String("vars", "", "YAML file with template variables")
+		overlay := fs.String("overlay", "", "name of the overlay (overlays/<name>/) to apply")
+		ignore := fs.String("ignore", "", "comma-separated glob patterns of files under the path that are not resources")
+		maxDeletions := fs.String("max-deletions", "", "maximum deletions per run: a count or a percentage of state (e.g. 20%)")
+		allowDestroy := fs.Bool("allow-destroy", false, "allow deleting mounts and auth methods")
+		_ = fs.Parse(os.Args[2:])
+		path := fs.Arg(0)
+		if path == "" {
 			printUsage()
 			os.Exit(1)
 		}
-		err = runLint(os.Args[2])
+		err = runPlan(path, *stateFile, gitops.LoadOptions{VarsFile: *varsFile, Overlay: *overlay, Ignore: splitList(*ignore)}, gitops.ApplyOptions{MaxDeletions: *maxDeletions, AllowDestroy: *allowDestroy})
 	case "test":
 		fs := flag.NewFlagSet("test", flag.ExitOnError)
 		stateFile := fs.String("state", "", "load and save state to file")
+		varsFile := fs.String("vars", "", "YAML file with template variables")
+		overlay := fs.String("overlay", "", "name of the overlay (overlays/<name>/) to apply")
+		ignore := fs.String("ignore", "", "comma-separated glob patterns of files under the path that are not resources")
+		maxDeletions := fs.String("max-deletions", "", "maximum deletions per run: a count or a percentage of state (e.g. 20%)")
+		allowDestroy := fs.Bool("allow-destroy", false, "allow deleting mounts and auth methods")
+		concurrency := fs.Int("concurrency", 1, "number of independent resources applied in parallel")
+		retry := gitops.RetryPolicy{}
+		fs.IntVar(&retry.MaxAttempts, "retry-max-attempts", gitops.DefaultRetryMaxAttempts, "attempts for requests failing with a transient error; 1 = no retries")
+		fs.StringVar(&retry.Backoff, "retry-backoff", "", "delay before the first retry (default 1s), doubled with every retry")
+		fs.StringVar(&retry.MaxBackoff, "retry-max-backoff", "", "maximum delay between retries (default 30s)")
+		retryOn := fs.String("retry-on", "", "comma-separated retryable status codes (default 429,500,502,503,504)")
+		atomicApply := fs.Bool("atomic", false, "roll back the changes of the run if a resource fails")
 		_ = fs.Parse(os.Args[2:])
 		path := fs.Arg(0)
 		if path == "" {
 			printUsage()
 			os.Exit(1)
 		}
-		err = runTest(path, *stateFile)
+		if retry.RetryOn, err = gitops.ParseRetryOn(*retryOn); err == nil {
+			err = runTest(path, *stateFile, gitops.LoadOptions{VarsFile: *varsFile, Overlay: *overlay, Ignore: splitList(*ignore)}, gitops.ApplyOptions{MaxDeletions: *maxDeletions, AllowDestroy: *allowDestroy, Concurrency: *concurrency, Retry: retry, Atomic: *atomicApply})
+		}
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		stateFile := fs.String("state", "", "state file to add the resources to (required)")
+		varsFile := fs.String("vars", "", "YAML file with template variables")
+		overlay := fs.String("overlay", "", "name of the overlay (overlays/<name>/) to apply")
+		ignore := fs.String("ignore", "", "comma-separated glob patterns of files under the path that are not resources")
+		read := fs.Bool("read", false, "read the current response data of the resources from Vault")
+		readPath := fs.String("read-path", "", "path to read the response data from (single key only); implies -read")
+		_ = fs.Parse(os.Args[2:])
+		path := fs.Arg(0)
+		if path == "" || fs.NArg() < 2 || *stateFile == "" {
+			printUsage()
+			os.Exit(1)
+		}
+		err = runImport(path, *stateFile, gitops.LoadOptions{VarsFile: *varsFile, Overlay: *overlay, Ignore: splitList(*ignore)}, fs.Args()[1:], *read || *readPath != "", *readPath)
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		output := fs.String("o", "", "write resources to this file instead of stdout")
+		_ = fs.Parse(os.Args[2:])
+		if fs.NArg() != 0 {
+			printUsage()
+			os.Exit(1)
+		}
+		quiet = *output == ""
+		err = runExport(*output)
 	default:
 
-		fmt.Fprintf(os.Stderr, "unknown command %q; use lint, test, or version\n", cmd)
+		fmt.Fprintf(os.Stderr, "unknown command %q; use lint, plan, test, import, export, or version\n", cmd)
 		printUsage()
 		os.Exit(1)
 	}
@@ -91,37 +162,171 @@ func main() {
 		os.Exit(1)
 	}
 
-	fmt.Printf("\033[32m✔\033[0m %s passed\n", cmd)
+	if !quiet {
+		fmt.Printf("\033[32m✔\033[0m %s passed\n", cmd)
+	}
 }
 
-func runLint(path string) error {
-	resources, err := gitops.LoadResourcesFromPath(path)
+// runLint loads and lints resources and writes all diagnostics in the given format:
+// text goes to stderr, json and sarif to stdout. Load errors are reported as a diagnostic too.
+// With openapiFile, data is also validated against the Vault OpenAPI document;
+// severity overrides rule severities ("rule=error|warning|off,...").
+func runLint(path string, opts gitops.LoadOptions, printResources bool, format, openapiFile, severity string) error {
+	var lintOpts gitops.LintOptions
+	if openapiFile != "" {
+		data, err := os.ReadFile(openapiFile)
+		if err != nil {
+			return fmt.Errorf("openapi: %w", err)
+		}
+		if lintOpts.OpenAPI, err = gitops.LoadOpenAPISpec(data); err != nil {
+			return fmt.Errorf("openapi: %s: %w", openapiFile, err)
+		}
+	}
+	if severity != "" {
+		var err error
+		if lintOpts.Severity, err = gitops.ParseSeverityOverrides(severity); err != nil {
+			return err
+		}
+	}
+	// The OpenAPI document is not a resource file, also when it lies under path.
+	if rel, err := filepath.Rel(path, openapiFile); openapiFile != "" && err == nil && !strings.HasPrefix(rel, "..") {
+		opts.Ignore = append(opts.Ignore, "/"+filepath.ToSlash(rel))
+	}
+	var diags gitops.Diagnostics
+	resources, err := gitops.LoadResourcesFromPath(path, opts)
 	if err != nil {
-		return fmt.Errorf("load: %w", err)
+		diags = gitops.Diagnostics{{Severity: gitops.SeverityError, Rule: gitops.RuleLoadError, Message: err.Error()}}
+	} else {
+		diags = gitops.LintDiagnostics(resources, lintOpts)
+	}
+	ignored, err := gitops.IgnoredFiles(path, opts)
+	if err != nil {
+		return err
+	}
+	for _, f := range ignored {
+		if strings.HasSuffix(strings.ToLower(f), gitops.JSONExt) {
+			diags = append(diags, gitops.Diagnostic{Severity: gitops.SeverityWarning, Rule: gitops.RuleSkippedFile, File: f, Message: "not loaded: the file matches -ignore or is the -openapi document"})
+		}
+	}
+	out := os.Stdout
+	if format == gitops.FormatText {
+		out = os.Stderr
+	}
+	if err := gitops.WriteDiagnostics(out, diags, format, "gitops-tool", projectVersion); err != nil {
+		return err
+	}
+	if diags.HasErrors() {
+		errorCount := 0
+		for _, d := range diags {
+			if d.Severity == gitops.SeverityError {
+				errorCount++
+			}
+		}
+		return fmt.Errorf("%d error(s) found", errorCount)
+	}
+	if printResources {
+		rendered, err := gitops.RenderStatic(resources)
+		if err != nil {
+			return fmt.Errorf("print: %w", err)
+		}
+		out, err := gitops.MarshalResourcesYAML(rendered)
+		if err != nil {
+			return fmt.Errorf("print: %w", err)
+		}
+		os.Stdout.Write(out)
 	}
-	return gitops.Lint(resources)
+	return nil
 }
 
-func runTest(path, stateFile string) error {
-	resources, err := gitops.LoadResourcesFromPath(path)
+func runPlan(path, stateFile string, opts gitops.LoadOptions, applyOpts gitops.ApplyOptions) error {
+	resources, err := gitops.LoadResourcesFromPath(path, opts)
 	if err != nil {
 		return fmt.Errorf("load: %w", err)
 	}
 	if err := gitops.Lint(resources); err != nil {
 		return fmt.Errorf("lint: %w", err)
 	}
-
-	if strings.TrimSpace(os.Getenv("VAULT_TOKEN")) == "" {
-		return fmt.Errorf("VAULT_TOKEN is not set")
+	state := &gitops.State{Resources: make(map[string]gitops.StateResource)}
+	if stateFile != "" {
+		if state, err = loadStateFromFile(stateFile); err != nil {
+			return fmt.Errorf("load state: %w", err)
+		}
+	}
+	changes, err := gitops.Plan(resources, state)
+	if err != nil {
+		return err
+	}
+	counts := make(map[gitops.PlanAction]int)
+	symbols := map[gitops.PlanAction]string{
+		gitops.PlanCreate:    "+",
+		gitops.PlanUpdate:    "~",
+		gitops.PlanDelete:    "-",
+		gitops.PlanAbandon:   "x",
+		gitops.PlanImport:    "=",
+		gitops.PlanRead:      "<",
+		gitops.PlanUnchanged: " ",
+	}
+	for _, c := range changes {
+		counts[c.Action]++
+		line := fmt.Sprintf("%s %s", symbols[c.Action], c.Key)
+		if c.Key != c.Namespace+c.Path {
+			line += fmt.Sprintf(" (%s%s)", c.Namespace, c.Path)
+		}
+		if c.Unknown {
+			line += " (data known after apply)"
+		}
+		switch c.Action {
+		case gitops.PlanAbandon:
+			line += " (abandon: removed from state, kept in Vault)"
+		case gitops.PlanImport:
+			line += " (import: recorded as applied, no request)"
+		case gitops.PlanRead:
+			line += " (data source: read)"
+		case gitops.PlanDelete:
+			if d := c.Delete; d != nil && d.None {
+				line += " (delete: none, removed from state, kept in Vault)"
+			} else if d != nil {
+				method, path := "DELETE", c.Path
+				if d.Method != "" {
+					method = strings.ToUpper(d.Method)
+				}
+				if d.Path != "" {
+					path = d.Path
+				}
+				line += fmt.Sprintf(" (delete: %s %s)", method, path)
+			}
+		}
+		fmt.Println(line)
 	}
+	summary := fmt.Sprintf("Plan: %d to create, %d to update, %d to delete", counts[gitops.PlanCreate], counts[gitops.PlanUpdate], counts[gitops.PlanDelete])
+	if counts[gitops.PlanRead] > 0 {
+		summary += fmt.Sprintf(", %d to read", counts[gitops.PlanRead])
+	}
+	if counts[gitops.PlanImport] > 0 {
+		summary += fmt.Sprintf(", %d to import", counts[gitops.PlanImport])
+	}
+	if counts[gitops.PlanAbandon] > 0 {
+		summary += fmt.Sprintf(", %d to abandon", counts[gitops.PlanAbandon])
+	}
+	fmt.Printf("%s, %d unchanged.\n", summary, counts[gitops.PlanUnchanged])
+	return gitops.CheckDeletions(changes, state, applyOpts)
+}
 
-	cfg := api.DefaultConfig()
-	if err := cfg.ReadEnvironment(); err != nil {
-		return fmt.Errorf("vault config: %w", err)
+func runTest(path, stateFile string, opts gitops.LoadOptions, applyOpts gitops.ApplyOptions) error {
+	if err := applyOpts.Retry.Validate(); err != nil {
+		return fmt.Errorf("retry: %w", err)
+	}
+	resources, err := gitops.LoadResourcesFromPath(path, opts)
+	if err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+	if err := gitops.Lint(resources); err != nil {
+		return fmt.Errorf("lint: %w", err)
 	}
-	vaultClient, err := api.NewClient(cfg)
+
+	vaultClient, err := newVaultClient()
 	if err != nil {
-		return fmt.Errorf("vault client: %w", err)
+		return err
 	}
 
 	var state *gitops.State
@@ -141,7 +346,14 @@ func runTest(path, stateFile string) error {
 	if stateFile != "" {
 		writer = fileStateWriter{filename: stateFile}
 	}
-	if err := gitops.Apply(context.Background(), resources, vaultClient, state, writer); err != nil {
+	result, err := gitops.Apply(context.Background(), resources, vaultClient, state, writer, applyOpts)
+	if result.Retries > 0 {
+		fmt.Fprintf(os.Stderr, "%d request(s) retried after transient Vault errors\n", result.Retries)
+	}
+	if result.RolledBack > 0 {
+		fmt.Fprintf(os.Stderr, "%d change(s) rolled back\n", result.RolledBack)
+	}
+	if err != nil {
 		return fmt.Errorf("apply: %w", err)
 	}
 	if writer != nil {
@@ -152,14 +364,130 @@ func runTest(path, stateFile string) error {
 	return nil
 }
 
+// runImport records the resources with the given keys in the state file as already applied.
+func runImport(path, stateFile string, opts gitops.LoadOptions, keys []string, read bool, readPath string) error {
+	if readPath != "" && len(keys) != 1 {
+		return fmt.Errorf("-read-path can only be used with a single key")
+	}
+	resources, err := gitops.LoadResourcesFromPath(path, opts)
+	if err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+	if err := gitops.Lint(resources); err != nil {
+		return fmt.Errorf("lint: %w", err)
+	}
+	state, err := loadStateFromFile(stateFile)
+	if err != nil {
+		return fmt.Errorf("load state: %w", err)
+	}
+	importOpts := gitops.ImportOptions{ReadPath: readPath}
+	if read {
+		if importOpts.Client, err = newVaultClient(); err != nil {
+			return err
+		}
+	}
+	byKey := make(map[string]*gitops.Resource, len(resources))
+	for i := range resources {
+		byKey[resources[i].Key()] = &resources[i]
+	}
+	for _, key := range keys {
+		r, ok := byKey[key]
+		if !ok {
+			return fmt.Errorf("resource %q not found in %s", key, path)
+		}
+		if err := gitops.Import(context.Background(), r, state, importOpts); err != nil {
+			return err
+		}
+		fmt.Printf("imported %s\n", key)
+	}
+	return fileStateWriter{filename: stateFile}.SaveState(context.Background(), state)
+}
+
+// runExport reads the configuration of the Vault from VAULT_* variables and writes it as resources.
+func runExport(output string) error {
+	client, err := newVaultClient()
+	if err != nil {
+		return err
+	}
+	resources, err := gitops.Export(context.Background(), client, gitops.ExportOptions{
+		Warn: func(msg string) { fmt.Fprintf(os.Stderr, "warning: %s\n", msg) },
+	})
+	if err != nil {
+		return err
+	}
+	out, err := gitops.MarshalResourcesYAML(resources)
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	if err := os.WriteFile(output, out, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("exported %d resources to %s\n", len(resources), output)
+	return nil
+}
+
+// newVaultClient returns a Vault client configured from VAULT_* environment variables.
+func newVaultClient() (*api.Client, error) {
+	if strings.TrimSpace(os.Getenv("VAULT_TOKEN")) == "" {
+		return nil, fmt.Errorf("VAULT_TOKEN is not set")
+	}
+	cfg := api.DefaultConfig()
+	if err := cfg.ReadEnvironment(); err != nil {
+		return nil, fmt.Errorf("vault config: %w", err)
+	}
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("vault client: %w", err)
+	}
+	return client, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func printUsage() {
-	fmt.Fprintln(os.Stderr, "usage: gitops-tool lint <path>")
-	fmt.Fprintln(os.Stderr, "       gitops-tool test [-state <file>] <path>")
+	fmt.Fprintln(os.Stderr, "usage: gitops-tool lint [-vars <file>] [-overlay <name>] [-ignore <patterns>] [-format text|json|sarif] [-openapi <file>] [-severity <rules>] [-print] <path>")
+	fmt.Fprintln(os.Stderr, "       gitops-tool plan [-state <file>] [-vars <file>] [-overlay <name>] [-ignore <patterns>] [-max-deletions <n|n%>] [-allow-destroy] <path>")
+	fmt.Fprintln(os.Stderr, "       gitops-tool test [-state <file>] [-vars <file>] [-overlay <name>] [-ignore <patterns>] [-max-deletions <n|n%>] [-allow-destroy] [-concurrency <n>] [-retry-*] [-atomic] <path>")
+	fmt.Fprintln(os.Stderr, "       gitops-tool import -state <file> [-vars <file>] [-overlay <name>] [-ignore <patterns>] [-read] [-read-path <path>] <path> <key>...")
+	fmt.Fprintln(os.Stderr, "       gitops-tool export [-o <file>]")
 	fmt.Fprintln(os.Stderr, "       gitops-tool version")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "  lint:    validate declarative YAML (path, data, names, dependencies).")
+	fmt.Fprintln(os.Stderr, "           -print: print resources after generator expansion and template rendering.")
+	fmt.Fprintln(os.Stderr, "           -format: diagnostics format: text (default, stderr), json or sarif (stdout).")
+	fmt.Fprintln(os.Stderr, "           -openapi: Vault OpenAPI document (sys/internal/specs/openapi) to check data fields and types.")
+	fmt.Fprintln(os.Stderr, "           -severity: override rule severities, e.g. policy-self-escalation=off,policy-sys-write=error.")
+	fmt.Fprintln(os.Stderr, "  plan:    show what test/apply would create, update or delete; does not contact Vault.")
 	fmt.Fprintln(os.Stderr, "  test:    run apply against Vault; requires VAULT_ADDR and VAULT_TOKEN.")
 	fmt.Fprintln(os.Stderr, "           -state: optional file to load state from and save state to.")
+	fmt.Fprintln(os.Stderr, "           -vars:  optional YAML file with variables for 'templating: go' resources.")
+	fmt.Fprintln(os.Stderr, "           -overlay: optional overlay name; patches from <path>/overlays/<name>/ are applied.")
+	fmt.Fprintln(os.Stderr, "           -ignore: files under <path> that are not resources, e.g. openapi.json,generated/*.json;")
+	fmt.Fprintln(os.Stderr, "           lint warns about every .json file it skips.")
+	fmt.Fprintln(os.Stderr, "           -max-deletions: fail if more resources would be deleted (count or percentage of state).")
+	fmt.Fprintln(os.Stderr, "           -allow-destroy: allow deleting sys/mounts/* and sys/auth/*; prevent_destroy still applies.")
+	fmt.Fprintln(os.Stderr, "           -concurrency: (test only) apply up to n resources in parallel once their dependencies are done.")
+	fmt.Fprintln(os.Stderr, "           -retry-max-attempts, -retry-backoff, -retry-max-backoff, -retry-on: (test only) retry policy for")
+	fmt.Fprintln(os.Stderr, "           transient Vault errors (429, 5xx); resources can override it with 'retry'.")
+	fmt.Fprintln(os.Stderr, "           -atomic: (test only) if a resource fails, undo the changes already made by the run.")
+	fmt.Fprintln(os.Stderr, "  import:  record existing Vault resources (by state key) in the state file as already applied.")
+	fmt.Fprintln(os.Stderr, "           -read: read their current response data from Vault (VAULT_ADDR, VAULT_TOKEN).")
+	fmt.Fprintln(os.Stderr, "           -read-path: read the response data from another path, e.g. pki/cert/ca.")
+	fmt.Fprintln(os.Stderr, "  export:  write the configuration of a live Vault (VAULT_ADDR, VAULT_TOKEN) as resources;")
+	fmt.Fprintln(os.Stderr, "           mounts, auth methods, policies, roles, identity and namespaces. Secret data is not exported.")
 	fmt.Fprintln(os.Stderr, "  version: print version and exit.")
-	fmt.Fprintln(os.Stderr, "  path:    file (.yaml/.yml) or directory (recursively collects .yaml/.yml)")
+	fmt.Fprintln(os.Stderr, "  path:    file (.yaml/.yml/.json/.gitops.hcl) or directory (recursively collects them)")
 }
@@ -13,33 +13,48 @@ import (
 
 // Engine abstracts a commit-processing backend (gitops, terraform, etc.).
 // Implementations self-register via init() so build tags can control which
-// engines are compiled into the binary.
+// engines are compiled into the binary. Every backend (mount) gets its own engine.
 type Engine interface {
-	ProcessCommit(ctx context.Context, storage logical.Storage, worktreeFS billy.Filesystem, logger hclog.Logger) error
+	ProcessCommit(ctx context.Context, storage logical.Storage, worktreeFS billy.Filesystem, commit Commit, logger hclog.Logger) error
 	Paths(baseBackend *framework.Backend) []*framework.Path
+	// SealWrapStorage returns the storage keys and prefixes of the engine that hold secrets and
+	// must be seal-wrapped.
+	SealWrapStorage() []string
+}
+
+// Commit describes the commit being processed.
+type Commit struct {
+	Hash    string
+	Message string
+	// VerifySignatures returns an error unless the commit has at least n verified signatures
+	// from trusted keys. Nil when signatures cannot be checked.
+	VerifySignatures func(n int) error
 }
 
 var (
 	mu       sync.RWMutex
-	registry = map[string]Engine{}
+	registry = map[string]func() Engine{}
 )
 
-// Register adds an engine under the given name. Intended to be called from init().
-func Register(name string, e Engine) {
+// Register adds an engine constructor under the given name. Intended to be called from init().
+func Register(name string, newEngine func() Engine) {
 	mu.Lock()
 	defer mu.Unlock()
 	if _, dup := registry[name]; dup {
 		panic(fmt.Sprintf("engine: Register called twice for %q", name))
 	}
-	registry[name] = e
+	registry[name] = newEngine
 }
 
-// Get returns a registered engine by name.
+// Get returns a new instance of a registered engine by name.
 func Get(name string) (Engine, bool) {
 	mu.RLock()
 	defer mu.RUnlock()
-	e, ok := registry[name]
-	return e, ok
+	newEngine, ok := registry[name]
+	if !ok {
+		return nil, false
+	}
+	return newEngine(), true
 }
 
 // RegisteredNames returns the names of all registered engines.
@@ -0,0 +1,117 @@
+package gitops
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Abandon_Lint(t *testing.T) {
+	resources, err := LoadResourcesFromFS(writeFSFiles(t, map[string]string{"a.yaml": `
+name: kv
+path: sys/mounts/kv
+lifecycle: abandon
+---
+name: role
+path: auth/approle/role/app
+dependencies: [kv]
+data: {}
+---
+path: sys/policies/acl/x
+lifecycle: forget
+data: {}
+`}), "", LoadOptions{})
+	require.NoError(t, err)
+	var rules []string
+	for _, d := range LintDiagnostics(resources, LintOptions{}) {
+		rules = append(rules, d.Rule)
+	}
+	require.ElementsMatch(t, []string{RuleUnknownDependency, RuleInvalidLifecycle}, rules)
+}
+
+func Test_Abandon_Apply(t *testing.T) {
+	client, requests := testVaultClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	state := &State{Resources: map[string]StateResource{
+		"kv":     {Path: "sys/mounts/kv", DataDigest: "x", PreventDestroy: true},
+		"reader": {Path: "sys/policies/acl/reader", DataDigest: "y"},
+	}}
+	resources := []Resource{
+		{Name: "kv", Path: "sys/mounts/kv", Lifecycle: LifecycleAbandon},
+		{Name: "reader", Path: "sys/policies/acl/reader", Lifecycle: LifecycleAbandon},
+		{Name: "gone", Path: "sys/policies/acl/gone", Lifecycle: LifecycleAbandon},
+	}
+	changes, err := Plan(resources, state)
+	require.NoError(t, err)
+	require.Equal(t, []PlanChange{
+		{Key: "kv", Path: "sys/mounts/kv", Action: PlanAbandon},
+		{Key: "reader", Path: "sys/policies/acl/reader", Action: PlanAbandon},
+	}, changes)
+
+	storage := &logical.InmemStorage{}
+	ctx := context.Background()
+	_, err = Apply(ctx, resources, client, state, NewStorageStateWriter(storage), ApplyOptions{MaxDeletions: "0", Commit: "abc"})
+	require.NoError(t, err)
+	require.Empty(t, *requests)
+	require.Empty(t, state.Resources)
+
+	history, err := GetHistory(ctx, storage)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	for _, e := range history {
+		require.Equal(t, string(PlanAbandon), e.Action)
+		require.Equal(t, "abc", e.Commit)
+	}
+}
+
+func Test_StateForget(t *testing.T) {
+	ctx := context.Background()
+	fb := &framework.Backend{}
+	fb.Paths = Paths(fb)
+	storage := &logical.InmemStorage{}
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+	require.NoError(t, fb.Setup(ctx, config))
+
+	state := &State{Resources: map[string]StateResource{
+		"sys/policies/acl/reader": {Path: "sys/policies/acl/reader"},
+		"kv":                      {Path: "sys/mounts/kv"},
+	}}
+	require.NoError(t, NewStorageStateWriter(storage).SaveState(ctx, state))
+
+	resp, err := fb.HandleRequest(ctx, &logical.Request{Operation: logical.UpdateOperation, Path: "state/forget/sys/policies/acl/reader", Storage: storage})
+	require.NoError(t, err)
+	require.False(t, resp.IsError(), "%v", resp.Data)
+	require.Equal(t, "sys/policies/acl/reader", resp.Data["path"])
+
+	resp, err = fb.HandleRequest(ctx, &logical.Request{Operation: logical.UpdateOperation, Path: "state/forget/nope", Storage: storage})
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+
+	var stored State
+	entry, err := storage.Get(ctx, StorageKeyState)
+	require.NoError(t, err)
+	require.NoError(t, entry.DecodeJSON(&stored))
+	require.Equal(t, []string{"kv"}, keysOf(stored.Resources))
+
+	resp, err = fb.HandleRequest(ctx, &logical.Request{Operation: logical.ReadOperation, Path: "history", Storage: storage})
+	require.NoError(t, err)
+	entries := resp.Data["entries"].([]map[string]interface{})
+	require.Len(t, entries, 1)
+	require.Equal(t, HistoryForget, entries[0]["action"])
+	require.Equal(t, "sys/policies/acl/reader", entries[0]["key"])
+}
+
+func keysOf(m map[string]StateResource) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -7,6 +7,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/vault/api"
 )
@@ -17,170 +20,415 @@ type StateWriter interface {
 }
 
 // Apply runs vault-gitops apply: resolve templates, POST create/update, DELETE removed, update state.
-func Apply(ctx context.Context, resources []Resource, client *api.Client, state *State, writer StateWriter) error {
+// Deletion safeguards (see CheckDeletions) are checked first; if one trips, nothing is applied.
+// Resources are applied level by level along the dependency graph, up to opts.Concurrency at a time;
+// a resource starts only after all its dependencies are done.
+// Requests failing with a transient error are retried according to opts.Retry and the resource's 'retry'.
+// With opts.Atomic a failure rolls back the Vault changes already made by the run (see rollback).
+func Apply(ctx context.Context, resources []Resource, client *api.Client, state *State, writer StateWriter, opts ApplyOptions) (result ApplyResult, err error) {
 	if client == nil {
-		return fmt.Errorf("vault client is required")
+		return result, fmt.Errorf("vault client is required")
 	}
 	if state == nil || state.Resources == nil {
 		state = &State{Resources: make(map[string]StateResource)}
 	}
 
-	order, err := topologicalOrder(resources)
+	levels, err := dependencyLevels(resources)
 	if err != nil {
-		return err
+		return result, err
+	}
+	changes, err := Plan(resources, state)
+	if err != nil {
+		return result, err
+	}
+	if err := CheckDeletions(changes, state, opts); err != nil {
+		return result, err
+	}
+	if client, err = withRetryAfter(client); err != nil {
+		return result, err
 	}
 
 	currentKeys := make(map[string]bool)
 	for _, r := range resources {
 		currentKeys[r.Key()] = true
 	}
+	a := &applier{ctx: ctx, client: client, state: state, writer: writer, opts: opts}
+	a.history, _ = writer.(HistoryRecorder)
+	if opts.Atomic {
+		a.snapshot = make(map[string]StateResource, len(state.Resources))
+		for key, res := range state.Resources {
+			a.snapshot[key] = res
+		}
+	}
+	defer func() {
+		result.Retries = int(a.retries.Load())
+		result.RolledBack = a.rolledBack
+	}()
 
 	// Create or update
-	for _, idx := range order {
-		r := &resources[idx]
-		key := r.Key()
-		resolvedData, err := ResolveTemplates(r.Data, state)
-		if err != nil {
-			msg := fmt.Sprintf("resource %s%s: %v", r.Namespace, r.Path, err)
-			if !r.IgnoreFailures {
-				return fmt.Errorf("%s", msg)
-			}
-			continue
+	for _, level := range levels {
+		if err := a.applyLevel(resources, level); err != nil {
+			return result, a.rollback(err)
 		}
-		rev := revisionForDigest(r.Revision)
-		digest := dataDigestWithRevision(resolvedData, rev)
-		if prev, inState := state.Resources[key]; inState && prev.DataDigest == digest {
-			continue
+	}
+
+	// Delete
+	var toDelete []string
+	for key, res := range state.Resources {
+		if !currentKeys[key] && !res.Imported {
+			toDelete = append(toDelete, key)
 		}
-		// Maybe state exists under old key (hash) after user added name to resource.
-		if _, inState := state.Resources[key]; !inState {
-			if oldKey, prev, found := state.FindByNsPath(r.NamespaceOrDefault(), r.Path); found && prev.DataDigest == digest {
-				state.Resources[key] = StateResource{
-					DataDigest:     prev.DataDigest,
-					Dependencies:   prev.Dependencies,
-					IgnoreFailures: prev.IgnoreFailures,
-					ResponseData:   prev.ResponseData,
-					Namespace:      r.NamespaceOrDefault(),
-					Path:           r.Path,
-				}
-				delete(state.Resources, oldKey)
-				if writer != nil {
-					if err := writer.SaveState(ctx, state); err != nil {
-						msg := fmt.Sprintf("resource %s%s: save state (migrate key): %v", r.Namespace, r.Path, err)
-						if !r.IgnoreFailures {
-							return fmt.Errorf("%s", msg)
-						}
-						continue
-					}
-				}
-				continue
-			}
+	}
+	for _, key := range deleteOrderFromState(state, toDelete) {
+		if err := a.delete(key); err != nil {
+			return result, a.rollback(err)
 		}
-		path := strings.TrimPrefix(r.Path, "/")
-		reqClient := client
-		if r.Namespace != "" {
-			reqClient = client.WithNamespace(strings.TrimSuffix(r.Namespace, "/"))
+	}
+
+	return result, nil
+}
+
+// ApplyResult summarizes an Apply run.
+type ApplyResult struct {
+	// Retries is the number of requests sent again after a transient error.
+	Retries int
+	// RolledBack is the number of changes undone after a failure in atomic mode.
+	RolledBack int
+}
+
+// applier holds the shared state of one Apply run.
+type applier struct {
+	ctx     context.Context
+	client  *api.Client
+	writer  StateWriter
+	history HistoryRecorder
+	opts    ApplyOptions
+	retries atomic.Int64
+
+	mu      sync.Mutex // guards state and journal, and serializes writer and history calls
+	state   *State
+	journal []change // Vault changes of the run, in order; only with opts.Atomic
+
+	snapshot   map[string]StateResource // state before the run; only with opts.Atomic
+	rolledBack int
+}
+
+// applyLevel applies resources[idx] for idx in level, up to opts.Concurrency at a time.
+// After a failure no new resources are started; the first failure in level order is returned.
+func (a *applier) applyLevel(resources []Resource, level []int) error {
+	workers := a.opts.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(level) {
+		workers = len(level)
+	}
+	errs := make([]error, len(level))
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, workers)
+	for i := range level {
+		slots <- struct{}{} // wait for a free slot; a failure of a finished resource is visible after it
+		if failed.Load() || a.ctx.Err() != nil {
+			break
 		}
-		method := normalizeMethod(r.Method)
-
-		var secret *api.Secret
-		var applyErr error
-
-		if method == "GET" {
-			secret, applyErr = reqClient.Logical().ReadWithContext(ctx, path)
-		} else {
-			dataMap, err := dataToDataMap(resolvedData)
-			if err != nil {
-				msg := fmt.Sprintf("resource %s%s: json encode: %v", r.Namespace, r.Path, err)
-				if !r.IgnoreFailures {
-					return fmt.Errorf("%s", msg)
-				}
-				continue
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if errs[i] = a.apply(&resources[level[i]]); errs[i] != nil {
+				failed.Store(true)
 			}
-			secret, applyErr = reqClient.Logical().WriteWithContext(ctx, path, dataMap)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
 		}
+	}
+	return a.ctx.Err()
+}
+
+// appliedData returns the declared data to keep in state for a later rollback (atomic mode only).
+func (a *applier) appliedData(resolvedData interface{}) interface{} {
+	if !a.opts.Atomic {
+		return nil
+	}
+	return resolvedData
+}
+
+// fail returns the error for a failed resource, or nil if it has ignore_failures.
+func fail(r *Resource, format string, args ...interface{}) error {
+	if r.IgnoreFailures {
+		return nil
+	}
+	return fmt.Errorf(format, args...)
+}
+
+// save persists the state and records a history entry; a.mu must be held.
+func (a *applier) save(action PlanAction, key, namespace, path string) (saveErr, historyErr error) {
+	return a.saveDetail(action, key, namespace, path, "")
+}
 
-		if applyErr != nil {
-			msg := formatVaultErr(r.Namespace, r.Path, applyErr)
-			if !r.IgnoreFailures {
-				return fmt.Errorf("%s", msg)
+// saveDetail is save with a detail in the history entry.
+func (a *applier) saveDetail(action PlanAction, key, namespace, path, detail string) (saveErr, historyErr error) {
+	if a.writer != nil {
+		if err := a.writer.SaveState(a.ctx, a.state); err != nil {
+			return err, nil
+		}
+	}
+	if a.history != nil && action != "" {
+		return nil, a.history.RecordHistory(a.ctx, HistoryEntry{Commit: a.opts.Commit, Action: string(action), Key: key, Namespace: namespace, Path: path, Detail: detail})
+	}
+	return nil, nil
+}
+
+// apply creates or updates one resource. State is only accessed under a.mu; the Vault request
+// is sent without holding it.
+func (a *applier) apply(r *Resource) error {
+	key := r.Key()
+	a.mu.Lock()
+	resolvedData, digest, done, err := a.prepare(r, key)
+	prev, inState := a.state.Resources[key]
+	a.mu.Unlock()
+	if done || err != nil {
+		return err
+	}
+	if r.IsDataSource() {
+		return a.read(r, key, resolvedData, digest)
+	}
+
+	path := strings.TrimPrefix(r.Path, "/")
+	reqClient := a.client
+	if r.Namespace != "" {
+		reqClient = a.client.WithNamespace(strings.TrimSuffix(r.Namespace, "/"))
+	}
+	method := normalizeMethod(r.Method)
+	retry := a.opts.Retry.Merge(r.Retry)
+
+	var dataMap map[string]interface{}
+	if method != "GET" && (method != "DELETE" || resolvedData != nil) {
+		if dataMap, err = dataToDataMap(resolvedData); err != nil {
+			return fail(r, "resource %s%s: json encode: %v", r.Namespace, r.Path, err)
+		}
+	}
+	var undo *change
+	if a.opts.Atomic && method != "GET" {
+		undo = &change{action: PlanCreate, key: key, namespace: r.NamespaceOrDefault(), path: r.Path, method: method, retry: retry}
+		switch {
+		case method == "DELETE":
+			// Rollback writes back what the request deletes; nothing to restore if it does not exist.
+			if undo.prev = a.priorData(reqClient, r.Path, nil, retry); undo.prev == nil {
+				undo = nil
+			} else {
+				undo.action, undo.method = PlanDelete, "POST"
 			}
-			continue
+		case inState || method == "PATCH":
+			// A patch always changes an existing object.
+			undo.action, undo.prev = PlanUpdate, a.priorData(reqClient, r.Path, prev.AppliedData, retry)
 		}
+	}
 
-		var responseData interface{}
-		if secret != nil && secret.Data != nil {
-			responseData = secret.Data
+	var secret *api.Secret
+	applyErr := retry.do(a.ctx, &a.retries, func(ctx context.Context) (err error) {
+		secret, err = send(ctx, reqClient, method, path, dataMap)
+		return err
+	})
+	if respErr, ok := applyErr.(*api.ResponseError); ok && method == "DELETE" && respErr.StatusCode == 404 {
+		applyErr = nil // already deleted
+	}
+	if applyErr != nil {
+		return fail(r, "%s", formatVaultErr(r.Namespace, r.Path, applyErr))
+	}
+
+	var responseData interface{}
+	if secret != nil && secret.Data != nil {
+		responseData = keepResponse(secret.Data, r.KeepResponse)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if undo != nil {
+		a.record(*undo)
+	}
+	action := PlanCreate
+	if _, inState := a.state.Resources[key]; inState {
+		action = PlanUpdate
+	}
+	appliedAt := time.Now().UTC()
+	ns, pathN := r.location()
+	a.state.Resources[key] = StateResource{
+		DataDigest:     digest,
+		Dependencies:   r.Dependencies,
+		IgnoreFailures: r.IgnoreFailures,
+		PreventDestroy: r.PreventDestroy,
+		ResponseData:   responseData,
+		AppliedData:    a.appliedData(resolvedData),
+		Delete:         deleteSpecFor(r),
+		Commit:         a.opts.Commit,
+		AppliedAt:      &appliedAt,
+		Namespace:      ns,
+		Path:           pathN,
+	}
+	saveErr, historyErr := a.save(action, key, ns, pathN)
+	if saveErr != nil {
+		return fail(r, "resource %s%s: save state: %v", r.Namespace, r.Path, saveErr)
+	}
+	if historyErr != nil {
+		return fail(r, "resource %s%s: record history: %v", r.Namespace, r.Path, historyErr)
+	}
+	return nil
+}
+
+// prepare resolves the data of r and handles everything that needs no Vault request:
+// abandon, pending import, unchanged data and a key migration. done reports that r is finished.
+// a.mu must be held.
+func (a *applier) prepare(r *Resource, key string) (resolvedData interface{}, digest string, done bool, err error) {
+	state := a.state
+	if r.Abandoned() {
+		prev, inState := state.Resources[key]
+		if !inState {
+			return nil, "", true, nil
 		}
+		delete(state.Resources, key)
+		saveErr, historyErr := a.save(PlanAbandon, key, prev.Namespace, prev.Path)
+		if saveErr != nil {
+			return nil, "", true, fmt.Errorf("abandon %s%s: save state: %v", prev.Namespace, prev.Path, saveErr)
+		}
+		if historyErr != nil {
+			return nil, "", true, fmt.Errorf("abandon %s%s: record history: %v", prev.Namespace, prev.Path, historyErr)
+		}
+		return nil, "", true, nil
+	}
+	resolvedData, err = resolveResourceData(r, state)
+	if err != nil {
+		return nil, "", true, fail(r, "resource %s%s: %v", r.Namespace, r.Path, err)
+	}
+	rev := revisionForDigest(r.Revision)
+	digest = dataDigestWithRevision(resolvedData, rev)
+	prev, inState := state.Resources[key]
+	if r.IsDataSource() {
+		return resolvedData, digest, dataSourceFresh(r, prev, digest, time.Now()), nil
+	}
+	switch {
+	case inState && prev.Imported:
+		ns, pathN := r.location()
 		state.Resources[key] = StateResource{
 			DataDigest:     digest,
 			Dependencies:   r.Dependencies,
 			IgnoreFailures: r.IgnoreFailures,
-			ResponseData:   responseData,
-			Namespace:      r.NamespaceOrDefault(),
-			Path:           r.Path,
+			PreventDestroy: r.PreventDestroy,
+			ResponseData:   keepResponse(prev.ResponseData, r.KeepResponse),
+			AppliedData:    a.appliedData(resolvedData),
+			Delete:         deleteSpecFor(r),
+			Commit:         a.opts.Commit,
+			Namespace:      ns,
+			Path:           pathN,
 		}
-		if writer != nil {
-			if err := writer.SaveState(ctx, state); err != nil {
-				msg := fmt.Sprintf("resource %s%s: save state: %v", r.Namespace, r.Path, err)
-				if !r.IgnoreFailures {
-					return fmt.Errorf("%s", msg)
-				}
-				continue
+		saveErr, historyErr := a.save(PlanImport, key, ns, pathN)
+		if saveErr != nil {
+			return nil, "", true, fail(r, "resource %s%s: save state (import): %v", r.Namespace, r.Path, saveErr)
+		}
+		if historyErr != nil {
+			return nil, "", true, fail(r, "resource %s%s: record history: %v", r.Namespace, r.Path, historyErr)
+		}
+		return nil, "", true, nil
+	case inState && prev.DataDigest == digest:
+		spec, kept := deleteSpecFor(r), keepResponse(prev.ResponseData, r.KeepResponse)
+		if prev.PreventDestroy != r.PreventDestroy || !sameJSON(prev.Delete, spec) || !sameJSON(prev.ResponseData, kept) {
+			prev.PreventDestroy, prev.Delete, prev.ResponseData = r.PreventDestroy, spec, kept
+			state.Resources[key] = prev
+			if saveErr, _ := a.save("", key, "", ""); saveErr != nil {
+				return nil, "", true, fail(r, "resource %s%s: save state: %v", r.Namespace, r.Path, saveErr)
 			}
 		}
+		return nil, "", true, nil
+	case !inState:
+		// Maybe state exists under old key (hash) after user added name to resource.
+		if oldKey, prev, found := state.FindByNsPath(r.NamespaceOrDefault(), r.Path); found && prev.DataDigest == digest {
+			ns, pathN := r.location()
+			state.Resources[key] = StateResource{
+				DataDigest:     prev.DataDigest,
+				Dependencies:   prev.Dependencies,
+				IgnoreFailures: prev.IgnoreFailures,
+				PreventDestroy: r.PreventDestroy,
+				ResponseData:   keepResponse(prev.ResponseData, r.KeepResponse),
+				AppliedData:    prev.AppliedData,
+				Delete:         deleteSpecFor(r),
+				Commit:         prev.Commit,
+				AppliedAt:      prev.AppliedAt,
+				Namespace:      ns,
+				Path:           pathN,
+			}
+			delete(state.Resources, oldKey)
+			if saveErr, _ := a.save("", key, "", ""); saveErr != nil {
+				return nil, "", true, fail(r, "resource %s%s: save state (migrate key): %v", r.Namespace, r.Path, saveErr)
+			}
+			return nil, "", true, nil
+		}
 	}
+	return resolvedData, digest, false, nil
+}
 
-	// Delete
-	var toDelete []string
-	for key := range state.Resources {
-		if !currentKeys[key] {
-			toDelete = append(toDelete, key)
+// delete deletes a state entry that is no longer declared: DELETE on its path, or the request
+// of its 'delete' block; with 'delete: none' the entry is only dropped from state.
+func (a *applier) delete(key string) error {
+	res := a.state.Resources[key]
+	ns := res.Namespace
+	ignoreFailures := res.IgnoreFailures
+	method, path, data, doSend, err := deleteRequest(res, a.state)
+	if err != nil {
+		if ignoreFailures {
+			return nil
 		}
+		return fmt.Errorf("delete %s%s: %v", ns, res.Path, err)
 	}
-	deleteOrder := deleteOrderFromState(state, toDelete)
-	for _, key := range deleteOrder {
-		res := state.Resources[key]
-		ns, path := res.Namespace, strings.TrimPrefix(res.Path, "/")
-		ignoreFailures := res.IgnoreFailures
-		reqClient := client
+	saveMsg := "save state"
+	detail := ""
+	var undo *change
+	if !doSend {
+		detail = "delete: none, kept in Vault"
+	} else {
+		reqClient := a.client
 		if ns != "" {
-			reqClient = client.WithNamespace(strings.TrimSuffix(ns, "/"))
+			reqClient = a.client.WithNamespace(strings.TrimSuffix(ns, "/"))
 		}
-		_, err := reqClient.Logical().DeleteWithContext(ctx, path)
-		if err == nil {
-			delete(state.Resources, key)
-			if writer != nil {
-				if err := writer.SaveState(ctx, state); err != nil {
-					msg := fmt.Sprintf("delete %s%s: save state: %v", ns, res.Path, err)
-					if !ignoreFailures {
-						return fmt.Errorf("%s", msg)
-					}
-					continue
-				}
-			}
-			continue
+		if a.opts.Atomic {
+			undo = &change{action: PlanDelete, key: key, namespace: ns, path: res.Path, method: "POST", retry: a.opts.Retry, prev: a.priorData(reqClient, res.Path, res.AppliedData, a.opts.Retry)}
 		}
-		respErr, ok := err.(*api.ResponseError)
-		if ok && (respErr.StatusCode == 404 || respErr.StatusCode == 405) {
-			delete(state.Resources, key)
-			if writer != nil {
-				if err := writer.SaveState(ctx, state); err != nil {
-					msg := fmt.Sprintf("delete %s%s: save state after %d: %v", ns, res.Path, respErr.StatusCode, err)
-					if !ignoreFailures {
-						return fmt.Errorf("%s", msg)
-					}
-					continue
+		err := a.opts.Retry.do(a.ctx, &a.retries, func(ctx context.Context) error {
+			_, err := send(ctx, reqClient, method, strings.TrimPrefix(path, "/"), data)
+			return err
+		})
+		if err != nil {
+			respErr, ok := err.(*api.ResponseError)
+			if !ok || (respErr.StatusCode != 404 && respErr.StatusCode != 405) {
+				if ignoreFailures {
+					return nil
 				}
+				return fmt.Errorf("%s", formatVaultErr(ns, path, err))
 			}
-			continue
-		}
-		msg := formatVaultErr(ns, res.Path, err)
-		if !ignoreFailures {
-			return fmt.Errorf("%s", msg)
+			saveMsg = fmt.Sprintf("save state after %d", respErr.StatusCode)
+			undo = nil // nothing was deleted
 		}
 	}
-
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if undo != nil {
+		a.record(*undo)
+	}
+	delete(a.state.Resources, key)
+	saveErr, historyErr := a.saveDetail(PlanDelete, key, ns, res.Path, detail)
+	if ignoreFailures {
+		return nil
+	}
+	if saveErr != nil {
+		return fmt.Errorf("delete %s%s: %s: %v", ns, res.Path, saveMsg, saveErr)
+	}
+	if historyErr != nil {
+		return fmt.Errorf("delete %s%s: record history: %v", ns, res.Path, historyErr)
+	}
 	return nil
 }
 
@@ -207,15 +455,41 @@ func revisionForDigest(revision int) uint64 {
 	return uint64(revision)
 }
 
+// normalizeMethod returns GET, PUT, PATCH or DELETE as given, and POST for anything else.
 func normalizeMethod(m string) string {
-	switch strings.ToUpper(strings.TrimSpace(m)) {
-	case "GET":
-		return "GET"
+	switch m := strings.ToUpper(strings.TrimSpace(m)); m {
+	case "GET", "PUT", "PATCH", "DELETE":
+		return m
 	default:
 		return "POST"
 	}
 }
 
+// send sends one request: GET reads, POST and PUT write (Vault handles them the same),
+// PATCH sends a JSON merge patch and DELETE deletes, with data as query parameters.
+func send(ctx context.Context, client *api.Client, method, path string, data map[string]interface{}) (*api.Secret, error) {
+	switch method {
+	case "GET":
+		return client.Logical().ReadWithContext(ctx, path)
+	case "PATCH":
+		return client.Logical().JSONMergePatch(ctx, path, data)
+	case "DELETE":
+		if len(data) == 0 {
+			return client.Logical().DeleteWithContext(ctx, path)
+		}
+		return client.Logical().DeleteWithDataWithContext(ctx, path, queryValues(data))
+	default:
+		return client.Logical().WriteWithContext(ctx, path, data)
+	}
+}
+
+// sameJSON reports whether a and b encode to the same JSON.
+func sameJSON(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
+
 func dataDigestWithRevision(data interface{}, revision uint64) string {
 	input := map[string]interface{}{"data": data, "revision": revision}
 	b, err := json.Marshal(input)
@@ -308,3 +582,31 @@ func topologicalOrder(resources []Resource) ([]int, error) {
 	}
 	return order, nil
 }
+
+// dependencyLevels groups resource indexes into levels: a resource is in the level after the
+// last level of its dependencies, so the resources of one level are independent of each other.
+// Within a level, resources keep their topological order.
+func dependencyLevels(resources []Resource) ([][]int, error) {
+	order, err := topologicalOrder(resources)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]int)
+	for i := range resources {
+		byName[resources[i].EffectiveName()] = i
+	}
+	level := make([]int, len(resources))
+	var levels [][]int
+	for _, i := range order {
+		for _, depName := range resources[i].Dependencies {
+			if depIdx, ok := byName[depName]; ok && level[depIdx]+1 > level[i] {
+				level[i] = level[depIdx] + 1
+			}
+		}
+		if level[i] == len(levels) {
+			levels = append(levels, nil)
+		}
+		levels[level[i]] = append(levels[level[i]], i)
+	}
+	return levels, nil
+}
@@ -0,0 +1,117 @@
+package gitops
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_dependencyLevels(t *testing.T) {
+	resources := []Resource{
+		{Name: "role", Path: "auth/approle/role/app", Dependencies: []string{"approle", "policy"}},
+		{Name: "approle", Path: "sys/auth/approle"},
+		{Name: "policy", Path: "sys/policies/acl/app", Dependencies: []string{"kv"}},
+		{Name: "kv", Path: "sys/mounts/kv"},
+		{Name: "secret-id", Path: "auth/approle/role/app/secret-id", Dependencies: []string{"role"}},
+	}
+	levels, err := dependencyLevels(resources)
+	require.NoError(t, err)
+	require.Equal(t, [][]int{{1, 3}, {2}, {0}, {4}}, levels)
+
+	resources[3].Dependencies = []string{"secret-id"}
+	_, err = dependencyLevels(resources)
+	require.Error(t, err)
+}
+
+func Test_Apply_Concurrency(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	var mu sync.Mutex
+	var bodies []string
+	client, _ := testVaultClient(t, func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, r.URL.Path+" "+string(body))
+		mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/broken"):
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors": ["invalid"]}`))
+		case strings.HasPrefix(r.URL.Path, "/v1/sys/policies/acl/"):
+			_, _ = w.Write([]byte(`{"data": {"name": "` + strings.TrimPrefix(r.URL.Path, "/v1/sys/policies/acl/") + `"}}`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	newResources := func() []Resource {
+		resources := []Resource{
+			{Name: "broken", Path: "sys/policies/acl/broken", IgnoreFailures: true, Data: map[string]interface{}{}},
+			{Name: "role", Path: "auth/approle/role/app", Dependencies: []string{"a", "b"}, Data: map[string]interface{}{"a": "<a:name>", "b": "<b:name>"}},
+		}
+		for _, name := range []string{"a", "b", "c", "d"} {
+			resources = append(resources, Resource{Name: name, Path: "sys/policies/acl/" + name, Data: map[string]interface{}{}})
+		}
+		return resources
+	}
+
+	tests := []struct {
+		name        string
+		concurrency int
+		wantMax     int32
+	}{
+		{name: "sequential", concurrency: 0, wantMax: 1},
+		{name: "parallel", concurrency: 8, wantMax: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxInFlight.Store(0)
+			bodies = nil
+			storage := &logical.InmemStorage{}
+			state := &State{Resources: map[string]StateResource{}}
+			ctx := context.Background()
+			_, err := Apply(ctx, newResources(), client, state, NewStorageStateWriter(storage), ApplyOptions{Concurrency: tt.concurrency})
+			require.NoError(t, err)
+			require.Equal(t, tt.wantMax, maxInFlight.Load())
+			require.Len(t, bodies, 6)
+			require.Equal(t, `/v1/auth/approle/role/app {"a":"a","b":"b"}`, bodies[5], "dependent resource runs last with resolved templates")
+			require.Len(t, state.Resources, 5, "the ignored failure is not in state")
+
+			var stored State
+			entry, err := storage.Get(ctx, StorageKeyState)
+			require.NoError(t, err)
+			require.NoError(t, entry.DecodeJSON(&stored))
+			require.Len(t, stored.Resources, 5)
+			history, err := GetHistory(ctx, storage)
+			require.NoError(t, err)
+			require.Len(t, history, 5)
+		})
+	}
+
+	t.Run("failure stops the next level", func(t *testing.T) {
+		bodies = nil
+		resources := newResources()
+		resources[0].IgnoreFailures = false
+		state := &State{Resources: map[string]StateResource{}}
+		_, err := Apply(context.Background(), resources, client, state, nil, ApplyOptions{Concurrency: 8})
+		require.ErrorContains(t, err, "sys/policies/acl/broken: 400")
+		require.Len(t, bodies, 5, "level 0 completes, role is not applied")
+		require.Len(t, state.Resources, 4)
+		require.NotContains(t, state.Resources, "role")
+	})
+}
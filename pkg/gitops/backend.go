@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/framework"
@@ -13,7 +14,20 @@ import (
 )
 
 const (
-	FieldNamePath = "path"
+	FieldNamePath     = "path"
+	FieldNameVarsFile = "vars_file"
+	FieldNameOverlay  = "overlay"
+
+	FieldNameMaxDeletionsPerRun = "max_deletions_per_run"
+	FieldNameDestroySignatures  = "destroy_signatures"
+	FieldNameConcurrency        = "concurrency"
+	FieldNameRetryMaxAttempts   = "retry_max_attempts"
+	FieldNameRetryBackoff       = "retry_backoff"
+	FieldNameRetryMaxBackoff    = "retry_max_backoff"
+	FieldNameRetryOn            = "retry_on"
+	FieldNameAtomic             = "atomic"
+	FieldNameLintSeverity       = "lint_severity"
+	FieldNameIgnore             = "ignore"
 
 	StorageKeyConfiguration = "gitops_configuration"
 	StorageKeyState         = "gitops_state"
@@ -21,21 +35,59 @@ const (
 
 // Configuration for gitops (path to YAML in repo).
 type Configuration struct {
-	Path string `structs:"path" json:"path,omitempty"`
+	Path     string `structs:"path" json:"path,omitempty"`
+	VarsFile string `structs:"vars_file" json:"vars_file,omitempty"`
+	Overlay  string `structs:"overlay" json:"overlay,omitempty"`
+
+	// MaxDeletionsPerRun is a count or a percentage of state entries ("20%"); empty = no limit.
+	MaxDeletionsPerRun string `structs:"max_deletions_per_run" json:"max_deletions_per_run,omitempty"`
+	// DestroySignatures is the number of verified commit signatures that permits deleting
+	// mounts and auth methods without the allow_destroy marker; 0 = marker only.
+	DestroySignatures int `structs:"destroy_signatures" json:"destroy_signatures,omitempty"`
+	// Concurrency is how many independent resources are applied at a time; 0 or 1 = one by one.
+	Concurrency int `structs:"concurrency" json:"concurrency,omitempty"`
+
+	// Global retry policy for transient Vault errors (see RetryPolicy).
+	RetryMaxAttempts int    `structs:"retry_max_attempts" json:"retry_max_attempts,omitempty"`
+	RetryBackoff     string `structs:"retry_backoff" json:"retry_backoff,omitempty"`
+	RetryMaxBackoff  string `structs:"retry_max_backoff" json:"retry_max_backoff,omitempty"`
+	RetryOn          []int  `structs:"retry_on" json:"retry_on,omitempty"`
+
+	// Atomic rolls back the changes of a commit when one of its resources fails.
+	Atomic bool `structs:"atomic" json:"atomic,omitempty"`
+
+	// LintSeverity overrides lint rule severities ("rule=error|warning|off,...", see
+	// ParseSeverityOverrides); findings of error severity stop the commit.
+	LintSeverity string `structs:"lint_severity" json:"lint_severity,omitempty"`
+
+	// Ignore lists patterns of files under Path that are not resource files (LoadOptions.Ignore).
+	Ignore []string `structs:"ignore" json:"ignore,omitempty"`
+}
+
+// RetryPolicy returns the global retry policy.
+func (c *Configuration) RetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: c.RetryMaxAttempts, Backoff: c.RetryBackoff, MaxBackoff: c.RetryMaxBackoff, RetryOn: c.RetryOn}
 }
 
 type backend struct {
 	baseBackend *framework.Backend
+
+	// stateLock serializes changes of the stored state of the mount: commit processing and
+	// state endpoints.
+	stateLock sync.Mutex
 }
 
 func (b *backend) Logger() hclog.Logger {
 	return b.baseBackend.Logger()
 }
 
-// Paths returns API paths for configure/gitops.
+// Paths returns API paths for configure/gitops, state and history.
 func Paths(baseBackend *framework.Backend) []*framework.Path {
-	b := &backend{baseBackend: baseBackend}
-	return []*framework.Path{
+	return (&backend{baseBackend: baseBackend}).paths()
+}
+
+func (b *backend) paths() []*framework.Path {
+	return append([]*framework.Path{
 		{
 			Pattern: "^configure/gitops/?$",
 			Fields: map[string]*framework.FieldSchema{
@@ -45,6 +97,76 @@ func Paths(baseBackend *framework.Backend) []*framework.Path {
 					Description: "Path to YAML files in the repository (e.g. 'vault' or empty for root).",
 					Required:    false,
 				},
+				FieldNameVarsFile: {
+					Type:        framework.TypeString,
+					Default:     "",
+					Description: "Path to a YAML file with template variables in the repository (e.g. 'vars/prod.yaml'); empty = no variables.",
+					Required:    false,
+				},
+				FieldNameOverlay: {
+					Type:        framework.TypeString,
+					Default:     "",
+					Description: "Name of the overlay to apply on top of the base resources (directory overlays/<name>/ under path); empty = no overlay, overlays/ is then an ordinary directory.",
+					Required:    false,
+				},
+				FieldNameMaxDeletionsPerRun: {
+					Type:        framework.TypeString,
+					Default:     "",
+					Description: "Maximum number of resources one commit may delete: a count (e.g. '5') or a percentage of the state (e.g. '20%'); empty = no limit.",
+					Required:    false,
+				},
+				FieldNameDestroySignatures: {
+					Type:        framework.TypeInt,
+					Default:     0,
+					Description: "Number of verified commit signatures that allows deleting mounts and auth methods without '[allow_destroy]' in the commit message; 0 = only the marker.",
+					Required:    false,
+				},
+				FieldNameConcurrency: {
+					Type:        framework.TypeInt,
+					Default:     1,
+					Description: "Number of resources applied in parallel; only resources whose dependencies are done run together. 1 = one by one.",
+					Required:    false,
+				},
+				FieldNameRetryMaxAttempts: {
+					Type:        framework.TypeInt,
+					Default:     DefaultRetryMaxAttempts,
+					Description: "Number of attempts for a request that fails with a transient error (see retry_on), including the first one (3 by default); 1 = no retries.",
+					Required:    false,
+				},
+				FieldNameRetryBackoff: {
+					Type:        framework.TypeString,
+					Default:     "",
+					Description: "Delay before the first retry (e.g. '1s', the default); doubles with every retry.",
+					Required:    false,
+				},
+				FieldNameRetryMaxBackoff: {
+					Type:        framework.TypeString,
+					Default:     "",
+					Description: "Maximum delay between retries, also for Retry-After (e.g. '30s', the default).",
+					Required:    false,
+				},
+				FieldNameRetryOn: {
+					Type:        framework.TypeCommaIntSlice,
+					Description: "HTTP status codes that are retried (default 429,500,502,503,504). Errors without a response are always retried.",
+					Required:    false,
+				},
+				FieldNameAtomic: {
+					Type:        framework.TypeBool,
+					Default:     false,
+					Description: "Roll back the changes already made by a commit when one of its resources fails: created resources are deleted, updated and deleted ones are written with their previous data.",
+					Required:    false,
+				},
+				FieldNameLintSeverity: {
+					Type:        framework.TypeString,
+					Default:     "",
+					Description: "Severity overrides of policy and openapi lint rules, e.g. 'policy-syntax=warning,policy-root-sudo=error'. Findings of error severity stop the commit; policy-syntax is an error and the other policy rules are warnings by default.",
+					Required:    false,
+				},
+				FieldNameIgnore: {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Glob patterns of files under path that are not resource files, e.g. 'openapi.json,generated/*.json'. A pattern with a slash matches the path relative to path, one without a slash the file name in any directory.",
+					Required:    false,
+				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
 				logical.CreateOperation: &framework.PathOperation{
@@ -66,9 +188,9 @@ func Paths(baseBackend *framework.Backend) []*framework.Path {
 			},
 			ExistenceCheck:  b.pathConfigExistenceCheck,
 			HelpSynopsis:    "Configure path to declarative YAML in the git repository.",
-			HelpDescription: "path: directory or file path in the repo containing .yaml/.yml (empty = root).",
+			HelpDescription: "path: directory or file path in the repo containing .yaml/.yml/.json/.gitops.hcl (empty = root); ignore: files under it that are not resources. vars_file: YAML file with variables for resources using 'templating: go'. overlay: name of the overlays/<name>/ directory with per-environment patches. max_deletions_per_run: stop the run if it would delete more resources. destroy_signatures: signature quorum that allows deleting sys/mounts/* and sys/auth/* (otherwise the commit message must contain '[allow_destroy]'). concurrency: number of independent resources applied in parallel. retry_*: retry policy for transient Vault errors (429, 5xx); resources can override it with 'retry'. atomic: roll back the changes of a failed commit. lint_severity: make lint rules errors, warnings or turn them off.",
 		},
-	}
+	}, b.statePaths()...)
 }
 
 func (b *backend) pathConfigExistenceCheck(ctx context.Context, req *logical.Request, _ *framework.FieldData) (bool, error) {
@@ -94,11 +216,73 @@ func (b *backend) pathConfigureCreateOrUpdate(ctx context.Context, req *logical.
 	if v, ok := fields.GetOk(FieldNamePath); ok {
 		config.Path = v.(string)
 	}
+	if v, ok := fields.GetOk(FieldNameVarsFile); ok {
+		config.VarsFile = v.(string)
+	}
+	if v, ok := fields.GetOk(FieldNameOverlay); ok {
+		config.Overlay = v.(string)
+	}
+	if v, ok := fields.GetOk(FieldNameMaxDeletionsPerRun); ok {
+		config.MaxDeletionsPerRun = v.(string)
+	}
+	if v, ok := fields.GetOk(FieldNameDestroySignatures); ok {
+		config.DestroySignatures = v.(int)
+	}
+	if v, ok := fields.GetOk(FieldNameConcurrency); ok {
+		config.Concurrency = v.(int)
+	}
+	if v, ok := fields.GetOk(FieldNameRetryMaxAttempts); ok {
+		config.RetryMaxAttempts = v.(int)
+	}
+	if v, ok := fields.GetOk(FieldNameRetryBackoff); ok {
+		config.RetryBackoff = v.(string)
+	}
+	if v, ok := fields.GetOk(FieldNameRetryMaxBackoff); ok {
+		config.RetryMaxBackoff = v.(string)
+	}
+	if v, ok := fields.GetOk(FieldNameRetryOn); ok {
+		config.RetryOn = v.([]int)
+	}
+	if v, ok := fields.GetOk(FieldNameAtomic); ok {
+		config.Atomic = v.(bool)
+	}
+	if v, ok := fields.GetOk(FieldNameLintSeverity); ok {
+		config.LintSeverity = v.(string)
+	}
+	if v, ok := fields.GetOk(FieldNameIgnore); ok {
+		config.Ignore = v.([]string)
+	}
 	if config.Path != "" {
 		if filepath.Clean(config.Path) != config.Path || strings.Contains(config.Path, "..") {
 			return logical.ErrorResponse("%q is invalid", FieldNamePath), nil
 		}
 	}
+	if config.VarsFile != "" {
+		if filepath.Clean(config.VarsFile) != config.VarsFile || strings.Contains(config.VarsFile, "..") || filepath.IsAbs(config.VarsFile) {
+			return logical.ErrorResponse("%q is invalid", FieldNameVarsFile), nil
+		}
+	}
+	if config.Overlay != "" && !validOverlayName(config.Overlay) {
+		return logical.ErrorResponse("%q is invalid", FieldNameOverlay), nil
+	}
+	if _, err := ParseMaxDeletions(config.MaxDeletionsPerRun, 0); err != nil {
+		return logical.ErrorResponse("%q is invalid: %s", FieldNameMaxDeletionsPerRun, err.Error()), nil
+	}
+	if config.DestroySignatures < 0 {
+		return logical.ErrorResponse("%q must be non-negative", FieldNameDestroySignatures), nil
+	}
+	if config.Concurrency < 0 {
+		return logical.ErrorResponse("%q must be non-negative", FieldNameConcurrency), nil
+	}
+	if err := config.RetryPolicy().Validate(); err != nil {
+		return logical.ErrorResponse("invalid retry policy: %s", err.Error()), nil
+	}
+	if _, err := ParseSeverityOverrides(config.LintSeverity); err != nil {
+		return logical.ErrorResponse("%q is invalid: %s", FieldNameLintSeverity, err.Error()), nil
+	}
+	if err := ValidateIgnore(config.Ignore); err != nil {
+		return logical.ErrorResponse("%q is invalid: %s", FieldNameIgnore, err.Error()), nil
+	}
 	entry, err := logical.StorageEntryJSON(StorageKeyConfiguration, &config)
 	if err != nil {
 		return nil, err
@@ -118,7 +302,21 @@ func (b *backend) pathConfigureRead(ctx context.Context, req *logical.Request, _
 		return nil, nil
 	}
 	return &logical.Response{Data: map[string]interface{}{
-		FieldNamePath: config.Path,
+		FieldNamePath:     config.Path,
+		FieldNameVarsFile: config.VarsFile,
+		FieldNameOverlay:  config.Overlay,
+
+		FieldNameMaxDeletionsPerRun: config.MaxDeletionsPerRun,
+		FieldNameDestroySignatures:  config.DestroySignatures,
+		FieldNameConcurrency:        config.Concurrency,
+
+		FieldNameRetryMaxAttempts: config.RetryMaxAttempts,
+		FieldNameRetryBackoff:     config.RetryBackoff,
+		FieldNameRetryMaxBackoff:  config.RetryMaxBackoff,
+		FieldNameRetryOn:          config.RetryOn,
+		FieldNameAtomic:           config.Atomic,
+		FieldNameLintSeverity:     config.LintSeverity,
+		FieldNameIgnore:           config.Ignore,
 	}}, nil
 }
 
@@ -0,0 +1,91 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// IsDataSource reports whether the resource is a data source ('kind: data'): it is read with GET
+// on every apply (or when its ttl has expired), never written and never deleted; the response
+// is stored in state as response_data for templates of other resources.
+func (r Resource) IsDataSource() bool {
+	return r.Kind == KindData
+}
+
+// dataSourceFresh reports whether the state entry of data source r can be used without a read:
+// it was read with the same data less than 'ttl' ago. Without a ttl it is never fresh.
+func dataSourceFresh(r *Resource, prev StateResource, digest string, now time.Time) bool {
+	if !prev.DataSource || prev.DataDigest != digest || prev.ReadAt == nil || r.TTL == "" {
+		return false
+	}
+	ttl, err := time.ParseDuration(r.TTL)
+	return err == nil && now.Sub(*prev.ReadAt) < ttl
+}
+
+// read reads data source r and stores the response in state. It is not recorded in history and
+// not rolled back: nothing changes in Vault.
+func (a *applier) read(r *Resource, key string, resolvedData interface{}, digest string) error {
+	reqClient := a.client
+	if r.Namespace != "" {
+		reqClient = a.client.WithNamespace(strings.TrimSuffix(r.Namespace, "/"))
+	}
+	var query map[string][]string
+	if resolvedData != nil {
+		dataMap, err := dataToDataMap(resolvedData)
+		if err != nil {
+			return fail(r, "data source %s%s: json encode: %v", r.Namespace, r.Path, err)
+		}
+		query = queryValues(dataMap)
+	}
+	var secret *api.Secret
+	err := a.opts.Retry.Merge(r.Retry).do(a.ctx, &a.retries, func(ctx context.Context) (err error) {
+		secret, err = reqClient.Logical().ReadWithDataWithContext(ctx, strings.TrimPrefix(r.Path, "/"), query)
+		return err
+	})
+	if err != nil {
+		return fail(r, "%s", formatVaultErr(r.Namespace, r.Path, err))
+	}
+	if secret == nil || secret.Data == nil {
+		return fail(r, "data source %s%s: not found", r.Namespace, r.Path)
+	}
+
+	readAt := time.Now().UTC()
+	ns, pathN := r.location()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.state.Resources[key] = StateResource{
+		DataDigest:     digest,
+		Dependencies:   r.Dependencies,
+		IgnoreFailures: r.IgnoreFailures,
+		ResponseData:   keepResponse(secret.Data, r.KeepResponse),
+		Delete:         deleteSpecFor(r),
+		DataSource:     true,
+		ReadAt:         &readAt,
+		Commit:         a.opts.Commit,
+		Namespace:      ns,
+		Path:           pathN,
+	}
+	if saveErr, _ := a.save("", key, "", ""); saveErr != nil {
+		return fail(r, "data source %s%s: save state: %v", r.Namespace, r.Path, saveErr)
+	}
+	return nil
+}
+
+// queryValues converts request data to query parameters; list values become repeated parameters.
+func queryValues(data map[string]interface{}) map[string][]string {
+	query := make(map[string][]string, len(data))
+	for k, v := range data {
+		if list, ok := v.([]interface{}); ok {
+			for _, item := range list {
+				query[k] = append(query[k], fmt.Sprint(item))
+			}
+			continue
+		}
+		query[k] = []string{fmt.Sprint(v)}
+	}
+	return query
+}
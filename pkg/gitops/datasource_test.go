@@ -0,0 +1,102 @@
+package gitops
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DataSource_Apply(t *testing.T) {
+	accessor := "auth_userpass_1"
+	client, requests := testVaultClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/v1/sys/auth/userpass" {
+			_, _ = w.Write([]byte(`{"data": {"accessor": "` + accessor + `", "type": "userpass"}}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	resources, err := LoadResourcesFromFS(writeFSFiles(t, map[string]string{"a.yaml": `
+kind: data
+name: userpass
+path: sys/auth/userpass
+---
+name: alias
+path: identity/group-alias/name/devs
+dependencies: [userpass]
+data:
+  mount_accessor: <userpass:accessor>
+`}), "", LoadOptions{})
+	require.NoError(t, err)
+	require.NoError(t, Lint(resources))
+	ctx := context.Background()
+	state := &State{Resources: map[string]StateResource{}}
+
+	changes, err := Plan(resources, state)
+	require.NoError(t, err)
+	require.Equal(t, PlanRead, changes[0].Action)
+
+	_, err = Apply(ctx, resources, client, state, nil, ApplyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"GET /v1/sys/auth/userpass", "PUT /v1/identity/group-alias/name/devs"}, *requests)
+	require.True(t, state.Resources["userpass"].DataSource)
+	require.NotNil(t, state.Resources["userpass"].ReadAt)
+
+	// Read again on every run; a new accessor re-applies the alias.
+	*requests = nil
+	accessor = "auth_userpass_2"
+	_, err = Apply(ctx, resources, client, state, nil, ApplyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"GET /v1/sys/auth/userpass", "PUT /v1/identity/group-alias/name/devs"}, *requests)
+
+	// With a ttl the last read is reused until it expires.
+	*requests = nil
+	resources[0].TTL = "1h"
+	_, err = Apply(ctx, resources, client, state, nil, ApplyOptions{})
+	require.NoError(t, err)
+	require.Empty(t, *requests)
+	changes, err = Plan(resources, state)
+	require.NoError(t, err)
+	require.Equal(t, PlanUnchanged, changes[0].Action)
+	expired := time.Now().Add(-2 * time.Hour)
+	res := state.Resources["userpass"]
+	res.ReadAt = &expired
+	state.Resources["userpass"] = res
+	_, err = Apply(ctx, resources, client, state, nil, ApplyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"GET /v1/sys/auth/userpass"}, *requests)
+
+	// Removed data sources are dropped from state without a request.
+	*requests = nil
+	_, err = Apply(ctx, resources[1:], client, state, nil, ApplyOptions{MaxDeletions: "0"})
+	require.NoError(t, err)
+	require.Empty(t, *requests)
+	require.NotContains(t, state.Resources, "userpass")
+}
+
+func Test_DataSource_Lint(t *testing.T) {
+	tests := []struct {
+		description string
+		resource    Resource
+		rules       []string
+	}{
+		{description: "data source", resource: Resource{Kind: KindData, Path: "sys/auth/userpass", TTL: "10m"}},
+		{description: "query data", resource: Resource{Kind: KindData, Path: "sys/internal/ui/mounts", Data: map[string]interface{}{"filter": "x"}}},
+		{description: "write method", resource: Resource{Kind: KindData, Path: "sys/auth/userpass", Method: "POST"}, rules: []string{RuleInvalidDataSource}},
+		{description: "delete", resource: Resource{Kind: KindData, Path: "sys/auth/userpass", Delete: &DeleteSpec{None: true}}, rules: []string{RuleInvalidDataSource}},
+		{description: "prevent_destroy", resource: Resource{Kind: KindData, Path: "sys/auth/userpass", PreventDestroy: true}, rules: []string{RuleInvalidDataSource}},
+		{description: "invalid ttl", resource: Resource{Kind: KindData, Path: "sys/auth/userpass", TTL: "1"}, rules: []string{RuleInvalidDataSource}},
+		{description: "ttl on a resource", resource: Resource{Path: "kv/a", Data: map[string]interface{}{}, TTL: "1h"}, rules: []string{RuleInvalidDataSource}},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var rules []string
+			for _, d := range LintDiagnostics([]Resource{test.resource}, LintOptions{}) {
+				rules = append(rules, d.Rule)
+			}
+			require.Equal(t, test.rules, rules)
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package gitops
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DeleteNone is the scalar form of 'delete': the resource is only dropped from state when it is
+// removed from the repository, nothing is deleted in Vault.
+const DeleteNone = "none"
+
+// DeleteSpec is the 'delete' block of a resource: the request sent when the resource is removed
+// from the repository, instead of DELETE on its path. Path and data may contain <name:key>
+// templates, resolved from state at deletion time (the resource's own response data included).
+type DeleteSpec struct {
+	// None is 'delete: none'.
+	None bool `yaml:"-" json:"none,omitempty"`
+	// Path defaults to the resource path.
+	Path string `yaml:"path,omitempty" json:"path,omitempty"`
+	// Method is DELETE (default), POST, PUT or PATCH; data of a DELETE is sent as query parameters.
+	Method string      `yaml:"method,omitempty" json:"method,omitempty"`
+	Data   interface{} `yaml:"data,omitempty" json:"data,omitempty"`
+}
+
+type deleteSpecFields DeleteSpec
+
+// UnmarshalYAML accepts 'none' or a {path, method, data} mapping.
+func (d *DeleteSpec) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		if node.Value != DeleteNone {
+			return fmt.Errorf("line %d: delete must be %q or an object with path, method and data (got %q)", node.Line, DeleteNone, node.Value)
+		}
+		*d = DeleteSpec{None: true}
+		return nil
+	}
+	var fields deleteSpecFields
+	if err := node.Decode(&fields); err != nil {
+		return err
+	}
+	*d = DeleteSpec(fields)
+	return nil
+}
+
+// MarshalYAML writes 'none' for DeleteSpec{None: true}.
+func (d DeleteSpec) MarshalYAML() (interface{}, error) {
+	if d.None {
+		return DeleteNone, nil
+	}
+	return deleteSpecFields(d), nil
+}
+
+// deleteRequest returns the request that deletes the state entry res: method, path and data
+// with templates resolved from state. ok is false for 'delete: none'.
+func deleteRequest(res StateResource, state *State) (method, path string, data map[string]interface{}, ok bool, err error) {
+	spec := res.Delete
+	if spec == nil {
+		return "DELETE", res.Path, nil, true, nil
+	}
+	if spec.None {
+		return "", "", nil, false, nil
+	}
+	method = normalizeMethod(spec.Method)
+	if strings.TrimSpace(spec.Method) == "" {
+		method = "DELETE"
+	}
+	path = res.Path
+	if spec.Path != "" {
+		if path, err = resolveTemplatesInString(spec.Path, state); err != nil {
+			return "", "", nil, false, err
+		}
+	}
+	if spec.Data != nil {
+		resolved, err := ResolveTemplates(spec.Data, state)
+		if err != nil {
+			return "", "", nil, false, err
+		}
+		if data, err = dataToDataMap(resolved); err != nil {
+			return "", "", nil, false, err
+		}
+	}
+	return method, path, data, true, nil
+}
+
+// deleteSpecFor returns the 'delete' recorded in state for r: data sources and resources with
+// method DELETE have nothing to delete when removed.
+func deleteSpecFor(r *Resource) *DeleteSpec {
+	if r.IsDataSource() || normalizeMethod(r.Method) == "DELETE" {
+		return &DeleteSpec{None: true}
+	}
+	return r.Delete
+}
+
+var inlineTemplateRe = regexp.MustCompile(`<([^<>:\s]+):([^<>\s]+)>`)
+
+// resolveTemplatesInString replaces every <name:key> inside s (not only a whole-string template),
+// e.g. identity/group/id/<devs:id>.
+func resolveTemplatesInString(s string, state *State) (string, error) {
+	var firstErr error
+	out := inlineTemplateRe.ReplaceAllStringFunc(s, func(m string) string {
+		v, err := resolveTemplateString(m, state)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return v
+	})
+	return out, firstErr
+}
+
+// templateRefs returns the resource names referenced by templates in the path and data of d.
+func (d *DeleteSpec) templateRefs() []string {
+	names := templateRefs(d.Path)
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			names = append(names, templateRefs(v)...)
+		case map[string]interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	walk(d.Data)
+	sort.Strings(names)
+	return names
+}
+
+// templateRefs returns the resource names referenced by <name:key> templates in s.
+func templateRefs(s string) []string {
+	var names []string
+	for _, m := range inlineTemplateRe.FindAllStringSubmatch(s, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
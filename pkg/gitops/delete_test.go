@@ -0,0 +1,119 @@
+package gitops
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func Test_DeleteSpec_YAML(t *testing.T) {
+	var r Resource
+	require.NoError(t, yaml.Unmarshal([]byte("path: kv/a\ndelete: none\n"), &r))
+	require.Equal(t, &DeleteSpec{None: true}, r.Delete)
+
+	r = Resource{}
+	require.NoError(t, yaml.Unmarshal([]byte("path: identity/group\ndelete:\n  path: identity/group/id/<devs:id>\n  method: post\n  data: {force: true}\n"), &r))
+	require.Equal(t, &DeleteSpec{Path: "identity/group/id/<devs:id>", Method: "post", Data: map[string]interface{}{"force": true}}, r.Delete)
+
+	require.ErrorContains(t, yaml.Unmarshal([]byte("path: kv/a\ndelete: never\n"), &r), `delete must be "none"`)
+
+	out, err := MarshalResourcesYAML([]Resource{{Path: "kv/a", Data: map[string]interface{}{}, Delete: &DeleteSpec{None: true}}})
+	require.NoError(t, err)
+	require.Contains(t, string(out), "delete: none\n")
+}
+
+func Test_Apply_DeleteMethods(t *testing.T) {
+	bodies := map[string]string{}
+	client, requests := testVaultClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies[r.Method+" "+r.URL.Path] = string(body)
+		if r.Method == http.MethodPut && r.URL.Path == "/v1/identity/group" {
+			_, _ = w.Write([]byte(`{"data": {"id": "g1"}}`))
+			return
+		}
+		if r.Method == http.MethodDelete && r.URL.Path == "/v1/kv/gone" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors": []}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	writer := NewStorageStateWriter(storage)
+
+	resources := []Resource{
+		{Name: "devs", Path: "identity/group", Data: map[string]interface{}{"name": "devs"}, Delete: &DeleteSpec{Path: "identity/group/id/<devs:id>"}},
+		{Name: "tune", Path: "sys/mounts/kv/tune", Method: "PATCH", Data: map[string]interface{}{"max_lease_ttl": "1h"}, Delete: &DeleteSpec{None: true}},
+		{Name: "config", Path: "auth/token/roles/ci", Method: "put", Data: map[string]interface{}{"orphan": true}},
+		{Name: "gone", Path: "kv/gone", Method: "DELETE"},
+	}
+	state := &State{Resources: map[string]StateResource{}}
+	_, err := Apply(ctx, resources, client, state, writer, ApplyOptions{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{
+		"PUT /v1/identity/group",
+		"PATCH /v1/sys/mounts/kv/tune",
+		"PUT /v1/auth/token/roles/ci",
+		"DELETE /v1/kv/gone",
+	}, *requests)
+	require.JSONEq(t, `{"max_lease_ttl": "1h"}`, bodies["PATCH /v1/sys/mounts/kv/tune"])
+	require.Equal(t, &DeleteSpec{None: true}, state.Resources["gone"].Delete, "nothing to delete for method DELETE")
+
+	changes, err := Plan(nil, state)
+	require.NoError(t, err)
+	require.NoError(t, CheckDeletions(changes, state, ApplyOptions{MaxDeletions: "2"}), "deletes with 'delete: none' are not counted")
+
+	*requests = nil
+	_, err = Apply(ctx, nil, client, state, writer, ApplyOptions{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{
+		"DELETE /v1/identity/group/id/g1",
+		"DELETE /v1/auth/token/roles/ci",
+	}, *requests)
+	require.Empty(t, state.Resources)
+
+	history, err := GetHistory(ctx, storage)
+	require.NoError(t, err)
+	details := map[string]string{}
+	for _, e := range history {
+		if e.Action == string(PlanDelete) {
+			details[e.Key] = e.Detail
+		}
+	}
+	require.Equal(t, map[string]string{"devs": "", "tune": "delete: none, kept in Vault", "config": "", "gone": "delete: none, kept in Vault"}, details)
+}
+
+func Test_Lint_Delete(t *testing.T) {
+	data := map[string]interface{}{}
+	tests := []struct {
+		description string
+		resource    Resource
+		rules       []string
+	}{
+		{description: "put", resource: Resource{Path: "kv/a", Method: "PUT", Data: data}},
+		{description: "delete without data", resource: Resource{Path: "kv/a", Method: "DELETE"}},
+		{description: "unknown method", resource: Resource{Path: "kv/a", Method: "HEAD", Data: data}, rules: []string{RuleInvalidMethod}},
+		{description: "patch without delete", resource: Resource{Path: "kv/a", Method: "PATCH", Data: data}, rules: []string{RulePatchWithoutDelete}},
+		{description: "patch with delete none", resource: Resource{Path: "kv/a", Method: "PATCH", Data: data, Delete: &DeleteSpec{None: true}}},
+		{description: "delete block on method DELETE", resource: Resource{Path: "kv/a", Method: "DELETE", Delete: &DeleteSpec{None: true}}, rules: []string{RuleInvalidDelete}},
+		{description: "delete with GET", resource: Resource{Path: "kv/a", Data: data, Delete: &DeleteSpec{Method: "GET"}}, rules: []string{RuleInvalidDelete}},
+		{description: "delete data not an object", resource: Resource{Path: "kv/a", Data: data, Delete: &DeleteSpec{Data: "x"}}, rules: []string{RuleInvalidDelete}},
+		{description: "delete template of itself", resource: Resource{Name: "a", Path: "kv/a", Data: data, Delete: &DeleteSpec{Path: "kv/id/<a:id>", Method: "POST"}}},
+		{description: "delete template of unknown resource", resource: Resource{Path: "kv/a", Data: data, Delete: &DeleteSpec{Path: "kv/id/<b:id>"}}, rules: []string{RuleInvalidDelete}},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var rules []string
+			for _, d := range LintDiagnostics([]Resource{test.resource}, LintOptions{}) {
+				rules = append(rules, d.Rule)
+			}
+			require.Equal(t, test.rules, rules)
+		})
+	}
+}
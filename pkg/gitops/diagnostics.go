@@ -0,0 +1,316 @@
+package gitops
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Severity of a lint diagnostic.
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Lint rule IDs.
+const (
+	RuleMissingPath         = "missing-path"
+	RuleMissingData         = "missing-data"
+	RuleDataNotObject       = "data-not-object"
+	RuleNegativeRevision    = "negative-revision"
+	RuleInvalidMethod       = "invalid-method"
+	RuleDuplicateName       = "duplicate-name"
+	RuleEmptyDependency     = "empty-dependency"
+	RuleUnknownDependency   = "unknown-dependency"
+	RuleInvalidTemplating   = "invalid-templating"
+	RuleTemplateError       = "template-error"
+	RuleInvalidLifecycle    = "invalid-lifecycle"
+	RuleInvalidRetry        = "invalid-retry"
+	RuleInvalidDelete       = "invalid-delete"
+	RuleInvalidDataSource   = "invalid-data-source"
+	RuleInvalidKeepResponse = "invalid-keep-response"
+	RulePatchWithoutDelete  = "patch-without-delete"
+	RuleLoadError           = "load-error"
+	RuleSkippedFile         = "skipped-file" // a .json file not loaded because of an ignore pattern
+
+	// Rules of LintOpenAPI.
+	RuleOpenAPIUnknownPath  = "openapi-unknown-path"
+	RuleOpenAPIMethod       = "openapi-method"
+	RuleOpenAPIUnknownField = "openapi-unknown-field"
+	RuleOpenAPIType         = "openapi-type"
+	RuleOpenAPIRequired     = "openapi-required"
+)
+
+// lintRules are all rule IDs; true for the rules whose severity can be overridden. The rules of
+// the resource format always stay as they are: apply cannot work around them.
+var lintRules = map[string]bool{
+	RuleMissingPath: false, RuleMissingData: false, RuleDataNotObject: false, RuleNegativeRevision: false,
+	RuleInvalidMethod: false, RuleDuplicateName: false, RuleEmptyDependency: false, RuleUnknownDependency: false,
+	RuleInvalidTemplating: false, RuleTemplateError: false, RuleInvalidLifecycle: false, RuleInvalidRetry: false,
+	RuleInvalidDelete: false, RuleInvalidDataSource: false, RuleInvalidKeepResponse: false,
+	RulePatchWithoutDelete: false, RuleLoadError: false, RuleSkippedFile: false,
+
+	RuleOpenAPIUnknownPath: true, RuleOpenAPIMethod: true, RuleOpenAPIUnknownField: true,
+	RuleOpenAPIType: true, RuleOpenAPIRequired: true,
+
+	RulePolicySyntax: true, RulePolicyRootSudo: true, RulePolicySysWrite: true,
+	RulePolicyTokenCreate: true, RulePolicySelfEscalation: true,
+}
+
+// Diagnostic is one lint finding, with the source position of the resource it refers to.
+type Diagnostic struct {
+	Severity Severity `json:"severity"`
+	Rule     string   `json:"rule"`
+	Message  string   `json:"message"`
+	Resource string   `json:"resource,omitempty"` // state key of the resource
+	File     string   `json:"file,omitempty"`
+	Line     int      `json:"line,omitempty"`
+	Column   int      `json:"column,omitempty"`
+}
+
+// newDiagnostic returns a diagnostic for resource r.
+func newDiagnostic(r *Resource, severity Severity, rule, format string, args ...interface{}) Diagnostic {
+	return Diagnostic{
+		Severity: severity,
+		Rule:     rule,
+		Message:  fmt.Sprintf(format, args...),
+		Resource: r.Key(),
+		File:     r.File,
+		Line:     r.Line,
+		Column:   r.Column,
+	}
+}
+
+// String formats the diagnostic as "file:line:column: severity: message [rule]".
+func (d Diagnostic) String() string {
+	where := d.File
+	if where != "" && d.Line > 0 {
+		where = fmt.Sprintf("%s:%d:%d", d.File, d.Line, d.Column)
+	}
+	if where == "" && d.Resource != "" {
+		where = fmt.Sprintf("resource %q", d.Resource)
+	}
+	if where == "" {
+		return fmt.Sprintf("%s: %s [%s]", d.Severity, d.Message, d.Rule)
+	}
+	return fmt.Sprintf("%s: %s: %s [%s]", where, d.Severity, d.Message, d.Rule)
+}
+
+// Diagnostics is a list of lint findings.
+type Diagnostics []Diagnostic
+
+// HasErrors reports whether any diagnostic has error severity.
+func (ds Diagnostics) HasErrors() bool {
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Err returns nil if there are no errors, otherwise an error listing every error diagnostic.
+func (ds Diagnostics) Err() error {
+	var errs []error
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			errs = append(errs, errors.New(d.String()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// withSeverity applies severity overrides by rule ID and drops rules set to SeverityOff. Overrides
+// of rules that cannot be overridden are ignored (ParseSeverityOverrides rejects them).
+func (ds Diagnostics) withSeverity(overrides map[string]Severity) Diagnostics {
+	if len(overrides) == 0 {
+		return ds
+	}
+	out := ds[:0]
+	for _, d := range ds {
+		if s, ok := overrides[d.Rule]; ok && lintRules[d.Rule] {
+			if s == SeverityOff {
+				continue
+			}
+			d.Severity = s
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// ParseSeverityOverrides parses "rule=severity" pairs separated by commas
+// (severity: error, warning or off), e.g. "policy-self-escalation=off,openapi-unknown-path=error".
+// Only policy-* and openapi-* rules can be overridden.
+func ParseSeverityOverrides(s string) (map[string]Severity, error) {
+	overrides := map[string]Severity{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		rule, sev, ok := strings.Cut(pair, "=")
+		if !ok || rule == "" {
+			return nil, fmt.Errorf("invalid severity override %q: expected rule=severity", pair)
+		}
+		overridable, known := lintRules[rule]
+		if !known {
+			return nil, fmt.Errorf("unknown rule %q", rule)
+		}
+		if !overridable {
+			return nil, fmt.Errorf("the severity of rule %q cannot be changed: only policy and openapi rules can be overridden", rule)
+		}
+		switch severity := Severity(strings.ToLower(sev)); severity {
+		case SeverityError, SeverityWarning, SeverityOff:
+			overrides[rule] = severity
+		default:
+			return nil, fmt.Errorf("invalid severity %q for rule %q: use error, warning or off", sev, rule)
+		}
+	}
+	return overrides, nil
+}
+
+// Sort orders diagnostics by file, line and column; diagnostics without a file go last.
+func (ds Diagnostics) Sort() {
+	sort.SliceStable(ds, func(i, j int) bool {
+		a, b := ds[i], ds[j]
+		if (a.File == "") != (b.File == "") {
+			return a.File != ""
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// Diagnostics output formats for WriteDiagnostics.
+const (
+	FormatText  = "text"
+	FormatJSON  = "json"
+	FormatSARIF = "sarif"
+)
+
+// WriteDiagnostics writes diagnostics to w in the given format: text (one per line),
+// json (array of diagnostics) or sarif (SARIF 2.1.0 log with one run of tool).
+func WriteDiagnostics(w io.Writer, ds Diagnostics, format, tool, version string) error {
+	if ds == nil {
+		ds = Diagnostics{}
+	}
+	switch format {
+	case FormatText, "":
+		for _, d := range ds {
+			if _, err := fmt.Fprintln(w, d.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ds)
+	case FormatSARIF:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(newSARIFLog(ds, tool, version))
+	default:
+		return fmt.Errorf("unknown format %q (use %s, %s or %s)", format, FormatText, FormatJSON, FormatSARIF)
+	}
+}
+
+// SARIF 2.1.0 subset: https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version,omitempty"`
+	Rules   []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID string `json:"id"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+func newSARIFLog(ds Diagnostics, tool, version string) sarifLog {
+	run := sarifRun{
+		Tool:    sarifTool{Driver: sarifDriver{Name: tool, Version: version, Rules: []sarifRule{}}},
+		Results: []sarifResult{},
+	}
+	seen := map[string]bool{}
+	for _, d := range ds {
+		if !seen[d.Rule] {
+			seen[d.Rule] = true
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{ID: d.Rule})
+		}
+		level := "error"
+		if d.Severity == SeverityWarning {
+			level = "warning"
+		}
+		res := sarifResult{RuleID: d.Rule, Level: level, Message: sarifMessage{Text: d.Message}}
+		if d.File != "" {
+			loc := sarifLocation{PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: d.File},
+			}}
+			if d.Line > 0 {
+				loc.PhysicalLocation.Region = &sarifRegion{StartLine: d.Line, StartColumn: d.Column}
+			}
+			res.Locations = []sarifLocation{loc}
+		}
+		run.Results = append(run.Results, res)
+	}
+	return sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	}
+}
@@ -0,0 +1,126 @@
+package gitops
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LintDiagnostics(t *testing.T) {
+	fs := writeFSFiles(t, map[string]string{
+		"vault/b.yaml": `
+path: sys/mounts/kv
+data: {type: kv}
+---
+path: sys/mounts/kv
+method: HEAD
+revision: -1
+data: {type: kv}
+dependencies: [missing, ""]
+`,
+		"vault/a.json": `[
+  {"path": "kv/x", "templating": "go", "data": {"v": "{{ .vars.nope }}"}},
+  {"data": {}}
+]`,
+	})
+	resources, err := LoadResourcesFromFS(fs, "vault", LoadOptions{})
+	require.NoError(t, err)
+
+	diags := LintDiagnostics(resources, LintOptions{})
+	require.True(t, diags.HasErrors())
+	type found struct {
+		Rule string
+		File string
+		Line int
+	}
+	var got []found
+	for _, d := range diags {
+		got = append(got, found{d.Rule, d.File, d.Line})
+	}
+	require.Equal(t, []found{
+		{RuleTemplateError, "vault/a.json", 2},
+		{RuleMissingPath, "vault/a.json", 3},
+		{RuleNegativeRevision, "vault/b.yaml", 5},
+		{RuleInvalidMethod, "vault/b.yaml", 5},
+		{RuleDuplicateName, "vault/b.yaml", 5},
+		{RuleUnknownDependency, "vault/b.yaml", 5},
+		{RuleEmptyDependency, "vault/b.yaml", 5},
+	}, got)
+	require.Contains(t, diags[4].Message, "vault/b.yaml:2:1")
+
+	err = Lint(resources)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "vault/b.yaml:5:1: error: revision must be non-negative")
+	require.NoError(t, Lint(resources[2:3]))
+}
+
+func Test_WriteDiagnostics(t *testing.T) {
+	diags := Diagnostics{
+		{Severity: SeverityError, Rule: RuleMissingData, Message: "missing 'data'", File: "a.yaml", Line: 3, Column: 1},
+		{Severity: SeverityWarning, Rule: RuleLoadError, Message: "no position"},
+	}
+
+	var text bytes.Buffer
+	require.NoError(t, WriteDiagnostics(&text, diags, FormatText, "gitops-tool", "v1"))
+	require.Equal(t, "a.yaml:3:1: error: missing 'data' [missing-data]\nwarning: no position [load-error]\n", text.String())
+
+	var out bytes.Buffer
+	require.NoError(t, WriteDiagnostics(&out, diags, FormatJSON, "gitops-tool", "v1"))
+	var decoded Diagnostics
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	require.Equal(t, diags, decoded)
+
+	out.Reset()
+	require.NoError(t, WriteDiagnostics(&out, diags, FormatSARIF, "gitops-tool", "v1"))
+	var sarif sarifLog
+	require.NoError(t, json.Unmarshal(out.Bytes(), &sarif))
+	require.Equal(t, "2.1.0", sarif.Version)
+	require.Len(t, sarif.Runs, 1)
+	results := sarif.Runs[0].Results
+	require.Len(t, results, 2)
+	require.Equal(t, "error", results[0].Level)
+	require.Equal(t, "a.yaml", results[0].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	require.Equal(t, 3, results[0].Locations[0].PhysicalLocation.Region.StartLine)
+	require.Equal(t, "warning", results[1].Level)
+	require.Empty(t, results[1].Locations)
+
+	require.Error(t, WriteDiagnostics(&out, diags, "xml", "gitops-tool", "v1"))
+}
+
+func Test_ParseSeverityOverrides(t *testing.T) {
+	tests := []struct {
+		description string
+		overrides   string
+		want        map[string]Severity
+		err         string
+	}{
+		{description: "empty", overrides: "", want: map[string]Severity{}},
+		{
+			description: "policy and openapi rules",
+			overrides:   "policy-syntax=error, openapi-unknown-path=OFF",
+			want:        map[string]Severity{RulePolicySyntax: SeverityError, RuleOpenAPIUnknownPath: SeverityOff},
+		},
+		{description: "typo", overrides: "policy-sytnax=error", err: `unknown rule "policy-sytnax"`},
+		{description: "structural rule", overrides: "missing-path=off", err: `the severity of rule "missing-path" cannot be changed`},
+		{description: "unknown dependency", overrides: "unknown-dependency=warning", err: "cannot be changed"},
+		{description: "invalid severity", overrides: "policy-syntax=fatal", err: `invalid severity "fatal"`},
+		{description: "no severity", overrides: "policy-syntax", err: "expected rule=severity"},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := ParseSeverityOverrides(test.overrides)
+			if test.err != "" {
+				require.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+
+	// Overrides set directly in LintOptions cannot turn off structural rules either.
+	diags := LintDiagnostics([]Resource{{Data: map[string]interface{}{}}}, LintOptions{Severity: map[string]Severity{RuleMissingPath: SeverityOff}})
+	require.True(t, diags.HasErrors())
+}
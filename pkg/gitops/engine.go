@@ -3,6 +3,7 @@ package gitops
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/go-git/go-billy/v6"
 	"github.com/hashicorp/go-hclog"
@@ -10,17 +11,19 @@ import (
 	"github.com/hashicorp/vault/sdk/logical"
 
 	"github.com/trublast/vault-plugin-gitops/pkg/engine"
-	"github.com/trublast/vault-plugin-gitops/pkg/util"
 	"github.com/trublast/vault-plugin-gitops/pkg/vault_client"
 )
 
 func init() {
-	engine.Register("gitops", &engineImpl{})
+	engine.Register("gitops", func() engine.Engine { return &engineImpl{backend: &backend{}} })
 }
 
-type engineImpl struct{}
+// engineImpl processes the commits of one mount; its backend serves the endpoints of the mount.
+type engineImpl struct {
+	backend *backend
+}
 
-func (e *engineImpl) ProcessCommit(ctx context.Context, storage logical.Storage, worktreeFS billy.Filesystem, logger hclog.Logger) error {
+func (e *engineImpl) ProcessCommit(ctx context.Context, storage logical.Storage, worktreeFS billy.Filesystem, commit engine.Commit, logger hclog.Logger) error {
 	vaultConfig, err := vault_client.GetConfig(ctx, storage)
 	if err != nil {
 		return fmt.Errorf("unable to get vault configuration: %w", err)
@@ -30,24 +33,54 @@ func (e *engineImpl) ProcessCommit(ctx context.Context, storage logical.Storage,
 		return fmt.Errorf("unable to get gitops configuration: %w", err)
 	}
 	rootPath := ""
+	var loadOpts LoadOptions
+	var lintOpts LintOptions
+	applyOpts := ApplyOptions{AllowDestroy: strings.Contains(commit.Message, AllowDestroyMarker), Commit: commit.Hash}
 	if gitopsConfig != nil {
 		rootPath = gitopsConfig.Path
+		loadOpts.VarsFile = gitopsConfig.VarsFile
+		loadOpts.Overlay = gitopsConfig.Overlay
+		loadOpts.Ignore = gitopsConfig.Ignore
+		applyOpts.MaxDeletions = gitopsConfig.MaxDeletionsPerRun
+		applyOpts.Concurrency = gitopsConfig.Concurrency
+		applyOpts.Retry = gitopsConfig.RetryPolicy()
+		applyOpts.Atomic = gitopsConfig.Atomic
+		if lintOpts.Severity, err = ParseSeverityOverrides(gitopsConfig.LintSeverity); err != nil {
+			return fmt.Errorf("invalid %s: %w", FieldNameLintSeverity, err)
+		}
+		if !applyOpts.AllowDestroy && gitopsConfig.DestroySignatures > 0 && commit.VerifySignatures != nil {
+			if err := commit.VerifySignatures(gitopsConfig.DestroySignatures); err == nil {
+				applyOpts.AllowDestroy = true
+			} else {
+				logger.Debug(fmt.Sprintf("commit %q does not reach the destroy signature quorum: %v", commit.Hash, err))
+			}
+		}
 	}
 
-	resources, err := LoadResourcesFromFS(worktreeFS, rootPath)
+	resources, err := LoadResourcesFromFS(worktreeFS, rootPath, loadOpts)
 	if err != nil {
 		return fmt.Errorf("unable to load resources from repo: %w", err)
 	}
-	if err := Lint(resources); err != nil {
+	diags := LintDiagnostics(resources, lintOpts)
+	for _, d := range diags {
+		if d.Severity == SeverityWarning {
+			logger.Warn(fmt.Sprintf("lint: %s", d))
+		}
+	}
+	if err := diags.Err(); err != nil {
 		return fmt.Errorf("lint: %w", err)
 	}
 
-	var state State
-	if err := util.GetJSON(ctx, storage, StorageKeyState, &state); err != nil {
-		return fmt.Errorf("unable to load state: %w", err)
+	e.backend.stateLock.Lock()
+	defer e.backend.stateLock.Unlock()
+	if from, err := UpgradeState(ctx, storage); err != nil {
+		return fmt.Errorf("unable to upgrade state: %w", err)
+	} else if from < CurrentStateVersion {
+		logger.Info(fmt.Sprintf("gitops state migrated from version %d to %d, previous state kept in %sv%d", from, CurrentStateVersion, StorageKeyStateBackupPrefix, from))
 	}
-	if state.Resources == nil {
-		state.Resources = make(map[string]StateResource)
+	state, err := LoadState(ctx, storage)
+	if err != nil {
+		return fmt.Errorf("unable to load state: %w", err)
 	}
 
 	vaultClient, err := vault_client.NewClientFromConfig(vaultConfig)
@@ -55,12 +88,38 @@ func (e *engineImpl) ProcessCommit(ctx context.Context, storage logical.Storage,
 		return fmt.Errorf("vault client: %w", err)
 	}
 	writer := NewStorageStateWriter(storage)
-	if err := Apply(ctx, resources, vaultClient, &state, writer); err != nil {
+	result, err := Apply(ctx, resources, vaultClient, state, writer, applyOpts)
+	if err := trimHistory(ctx, storage); err != nil {
+		logger.Warn(fmt.Sprintf("unable to trim gitops history: %v", err))
+	}
+	if result.Retries > 0 {
+		logger.Info(fmt.Sprintf("gitops apply of commit %q retried %d request(s) after transient Vault errors", commit.Hash, result.Retries))
+	}
+	if result.RolledBack > 0 {
+		logger.Warn(fmt.Sprintf("gitops apply of commit %q failed, rolled back %d change(s)", commit.Hash, result.RolledBack))
+	}
+	if err != nil {
+		if result.Retries > 0 {
+			return fmt.Errorf("gitops apply (%d retries): %w", result.Retries, err)
+		}
 		return fmt.Errorf("gitops apply: %w", err)
 	}
+	if err := SnapshotState(ctx, storage, commit.Hash); err != nil {
+		logger.Warn(fmt.Sprintf("unable to snapshot gitops state of commit %q: %v", commit.Hash, err))
+	}
 	return nil
 }
 
 func (e *engineImpl) Paths(baseBackend *framework.Backend) []*framework.Path {
-	return Paths(baseBackend)
+	e.backend.baseBackend = baseBackend
+	return e.backend.paths()
+}
+
+func (e *engineImpl) SealWrapStorage() []string {
+	return []string{
+		StorageKeyState,
+		StorageKeyStateKey,
+		StorageKeyStateBackupPrefix,
+		StorageKeyStateSnapshotPrefix,
+	}
 }
@@ -0,0 +1,410 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// ExportOptions are optional settings for Export.
+type ExportOptions struct {
+	// Warn is called for paths that could not be read (e.g. permission denied); they are skipped.
+	Warn func(msg string)
+}
+
+// mountExport lists what is exported under a mount of one engine type, relative to the mount path.
+type mountExport struct {
+	configs []string // read as one resource each
+	setup   []string // listed; every item is read as a resource that the items of lists depend on
+	lists   []string // listed; every item is read as a resource
+}
+
+var authMountExports = map[string]mountExport{
+	"approle":    {lists: []string{"role"}},
+	"userpass":   {lists: []string{"users"}},
+	"kubernetes": {configs: []string{"config"}, lists: []string{"role"}},
+	"jwt":        {configs: []string{"config"}, lists: []string{"role"}},
+	"oidc":       {configs: []string{"config"}, lists: []string{"role"}},
+	"ldap":       {configs: []string{"config"}, lists: []string{"groups", "users"}},
+	"cert":       {lists: []string{"certs"}},
+	"aws":        {configs: []string{"config/client"}, lists: []string{"role"}},
+	"github":     {configs: []string{"config"}, lists: []string{"map/teams", "map/users"}},
+}
+
+var secretMountExports = map[string]mountExport{
+	"pki":        {lists: []string{"roles"}},
+	"database":   {setup: []string{"config"}, lists: []string{"roles", "static-roles"}},
+	"ssh":        {lists: []string{"roles"}},
+	"aws":        {configs: []string{"config/lease"}, lists: []string{"roles"}},
+	"kubernetes": {configs: []string{"config"}, lists: []string{"roles"}},
+	"ldap":       {configs: []string{"config"}, lists: []string{"role", "static-role"}},
+	"consul":     {lists: []string{"roles"}},
+	"rabbitmq":   {lists: []string{"roles"}},
+	"nomad":      {lists: []string{"role"}},
+}
+
+// builtinMountTypes are mounted by Vault itself and cannot be created or deleted.
+var builtinMountTypes = map[string]bool{
+	"system": true, "identity": true, "cubbyhole": true, "token": true,
+	"ns_system": true, "ns_identity": true, "ns_cubbyhole": true, "ns_token": true,
+}
+
+// mountConfigKeys are the mount config fields accepted when enabling a mount.
+var mountConfigKeys = []string{
+	"default_lease_ttl", "max_lease_ttl", "force_no_cache", "audit_non_hmac_request_keys",
+	"audit_non_hmac_response_keys", "listing_visibility", "passthrough_request_headers",
+	"allowed_response_headers", "allowed_managed_keys", "token_type",
+}
+
+type exporter struct {
+	ctx       context.Context
+	client    *api.Client
+	opts      ExportOptions
+	resources []Resource
+}
+
+// Export walks a live Vault and returns its configuration as resources: namespaces, ACL policies,
+// secrets engines and auth methods with their configs and roles, and identity entities and groups.
+// Dependencies are inferred: namespace before its contents, mount before its roles, policy before
+// the roles, entities and groups that reference it. Secret data (e.g. kv) is not exported.
+func Export(ctx context.Context, client *api.Client, opts ExportOptions) ([]Resource, error) {
+	e := &exporter{ctx: ctx, client: client, opts: opts}
+	if err := e.exportNamespace("", nil); err != nil {
+		return nil, err
+	}
+	return e.resources, nil
+}
+
+func (e *exporter) add(r Resource) string {
+	e.resources = append(e.resources, r)
+	return r.Key()
+}
+
+func (e *exporter) clientFor(namespace string) *api.Client {
+	if namespace == "" {
+		return e.client
+	}
+	return e.client.WithNamespace(strings.TrimSuffix(namespace, "/"))
+}
+
+// skip decides what to do with a read error: 404 is "nothing there", other 4xx are reported
+// through Warn and skipped, anything else aborts the export.
+func (e *exporter) skip(namespace, path string, err error) error {
+	if respErr, ok := err.(*api.ResponseError); ok && respErr.StatusCode >= 400 && respErr.StatusCode < 500 {
+		if respErr.StatusCode != 404 && e.opts.Warn != nil {
+			e.opts.Warn(fmt.Sprintf("skipping %s%s: %d %s", namespace, path, respErr.StatusCode, strings.Join(respErr.Errors, "; ")))
+		}
+		return nil
+	}
+	return fmt.Errorf("%s", formatVaultErr(namespace, path, err))
+}
+
+func (e *exporter) read(namespace, path string) (map[string]interface{}, error) {
+	secret, err := e.clientFor(namespace).Logical().ReadWithContext(e.ctx, path)
+	if err != nil {
+		return nil, e.skip(namespace, path, err)
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	data, _ := exportValue(secret.Data).(map[string]interface{})
+	return data, nil
+}
+
+// list returns the sorted keys under path; sub-folders (keys ending with '/') are dropped
+// unless folders is set.
+func (e *exporter) list(namespace, path string, folders bool) ([]string, error) {
+	secret, err := e.clientFor(namespace).Logical().ListWithContext(e.ctx, path)
+	if err != nil {
+		return nil, e.skip(namespace, path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+	raw, _ := secret.Data["keys"].([]interface{})
+	var keys []string
+	for _, k := range raw {
+		s, ok := k.(string)
+		if !ok || strings.HasSuffix(s, "/") != folders {
+			continue
+		}
+		keys = append(keys, s)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// exportNamespace exports everything in namespace ("" = root; otherwise with a trailing '/').
+// deps are added to every top-level resource of the namespace.
+func (e *exporter) exportNamespace(namespace string, deps []string) error {
+	children, err := e.list(namespace, "sys/namespaces", true)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		key := e.add(Resource{
+			Path:         "sys/namespaces/" + strings.TrimSuffix(child, "/"),
+			Namespace:    namespace,
+			Dependencies: deps,
+			Data:         map[string]interface{}{},
+		})
+		if err := e.exportNamespace(namespace+child, []string{key}); err != nil {
+			return err
+		}
+	}
+
+	policies := make(map[string]string) // policy name -> resource key
+	names, err := e.list(namespace, "sys/policies/acl", false)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == "root" || name == "default" {
+			continue
+		}
+		path := "sys/policies/acl/" + name
+		data, err := e.read(namespace, path)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		policies[name] = e.add(Resource{Path: path, Namespace: namespace, Dependencies: deps, Data: map[string]interface{}{"policy": data["policy"]}})
+	}
+
+	for _, kind := range []struct {
+		list    string
+		exports map[string]mountExport
+	}{
+		{"sys/mounts", secretMountExports},
+		{"sys/auth", authMountExports},
+	} {
+		mounts, err := e.read(namespace, kind.list)
+		if err != nil {
+			return err
+		}
+		for _, mountPath := range sortedKeys(mounts) {
+			mount, ok := mounts[mountPath].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			mountType, _ := mount["type"].(string)
+			if builtinMountTypes[mountType] {
+				continue
+			}
+			mountPath = strings.TrimSuffix(mountPath, "/")
+			key := e.add(Resource{Path: kind.list + "/" + mountPath, Namespace: namespace, Dependencies: deps, Data: mountData(mount)})
+			prefix := mountPath
+			if kind.list == "sys/auth" {
+				prefix = "auth/" + mountPath
+			}
+			if err := e.exportMount(namespace, prefix, kind.exports[mountType], key, policies); err != nil {
+				return err
+			}
+		}
+	}
+
+	return e.exportIdentity(namespace, deps, policies)
+}
+
+// exportMount exports the configs and roles under a mount (prefix is its API path).
+func (e *exporter) exportMount(namespace, prefix string, spec mountExport, mountKey string, policies map[string]string) error {
+	deps := []string{mountKey}
+	for _, config := range spec.configs {
+		path := prefix + "/" + config
+		data, err := e.read(namespace, path)
+		if err != nil {
+			return err
+		}
+		if len(data) > 0 {
+			deps = append(deps, e.add(Resource{Path: path, Namespace: namespace, Dependencies: []string{mountKey}, Data: data}))
+		}
+	}
+	setupDeps := deps
+	for i, lists := range [][]string{spec.setup, spec.lists} {
+		var added []string
+		for _, list := range lists {
+			names, err := e.list(namespace, prefix+"/"+list, false)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				path := prefix + "/" + list + "/" + name
+				data, err := e.read(namespace, path)
+				if err != nil {
+					return err
+				}
+				if data == nil {
+					continue
+				}
+				if details, ok := data["connection_details"].(map[string]interface{}); ok {
+					// database config: connection fields are written at the top level
+					delete(data, "connection_details")
+					for k, v := range details {
+						data[k] = v
+					}
+				}
+				added = append(added, e.add(Resource{Path: path, Namespace: namespace, Dependencies: withPolicyDeps(setupDeps, data, policies), Data: data}))
+			}
+		}
+		if i == 0 {
+			setupDeps = append(append([]string{}, deps...), added...)
+		}
+	}
+	return nil
+}
+
+func (e *exporter) exportIdentity(namespace string, deps []string, policies map[string]string) error {
+	entities, err := e.list(namespace, "identity/entity/name", false)
+	if err != nil {
+		return err
+	}
+	for _, name := range entities {
+		path := "identity/entity/name/" + name
+		entity, err := e.read(namespace, path)
+		if err != nil {
+			return err
+		}
+		if entity == nil {
+			continue
+		}
+		data := pickNonZero(entity, "policies", "metadata", "disabled")
+		e.add(Resource{Path: path, Namespace: namespace, Dependencies: withPolicyDeps(deps, data, policies), Data: data})
+	}
+	groups, err := e.list(namespace, "identity/group/name", false)
+	if err != nil {
+		return err
+	}
+	for _, name := range groups {
+		path := "identity/group/name/" + name
+		group, err := e.read(namespace, path)
+		if err != nil {
+			return err
+		}
+		if group == nil {
+			continue
+		}
+		data := pickNonZero(group, "type", "policies", "metadata", "member_entity_ids", "member_group_ids")
+		e.add(Resource{Path: path, Namespace: namespace, Dependencies: withPolicyDeps(deps, data, policies), Data: data})
+	}
+	return nil
+}
+
+// mountData returns the body that enables a mount as it is configured now.
+func mountData(mount map[string]interface{}) map[string]interface{} {
+	data := pickNonZero(mount, "type", "description", "local", "seal_wrap", "external_entropy_access", "options")
+	if config, ok := mount["config"].(map[string]interface{}); ok {
+		if c := pickNonZero(config, mountConfigKeys...); len(c) > 0 {
+			data["config"] = c
+		}
+	}
+	return data
+}
+
+// withPolicyDeps adds the exported policies referenced by data (policies, token_policies) to deps.
+func withPolicyDeps(deps []string, data map[string]interface{}, policies map[string]string) []string {
+	out := append([]string{}, deps...)
+	seen := make(map[string]bool)
+	for _, field := range []string{"policies", "token_policies"} {
+		var names []string
+		switch v := data[field].(type) {
+		case []interface{}:
+			for _, n := range v {
+				if s, ok := n.(string); ok {
+					names = append(names, s)
+				}
+			}
+		case string:
+			names = strings.Split(v, ",")
+		}
+		for _, n := range names {
+			if key, ok := policies[strings.TrimSpace(n)]; ok && !seen[key] {
+				seen[key] = true
+				out = append(out, key)
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// pickNonZero returns the given fields of m that are set to a non-zero value.
+func pickNonZero(m map[string]interface{}, fields ...string) map[string]interface{} {
+	out := make(map[string]interface{})
+	for _, f := range fields {
+		switch v := m[f].(type) {
+		case nil:
+		case bool:
+			if v {
+				out[f] = v
+			}
+		case string:
+			if v != "" {
+				out[f] = v
+			}
+		case int64:
+			if v != 0 {
+				out[f] = v
+			}
+		case float64:
+			if v != 0 {
+				out[f] = v
+			}
+		case []interface{}:
+			if len(v) > 0 {
+				out[f] = v
+			}
+		case map[string]interface{}:
+			if len(v) > 0 {
+				out[f] = v
+			}
+		default:
+			out[f] = v
+		}
+	}
+	return out
+}
+
+// exportValue converts a value decoded by the Vault client for YAML output: json.Number
+// becomes int64 or float64 and null fields are dropped.
+func exportValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k, val := range x {
+			if val != nil {
+				out[k] = exportValue(val)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, val := range x {
+			out[i] = exportValue(val)
+		}
+		return out
+	}
+	return v
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
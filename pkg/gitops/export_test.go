@@ -0,0 +1,112 @@
+package gitops
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVaultAPI serves "METHOD /path" (LIST for ?list=true) from a map of JSON responses
+// for the root namespace; X-Vault-Namespace selects ns1.
+func fakeVaultAPI(routes map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		method := r.Method
+		if r.URL.Query().Get("list") == "true" {
+			method = "LIST"
+		}
+		route := method + " " + strings.TrimPrefix(r.URL.Path, "/v1/")
+		if ns := r.Header.Get("X-Vault-Namespace"); ns != "" {
+			route = ns + ": " + route
+		}
+		body, ok := routes[route]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors": []}`))
+			return
+		}
+		if body == "403" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data": ` + body + `}`))
+	}
+}
+
+func Test_Export(t *testing.T) {
+	client, _ := testVaultClient(t, fakeVaultAPI(map[string]string{
+		"LIST sys/namespaces":      `{"keys": ["ns1/"]}`,
+		"LIST sys/policies/acl":    `{"keys": ["app", "default", "root"]}`,
+		"GET sys/policies/acl/app": `{"name": "app", "policy": "path \"secret/*\" { capabilities = [\"read\"] }"}`,
+		"GET sys/mounts": `{
+			"cubbyhole/": {"type": "cubbyhole"},
+			"pki/": {"type": "pki", "accessor": "pki_123", "uuid": "u", "description": "", "local": false,
+				"config": {"default_lease_ttl": 0, "max_lease_ttl": 315360000, "force_no_cache": false}},
+			"secret/": {"type": "kv", "options": {"version": "2"}, "config": {}},
+			"sys/": {"type": "system"}
+		}`,
+		"LIST pki/roles":                 `{"keys": ["web"]}`,
+		"GET pki/roles/web":              `{"allowed_domains": ["example.com"], "max_ttl": 86400, "not_before_duration": 30}`,
+		"GET sys/auth":                   `{"approle/": {"type": "approle", "description": "apps"}, "token/": {"type": "token"}}`,
+		"LIST auth/approle/role":         `{"keys": ["ci"]}`,
+		"GET auth/approle/role/ci":       `{"token_policies": ["app", "default"], "token_ttl": 3600, "secret_id_num_uses": 0}`,
+		"LIST identity/entity/name":      `{"keys": ["alice"]}`,
+		"GET identity/entity/name/alice": `{"id": "e-1", "name": "alice", "policies": ["app"], "metadata": null, "disabled": false, "creation_time": "t"}`,
+		"LIST identity/group/name":       "403",
+
+		"ns1: LIST sys/policies/acl": `{"keys": ["default"]}`,
+		"ns1: GET sys/mounts":        `{"db/": {"type": "database"}}`,
+		"ns1: LIST db/config":        `{"keys": ["pg"]}`,
+		"ns1: GET db/config/pg": `{"plugin_name": "postgresql-database-plugin", "allowed_roles": ["ro"],
+			"connection_details": {"connection_url": "postgresql://{{username}}:{{password}}@db/app", "username": "vault"}}`,
+		"ns1: LIST db/roles":   `{"keys": ["ro"]}`,
+		"ns1: GET db/roles/ro": `{"db_name": "pg", "creation_statements": ["CREATE ROLE"], "default_ttl": 3600}`,
+		"ns1: GET sys/auth":    `{"token/": {"type": "ns_token"}}`,
+	}))
+
+	var warnings []string
+	resources, err := Export(context.Background(), client, ExportOptions{Warn: func(msg string) { warnings = append(warnings, msg) }})
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0], "identity/group/name: 403")
+
+	byKey := make(map[string]Resource)
+	var keys []string
+	for _, r := range resources {
+		byKey[r.Key()] = r
+		keys = append(keys, r.Key())
+	}
+	require.Equal(t, []string{
+		"sys/namespaces/ns1",
+		"ns1/sys/mounts/db",
+		"ns1/db/config/pg",
+		"ns1/db/roles/ro",
+		"sys/policies/acl/app",
+		"sys/mounts/pki",
+		"pki/roles/web",
+		"sys/mounts/secret",
+		"sys/auth/approle",
+		"auth/approle/role/ci",
+		"identity/entity/name/alice",
+	}, keys)
+
+	require.Equal(t, map[string]interface{}{"type": "pki", "config": map[string]interface{}{"max_lease_ttl": int64(315360000)}}, byKey["sys/mounts/pki"].Data)
+	require.Equal(t, map[string]interface{}{"type": "kv", "options": map[string]interface{}{"version": "2"}}, byKey["sys/mounts/secret"].Data)
+	require.Equal(t, []string{"sys/namespaces/ns1"}, byKey["ns1/sys/mounts/db"].Dependencies)
+	require.Equal(t, []string{"ns1/sys/mounts/db", "ns1/db/config/pg"}, byKey["ns1/db/roles/ro"].Dependencies)
+	require.Equal(t, "vault", byKey["ns1/db/config/pg"].Data.(map[string]interface{})["username"])
+	require.Equal(t, []string{"sys/auth/approle", "sys/policies/acl/app"}, byKey["auth/approle/role/ci"].Dependencies)
+	require.Equal(t, map[string]interface{}{"policies": []interface{}{"app"}}, byKey["identity/entity/name/alice"].Data)
+	require.Equal(t, []string{"sys/policies/acl/app"}, byKey["identity/entity/name/alice"].Dependencies)
+
+	// The output is valid input: it loads back and lints.
+	out, err := MarshalResourcesYAML(resources)
+	require.NoError(t, err)
+	loaded, err := LoadResourcesFromFS(writeFSFiles(t, map[string]string{"export.yaml": string(out)}), "", LoadOptions{})
+	require.NoError(t, err)
+	require.Len(t, loaded, len(resources))
+	require.NoError(t, Lint(loaded))
+}
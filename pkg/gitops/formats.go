@@ -0,0 +1,222 @@
+package gitops
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hashicorp/hcl/hcl/ast"
+	hclparser "github.com/hashicorp/hcl/hcl/parser"
+	hcltoken "github.com/hashicorp/hcl/hcl/token"
+	"gopkg.in/yaml.v3"
+)
+
+// HCLExt and JSONExt are the file suffixes of resource files in HCL and JSON. Plain .hcl files
+// are not loaded as resources: they are usually Vault policies referenced with $file. Every .json
+// file is loaded; .gitops.json names resources apart from other JSON in the same directory, and
+// JSON files that are not resources (OpenAPI documents, state dumps) are excluded with
+// LoadOptions.Ignore.
+const (
+	HCLExt  = ".gitops.hcl"
+	JSONExt = ".json"
+)
+
+// isResourceFile reports whether the file name has one of the supported resource file extensions.
+func isResourceFile(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".yaml", ".yml", JSONExt, HCLExt} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeDocuments splits a resource file into document nodes according to its extension.
+// All formats are converted to yaml.Node trees with source line and column kept, so that
+// documents from every format go through the same decoding and includes.
+func decodeDocuments(fpath string, data []byte) ([]*yaml.Node, error) {
+	lower := strings.ToLower(fpath)
+	switch {
+	case strings.HasSuffix(lower, ".json"):
+		return decodeJSONDocuments(data)
+	case strings.HasSuffix(lower, HCLExt):
+		return decodeHCLDocuments(data)
+	default:
+		return decodeYAMLDocuments(data)
+	}
+}
+
+// decodeYAMLDocuments decodes a multi-document YAML stream.
+func decodeYAMLDocuments(data []byte) ([]*yaml.Node, error) {
+	var nodes []*yaml.Node
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var node yaml.Node
+		if err := dec.Decode(&node); err != nil {
+			if err == io.EOF {
+				return nodes, nil
+			}
+			return nil, err
+		}
+		nodes = append(nodes, &node)
+	}
+}
+
+// decodeJSONDocuments decodes a JSON file holding one resource object or an array of them.
+func decodeJSONDocuments(data []byte) ([]*yaml.Node, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, column := offsetPosition(data, syntaxErr.Offset)
+			return nil, fmt.Errorf("line %d, column %d: %w", line, column, err)
+		}
+		return nil, err
+	}
+	// Valid JSON is valid YAML; the YAML parser keeps positions for later errors.
+	// Raw tabs can only be whitespace in valid JSON, and YAML is stricter about them.
+	var root yaml.Node
+	if err := yaml.Unmarshal(bytes.ReplaceAll(data, []byte("\t"), []byte(" ")), &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 {
+		return nil, nil
+	}
+	top := root.Content[0]
+	switch top.Kind {
+	case yaml.MappingNode:
+		return []*yaml.Node{top}, nil
+	case yaml.SequenceNode:
+		for i, item := range top.Content {
+			if item.Kind != yaml.MappingNode {
+				return nil, fmt.Errorf("line %d: item %d: must be an object", item.Line, i+1)
+			}
+		}
+		return top.Content, nil
+	default:
+		return nil, fmt.Errorf("line %d: must be an object or an array of objects", top.Line)
+	}
+}
+
+// offsetPosition converts a byte offset into 1-based line and column.
+func offsetPosition(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// hclLabelField maps a block type to the field its label sets.
+var hclLabelField = map[string]string{
+	KindResource:  "name",
+	KindData:      "name",
+	KindGenerator: "name",
+	KindPatch:     "target",
+}
+
+// decodeHCLDocuments decodes top-level blocks of an HCL file, one document per block:
+//
+//	resource "kv-mount" {
+//	  path = "sys/mounts/kv"
+//	  data {
+//	    type = "kv"
+//	  }
+//	}
+//
+// The block type is the document kind (resource, generator or patch); the optional label
+// is the name (target for patches). Nested blocks and objects become maps.
+func decodeHCLDocuments(data []byte) ([]*yaml.Node, error) {
+	file, err := hclparser.Parse(data)
+	if err != nil {
+		var posErr *hclparser.PosError
+		if errors.As(err, &posErr) {
+			return nil, fmt.Errorf("line %d, column %d: %w", posErr.Pos.Line, posErr.Pos.Column, posErr.Err)
+		}
+		return nil, err
+	}
+	list, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("unexpected HCL root %T", file.Node)
+	}
+	var nodes []*yaml.Node
+	for _, item := range list.Items {
+		pos := item.Pos()
+		kind := hclKey(item.Keys[0])
+		labelField, ok := hclLabelField[kind]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown block %q (expected resource, data, generator or patch)", pos.Line, kind)
+		}
+		if len(item.Keys) > 2 {
+			return nil, fmt.Errorf("line %d: %s block takes at most one label", pos.Line, kind)
+		}
+		body, ok := item.Val.(*ast.ObjectType)
+		if !ok {
+			return nil, fmt.Errorf("line %d: %s must be a block", pos.Line, kind)
+		}
+		doc := hclNode(body)
+		doc.Content = append([]*yaml.Node{hclScalar("kind", pos), hclScalar(kind, pos)}, doc.Content...)
+		if len(item.Keys) == 2 {
+			labelPos := item.Keys[1].Pos()
+			doc.Content = append(doc.Content, hclScalar(labelField, labelPos), hclScalar(hclKey(item.Keys[1]), labelPos))
+		}
+		nodes = append(nodes, doc)
+	}
+	return nodes, nil
+}
+
+// hclKey returns the unquoted text of an object key.
+func hclKey(key *ast.ObjectKey) string {
+	return fmt.Sprint(key.Token.Value())
+}
+
+func hclScalar(value string, pos hcltoken.Pos) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value, Line: pos.Line, Column: pos.Column}
+}
+
+// hclNode converts an HCL value into a yaml.Node. Keys of nested blocks (a "b" { ... })
+// become nested maps; repeated keys are reported as duplicates when the node is decoded.
+func hclNode(n ast.Node) *yaml.Node {
+	pos := n.Pos()
+	switch v := n.(type) {
+	case *ast.ObjectType:
+		out := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: pos.Line, Column: pos.Column}
+		for _, item := range v.List.Items {
+			val := hclNode(item.Val)
+			for i := len(item.Keys) - 1; i > 0; i-- {
+				keyPos := item.Keys[i].Pos()
+				val = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: keyPos.Line, Column: keyPos.Column,
+					Content: []*yaml.Node{hclScalar(hclKey(item.Keys[i]), keyPos), val}}
+			}
+			out.Content = append(out.Content, hclScalar(hclKey(item.Keys[0]), item.Keys[0].Pos()), val)
+		}
+		return out
+	case *ast.ListType:
+		out := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: pos.Line, Column: pos.Column}
+		for _, elem := range v.List {
+			out.Content = append(out.Content, hclNode(elem))
+		}
+		return out
+	case *ast.LiteralType:
+		out := &yaml.Node{Kind: yaml.ScalarNode, Line: pos.Line, Column: pos.Column}
+		switch v.Token.Type {
+		case hcltoken.NUMBER:
+			out.Tag, out.Value = "!!int", v.Token.Text
+		case hcltoken.FLOAT:
+			out.Tag, out.Value = "!!float", v.Token.Text
+		case hcltoken.BOOL:
+			out.Tag, out.Value = "!!bool", v.Token.Text
+		default:
+			out.Tag, out.Value = "!!str", fmt.Sprint(v.Token.Value())
+		}
+		return out
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Line: pos.Line, Column: pos.Column}
+	}
+}
@@ -0,0 +1,146 @@
+package gitops
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const formatsYAML = `
+name: kv-mount
+path: sys/mounts/kv
+data:
+  type: kv
+  options: {version: "2"}
+  config: {max_lease_ttl: 3600}
+---
+path: sys/policies/password/reader
+dependencies: [kv-mount]
+data:
+  policy: read
+  local: true
+`
+
+func Test_Formats_SameResources(t *testing.T) {
+	files := map[string]string{
+		"yaml/a.yaml": formatsYAML,
+		"json/a.json": `[
+	{
+		"name": "kv-mount",
+		"path": "sys/mounts/kv",
+		"data": {"type": "kv", "options": {"version": "2"}, "config": {"max_lease_ttl": 3600}}
+	},
+	{
+		"path": "sys/policies/password/reader",
+		"dependencies": ["kv-mount"],
+		"data": {"policy": "read", "local": true}
+	}
+]`,
+		"hcl/a.gitops.hcl": `
+resource "kv-mount" {
+  path = "sys/mounts/kv"
+  data {
+    type = "kv"
+    options { version = "2" }
+    config = { max_lease_ttl = 3600 }
+  }
+}
+
+resource {
+  path         = "sys/policies/password/reader"
+  dependencies = ["kv-mount"]
+  data = {
+    policy = "read"
+    local  = true
+  }
+}
+`,
+		"hcl/policy.hcl": `path "secret/*" { capabilities = ["read"] }`,
+	}
+	fs := writeFSFiles(t, files)
+	want, err := LoadResourcesFromFS(fs, "yaml", LoadOptions{})
+	require.NoError(t, err)
+	require.Len(t, want, 2)
+	for _, dir := range []string{"json", "hcl"} {
+		t.Run(dir, func(t *testing.T) {
+			got, err := LoadResourcesFromFS(fs, dir, LoadOptions{})
+			require.NoError(t, err)
+			require.NoError(t, Lint(got))
+			require.Len(t, got, len(want))
+			for i := range want {
+				require.Equal(t, want[i].Key(), got[i].Key())
+				require.Equal(t, want[i].Dependencies, got[i].Dependencies)
+				require.Equal(t, want[i].Data, got[i].Data)
+				require.Equal(t, dataDigestWithRevision(want[i].Data, 0), dataDigestWithRevision(got[i].Data, 0))
+			}
+		})
+	}
+}
+
+func Test_Formats_Errors(t *testing.T) {
+	tests := []struct {
+		description string
+		file        string
+		content     string
+		contains    string
+	}{
+		{description: "json syntax", file: "a.json", content: "{\n  \"path\": \"a\",\n  \"data\": {\n}", contains: "line 4"},
+		{description: "json scalar item", file: "a.json", content: "[{\"path\": \"a\"},\n 1]", contains: "line 2: item 2"},
+		{description: "json data not object", file: "a.json", content: `{"path": "a", "data": []}`, contains: "'data' must be an object"},
+		{description: "hcl syntax", file: "a.gitops.hcl", content: "resource {\n  path = \n}\n", contains: "line 3"},
+		{description: "hcl unknown block", file: "a.gitops.hcl", content: "\nvariable \"x\" {}\n", contains: "line 2: unknown block"},
+		{description: "hcl duplicate name", file: "a.gitops.hcl", content: "resource \"a\" {\n  name = \"b\"\n  path = \"p\"\n}\n", contains: "already defined"},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			_, err := LoadResourcesFromFS(writeFSFiles(t, map[string]string{test.file: test.content}), "", LoadOptions{})
+			require.Error(t, err)
+			require.Contains(t, err.Error(), test.file)
+			require.Contains(t, err.Error(), test.contains)
+		})
+	}
+}
+
+func Test_Formats_Ignore(t *testing.T) {
+	files := map[string]string{
+		"vault/a.yaml":                  "path: sys/mounts/a\ndata: {type: kv}\n",
+		"vault/b.json":                  `{"path": "sys/mounts/b", "data": {"type": "kv"}}`,
+		"vault/c.gitops.json":           `{"path": "sys/mounts/c", "data": {"type": "kv"}}`,
+		"vault/openapi.json":            `{"openapi": "3.0.2", "paths": {}}`,
+		"vault/sub/openapi.json":        `{"openapi": "3.0.2", "paths": {}}`,
+		"vault/generated/d.json":        `["not", "a", "resource"]`,
+		"vault/generated/e.gitops.json": `{"path": "sys/mounts/e", "data": {"type": "kv"}}`,
+	}
+	opts := LoadOptions{Ignore: []string{"openapi.json", "/generated/?.json"}}
+	fromFS, err := LoadResourcesFromFS(writeFSFiles(t, files), "vault", opts)
+	require.NoError(t, err)
+	var paths []string
+	for _, r := range fromFS {
+		paths = append(paths, r.Path)
+	}
+	require.Equal(t, []string{"sys/mounts/a", "sys/mounts/b", "sys/mounts/c", "sys/mounts/e"}, paths, ".json and .gitops.json files are resources")
+
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o644))
+	}
+	fromPath, err := LoadResourcesFromPath(filepath.Join(dir, "vault"), opts)
+	require.NoError(t, err)
+	require.Len(t, fromPath, len(fromFS))
+	ignored, err := IgnoredFiles(filepath.Join(dir, "vault"), opts)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "vault/generated/d.json"),
+		filepath.Join(dir, "vault/openapi.json"),
+		filepath.Join(dir, "vault/sub/openapi.json"),
+	}, ignored)
+
+	_, err = LoadResourcesFromFS(writeFSFiles(t, files), "vault", LoadOptions{})
+	require.ErrorContains(t, err, "generated/d.json", "other JSON files are not skipped silently")
+	_, err = LoadResourcesFromFS(writeFSFiles(t, files), "vault", LoadOptions{Ignore: []string{"["}})
+	require.ErrorContains(t, err, `invalid ignore pattern "["`)
+}
@@ -0,0 +1,126 @@
+package gitops
+
+import (
+	"fmt"
+	"sort"
+)
+
+// generatorDoc stamps out one resource per item of for_each (kind: generator).
+//
+// The resource template's name, path, namespace and dependencies are rendered at load time
+// with .each (key and value of the item) and .vars; data is rendered at apply time like any
+// resource with 'templating: go', with .each available as well.
+type generatorDoc struct {
+	Kind       string      `yaml:"kind"`
+	Name       string      `yaml:"name"`
+	ForEach    interface{} `yaml:"for_each"`
+	ForEachVar string      `yaml:"for_each_var"`
+	Resource   Resource    `yaml:"resource"`
+}
+
+// generatorItem is one for_each element, exposed to templates as .each.
+type generatorItem struct {
+	Key   string
+	Value interface{}
+}
+
+// items returns for_each elements in a deterministic order, keyed so that reordering
+// the source list does not change generated names: map keys, scalar list values,
+// or the 'name' field of list items that are maps.
+func (g *generatorDoc) items(vars map[string]interface{}) ([]generatorItem, error) {
+	source := g.ForEach
+	if g.ForEachVar != "" {
+		if source != nil {
+			return nil, fmt.Errorf("for_each and for_each_var are mutually exclusive")
+		}
+		v, ok := vars[g.ForEachVar]
+		if !ok {
+			return nil, fmt.Errorf("for_each_var: variable %q not found", g.ForEachVar)
+		}
+		source = v
+	}
+	var items []generatorItem
+	switch x := source.(type) {
+	case nil:
+		return nil, fmt.Errorf("for_each or for_each_var is required")
+	case map[string]interface{}:
+		for k, v := range x {
+			items = append(items, generatorItem{Key: k, Value: v})
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	case []interface{}:
+		for i, v := range x {
+			var key string
+			switch item := v.(type) {
+			case map[string]interface{}:
+				name, ok := item["name"]
+				if !ok {
+					return nil, fmt.Errorf("for_each item %d: map items must have a 'name' field", i+1)
+				}
+				key = fmt.Sprint(name)
+			case []interface{}, nil:
+				return nil, fmt.Errorf("for_each item %d: must be a scalar or a map with 'name'", i+1)
+			default:
+				key = fmt.Sprint(item)
+			}
+			items = append(items, generatorItem{Key: key, Value: v})
+		}
+	default:
+		return nil, fmt.Errorf("for_each must be a list or a map (got %T)", source)
+	}
+	seen := make(map[string]bool, len(items))
+	for _, it := range items {
+		if seen[it.Key] {
+			return nil, fmt.Errorf("for_each: duplicate key %q", it.Key)
+		}
+		seen[it.Key] = true
+	}
+	return items, nil
+}
+
+// expand produces one normalized resource per item.
+func (g *generatorDoc) expand(vars map[string]interface{}, env *renderEnv) ([]Resource, error) {
+	items, err := g.items(vars)
+	if err != nil {
+		return nil, err
+	}
+	if g.Resource.Data != nil && !isObject(g.Resource.Data) {
+		return nil, fmt.Errorf("resource: 'data' must be an object (map)")
+	}
+	noRef := func(name, key string) (interface{}, error) {
+		return nil, fmt.Errorf("ref is only available in data")
+	}
+	resources := make([]Resource, 0, len(items))
+	for _, it := range items {
+		itemEnv := &renderEnv{
+			vars:  vars,
+			files: env.files,
+			dir:   env.dir,
+			each:  map[string]interface{}{"key": it.Key, "value": it.Value},
+		}
+		r := g.Resource
+		r.env = itemEnv
+		rd := newRenderer(&r, noRef)
+		fields := []*string{&r.Name, &r.Path, &r.Namespace}
+		for _, f := range fields {
+			if *f, err = rd.renderString(*f); err != nil {
+				return nil, fmt.Errorf("item %q: %w", it.Key, err)
+			}
+		}
+		r.Dependencies = make([]string, len(g.Resource.Dependencies))
+		for i, dep := range g.Resource.Dependencies {
+			if r.Dependencies[i], err = rd.renderString(dep); err != nil {
+				return nil, fmt.Errorf("item %q: dependency %d: %w", it.Key, i+1, err)
+			}
+		}
+		if r.Name == "" && g.Name != "" {
+			r.Name = g.Name + "/" + it.Key
+		}
+		if r.Templating == "" {
+			r.Templating = TemplatingGo
+		}
+		NormalizeResource(&r)
+		resources = append(resources, r)
+	}
+	return resources, nil
+}
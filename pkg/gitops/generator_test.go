@@ -0,0 +1,102 @@
+package gitops
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Generator_Expand(t *testing.T) {
+	fs := writeFSFiles(t, map[string]string{
+		"vars.yaml": "teams:\n  search: {ttl: 1h}\n  payments: {ttl: 2h}\n",
+		"vault/teams.yaml": `
+kind: generator
+name: approle
+for_each_var: teams
+resource:
+  path: "auth/approle/role/{{ .each.key }}"
+  dependencies: ["policy-{{ .each.key }}"]
+  data:
+    token_ttl: "{{ .each.value.ttl }}"
+    token_policies: ["{{ .each.key }}"]
+---
+kind: generator
+for_each:
+  - name: payments
+    rules: read
+  - name: search
+    rules: list
+resource:
+  name: "policy-{{ .each.key }}"
+  path: "sys/policies/acl/{{ .each.value.name }}"
+  data:
+    policy: 'path "secret/{{ .each.key }}/*" { capabilities = ["{{ .each.value.rules }}"] }'
+`,
+	})
+	resources, err := LoadResourcesFromFS(fs, "vault", LoadOptions{VarsFile: "vars.yaml"})
+	require.NoError(t, err)
+	require.NoError(t, Lint(resources))
+
+	var names []string
+	for _, r := range resources {
+		names = append(names, r.Key())
+	}
+	require.Equal(t, []string{"approle/payments", "approle/search", "policy-payments", "policy-search"}, names)
+	require.Equal(t, "auth/approle/role/payments", resources[0].Path)
+	require.Equal(t, []string{"policy-payments"}, resources[0].Dependencies)
+
+	data, err := resolveResourceData(&resources[1], &State{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"token_ttl": "1h", "token_policies": []interface{}{"search"}}, data)
+
+	data, err = resolveResourceData(&resources[3], &State{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"policy": `path "secret/search/*" { capabilities = ["list"] }`}, data)
+}
+
+func Test_Generator_StableKeys(t *testing.T) {
+	load := func(list string) []string {
+		fs := writeFSFiles(t, map[string]string{"a.yaml": `
+kind: generator
+name: mount
+for_each: ` + list + `
+resource:
+  path: "sys/mounts/{{ .each.key }}"
+  data: {type: kv}
+`})
+		resources, err := LoadResourcesFromFS(fs, "", LoadOptions{})
+		require.NoError(t, err)
+		keys := map[string]string{}
+		for _, r := range resources {
+			keys[r.Key()] = r.Path
+		}
+		require.Len(t, keys, 3)
+		var out []string
+		for k, p := range keys {
+			out = append(out, k+"="+p)
+		}
+		return out
+	}
+	require.ElementsMatch(t, load("[a, b, c]"), load("[c, a, b]"))
+}
+
+func Test_Generator_Errors(t *testing.T) {
+	tests := []struct {
+		description string
+		doc         string
+	}{
+		{description: "missing for_each", doc: "kind: generator\nresource: {path: a, data: {}}\n"},
+		{description: "duplicate key", doc: "kind: generator\nfor_each: [a, a]\nresource: {path: a, data: {}}\n"},
+		{description: "map item without name", doc: "kind: generator\nfor_each: [{x: 1}]\nresource: {path: a, data: {}}\n"},
+		{description: "unknown variable", doc: "kind: generator\nfor_each_var: nope\nresource: {path: a, data: {}}\n"},
+		{description: "ref in path", doc: "kind: generator\nfor_each: [a]\nresource: {path: '{{ ref \"x\" \"y\" }}', data: {}}\n"},
+		{description: "unknown kind", doc: "kind: nope\npath: a\ndata: {}\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			fs := writeFSFiles(t, map[string]string{"a.yaml": test.doc})
+			_, err := LoadResourcesFromFS(fs, "", LoadOptions{})
+			require.Error(t, err)
+		})
+	}
+}
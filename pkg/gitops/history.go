@@ -0,0 +1,134 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/trublast/vault-plugin-gitops/pkg/util"
+)
+
+const (
+	// StorageKeyHistoryPrefix holds one history entry per key; keys sort in the order the
+	// entries were recorded.
+	StorageKeyHistoryPrefix = "gitops_history/"
+	// StorageKeyHistory is the history of earlier plugin versions, kept as one list. It is moved
+	// under StorageKeyHistoryPrefix by trimHistory.
+	StorageKeyHistory = "gitops_history"
+
+	// MaxHistoryEntries is how many history entries are kept; older ones are dropped.
+	MaxHistoryEntries = 500
+)
+
+// History actions besides the PlanAction values (create, update, delete, abandon).
+const (
+	HistoryForget  = "forget"
+	HistoryRestore = "restore"
+)
+
+// HistoryEntry records one change of the state.
+type HistoryEntry struct {
+	Time      time.Time `json:"time"`
+	Commit    string    `json:"commit,omitempty"`
+	Action    string    `json:"action"`
+	Key       string    `json:"key"`
+	Namespace string    `json:"namespace,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// HistoryRecorder is implemented by state writers that also keep a history of changes.
+type HistoryRecorder interface {
+	RecordHistory(ctx context.Context, entry HistoryEntry) error
+}
+
+// historySeq orders entries recorded in the same nanosecond.
+var historySeq atomic.Uint32
+
+// historyKey returns the storage key of an entry recorded at t.
+func historyKey(t time.Time) string {
+	return fmt.Sprintf("%s%020d-%010d", StorageKeyHistoryPrefix, t.UnixNano(), historySeq.Add(1))
+}
+
+// historyKeys returns the keys of the history entries, oldest first.
+func historyKeys(ctx context.Context, storage logical.Storage) ([]string, error) {
+	keys, err := storage.List(ctx, StorageKeyHistoryPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list %q: %w", StorageKeyHistoryPrefix, err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// GetHistory returns the recorded history, oldest first.
+func GetHistory(ctx context.Context, storage logical.Storage) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	if err := util.GetJSON(ctx, storage, StorageKeyHistory, &entries); err != nil {
+		return nil, err
+	}
+	keys, err := historyKeys(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		var entry *HistoryEntry
+		if err := util.GetJSON(ctx, storage, StorageKeyHistoryPrefix+key, &entry); err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, nil
+}
+
+// appendHistory stores an entry of the history; it writes only the new entry; see trimHistory for
+// dropping old ones.
+func appendHistory(ctx context.Context, storage logical.Storage, entry HistoryEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	return util.PutJSON(ctx, storage, historyKey(entry.Time), entry)
+}
+
+// recordHistory appends an entry and trims the history; for changes made outside of apply.
+func recordHistory(ctx context.Context, storage logical.Storage, entry HistoryEntry) error {
+	if err := appendHistory(ctx, storage, entry); err != nil {
+		return err
+	}
+	return trimHistory(ctx, storage)
+}
+
+// trimHistory deletes the entries beyond MaxHistoryEntries, oldest first. The list of earlier
+// plugin versions is moved to one key per entry first.
+func trimHistory(ctx context.Context, storage logical.Storage) error {
+	var legacy []HistoryEntry
+	if err := util.GetJSON(ctx, storage, StorageKeyHistory, &legacy); err != nil {
+		return err
+	}
+	for _, entry := range legacy {
+		if err := util.PutJSON(ctx, storage, historyKey(entry.Time), entry); err != nil {
+			return err
+		}
+	}
+	if legacy != nil {
+		if err := storage.Delete(ctx, StorageKeyHistory); err != nil {
+			return err
+		}
+	}
+	keys, err := historyKeys(ctx, storage)
+	if err != nil {
+		return err
+	}
+	for len(keys) > MaxHistoryEntries {
+		if err := storage.Delete(ctx, StorageKeyHistoryPrefix+keys[0]); err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
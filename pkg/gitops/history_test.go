@@ -0,0 +1,51 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+
+	"github.com/trublast/vault-plugin-gitops/pkg/util"
+)
+
+func Test_History(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	legacy := []HistoryEntry{
+		{Time: start, Action: "create", Key: "legacy-1"},
+		{Time: start.Add(time.Second), Action: "update", Key: "legacy-2"},
+	}
+	require.NoError(t, util.PutJSON(ctx, storage, StorageKeyHistory, legacy))
+
+	for i := 0; i < MaxHistoryEntries; i++ {
+		require.NoError(t, appendHistory(ctx, storage, HistoryEntry{Time: start.Add(time.Hour), Action: "create", Key: fmt.Sprintf("k%d", i)}))
+	}
+	entries, err := GetHistory(ctx, storage)
+	require.NoError(t, err)
+	require.Len(t, entries, MaxHistoryEntries+2)
+	require.Equal(t, "legacy-1", entries[0].Key)
+	require.Equal(t, "k0", entries[2].Key, "entries of the same time keep their order")
+	require.Equal(t, fmt.Sprintf("k%d", MaxHistoryEntries-1), entries[len(entries)-1].Key)
+
+	require.NoError(t, trimHistory(ctx, storage))
+	entry, err := storage.Get(ctx, StorageKeyHistory)
+	require.NoError(t, err)
+	require.Nil(t, entry, "the legacy list is moved")
+	entries, err = GetHistory(ctx, storage)
+	require.NoError(t, err)
+	require.Len(t, entries, MaxHistoryEntries)
+	require.Equal(t, "k0", entries[0].Key)
+
+	require.NoError(t, recordHistory(ctx, storage, HistoryEntry{Action: HistoryForget, Key: "last"}))
+	entries, err = GetHistory(ctx, storage)
+	require.NoError(t, err)
+	require.Len(t, entries, MaxHistoryEntries)
+	require.Equal(t, "k1", entries[0].Key)
+	require.Equal(t, "last", entries[len(entries)-1].Key)
+	require.False(t, entries[len(entries)-1].Time.IsZero())
+}
@@ -0,0 +1,89 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// ImportOptions are optional settings for Import.
+type ImportOptions struct {
+	// Client, if set, reads the current response data of the resource from Vault.
+	Client *api.Client
+	// ReadPath is the path ResponseData is read from instead of the resource path,
+	// e.g. pki/cert/ca for pki/root/generate/internal (which cannot be read back).
+	ReadPath string
+}
+
+// Import records r as already applied: its current digest is stored in state, so the next
+// apply treats it as unchanged instead of sending the request again.
+func Import(ctx context.Context, r *Resource, state *State, opts ImportOptions) error {
+	if r.Abandoned() {
+		return fmt.Errorf("resource %s is abandoned", r.Key())
+	}
+	if r.IsDataSource() {
+		return fmt.Errorf("resource %s is a data source: it is read on apply, nothing to import", r.Key())
+	}
+	key := r.Key()
+	if _, inState := state.Resources[key]; inState {
+		return fmt.Errorf("resource %s is already in state", key)
+	}
+	resolvedData, err := resolveResourceData(r, state)
+	if err != nil {
+		return fmt.Errorf("resource %s%s: %w", r.Namespace, r.Path, err)
+	}
+	var responseData interface{}
+	if opts.Client != nil {
+		if responseData, err = readResponseData(ctx, opts.Client, r.NamespaceOrDefault(), r.Path, opts.ReadPath); err != nil {
+			return err
+		}
+	}
+	ns, pathN := r.location()
+	state.Resources[key] = StateResource{
+		DataDigest:     dataDigestWithRevision(resolvedData, revisionForDigest(r.Revision)),
+		Dependencies:   r.Dependencies,
+		IgnoreFailures: r.IgnoreFailures,
+		PreventDestroy: r.PreventDestroy,
+		ResponseData:   keepResponse(responseData, r.KeepResponse),
+		Delete:         deleteSpecFor(r),
+		Namespace:      ns,
+		Path:           pathN,
+	}
+	return nil
+}
+
+// PendingImport returns the state entry recorded by the state/import endpoint, which has no
+// access to the repository: the next apply adopts the entry (see StateResource.Imported).
+func PendingImport(ctx context.Context, client *api.Client, namespace, path, readPath string) (StateResource, error) {
+	res := StateResource{Imported: true}
+	res.Namespace, res.Path = stateLocation(namespace, path)
+	if client != nil {
+		data, err := readResponseData(ctx, client, namespace, path, readPath)
+		if err != nil {
+			return res, err
+		}
+		res.ResponseData = data
+	}
+	return res, nil
+}
+
+// readResponseData reads readPath (or path) from Vault and returns the response data.
+func readResponseData(ctx context.Context, client *api.Client, namespace, path, readPath string) (interface{}, error) {
+	if readPath == "" {
+		readPath = path
+	}
+	readPath = strings.TrimPrefix(readPath, "/")
+	if namespace != "" {
+		client = client.WithNamespace(strings.TrimSuffix(namespace, "/"))
+	}
+	secret, err := client.Logical().ReadWithContext(ctx, readPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s", formatVaultErr(namespace, readPath, err))
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("resource %s%s: nothing to read", namespace, readPath)
+	}
+	return secret.Data, nil
+}
@@ -0,0 +1,121 @@
+package gitops
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// testVaultClient returns a client for a fake Vault and the list of requests it received.
+func testVaultClient(t *testing.T, handler http.HandlerFunc) (*api.Client, *[]string) {
+	var requests []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	cfg := api.DefaultConfig()
+	cfg.Address = server.URL
+	cfg.MaxRetries = 0
+	client, err := api.NewClient(cfg)
+	require.NoError(t, err)
+	return client, &requests
+}
+
+func Test_Import(t *testing.T) {
+	client, requests := testVaultClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/pki/cert/ca" {
+			_, _ = w.Write([]byte(`{"data": {"certificate": "PEM"}}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	resources := []Resource{
+		{Name: "root-ca", Path: "pki/root/generate/internal", Data: map[string]interface{}{"common_name": "example.com"}},
+		{Name: "role", Path: "pki/roles/web", Dependencies: []string{"root-ca"}, Data: map[string]interface{}{"issuer": "<root-ca:certificate>"}},
+	}
+	state := &State{Resources: map[string]StateResource{}}
+	ctx := context.Background()
+
+	require.NoError(t, Import(ctx, &resources[0], state, ImportOptions{Client: client, ReadPath: "pki/cert/ca"}))
+	require.Error(t, Import(ctx, &resources[0], state, ImportOptions{}), "already in state")
+	require.Equal(t, map[string]interface{}{"certificate": "PEM"}, state.Resources["root-ca"].ResponseData)
+
+	changes, err := Plan(resources, state)
+	require.NoError(t, err)
+	require.Equal(t, PlanUnchanged, changes[0].Action)
+	require.Equal(t, PlanCreate, changes[1].Action)
+	require.False(t, changes[1].Unknown, "response data of the import is available to templates")
+
+	require.NoError(t, Import(ctx, &resources[1], state, ImportOptions{}))
+	_, err = Apply(ctx, resources, client, state, nil, ApplyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"GET /v1/pki/cert/ca"}, *requests)
+
+	mount := Resource{Name: "kv", Namespace: "/team", Path: "/sys/mounts/kv/"}
+	require.NoError(t, Import(ctx, &mount, state, ImportOptions{}))
+	require.Equal(t, "team/", state.Resources["kv"].Namespace, "namespace and path are recorded normalized")
+	require.Equal(t, "sys/mounts/kv", state.Resources["kv"].Path)
+}
+
+func Test_PendingImport(t *testing.T) {
+	client, requests := testVaultClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ctx := context.Background()
+	fb := &framework.Backend{}
+	fb.Paths = Paths(fb)
+	storage := &logical.InmemStorage{}
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+	require.NoError(t, fb.Setup(ctx, config))
+
+	for _, data := range []map[string]interface{}{
+		{"key": "token", "path": "auth/token/create"},
+		{"key": "undeclared", "path": "sys/mounts/other"},
+	} {
+		resp, err := fb.HandleRequest(ctx, &logical.Request{Operation: logical.UpdateOperation, Path: "state/import", Storage: storage, Data: data})
+		require.NoError(t, err)
+		require.False(t, resp.IsError(), "%v", resp.Data)
+	}
+	resp, err := fb.HandleRequest(ctx, &logical.Request{Operation: logical.UpdateOperation, Path: "state/import", Storage: storage, Data: map[string]interface{}{"key": "token", "path": "auth/token/create"}})
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+
+	var state State
+	entry, err := storage.Get(ctx, StorageKeyState)
+	require.NoError(t, err)
+	require.NoError(t, entry.DecodeJSON(&state))
+	require.True(t, state.Resources["token"].Imported)
+
+	resources := []Resource{{Name: "token", Path: "auth/token/create", Data: map[string]interface{}{"policies": "default"}}}
+	changes, err := Plan(resources, &state)
+	require.NoError(t, err)
+	require.Equal(t, []PlanChange{{Key: "token", Path: "auth/token/create", Action: PlanImport}}, changes)
+
+	_, err = Apply(ctx, resources, client, &state, NewStorageStateWriter(storage), ApplyOptions{})
+	require.NoError(t, err)
+	require.Empty(t, *requests)
+	require.False(t, state.Resources["token"].Imported)
+	require.NotEmpty(t, state.Resources["token"].DataDigest)
+	require.True(t, state.Resources["undeclared"].Imported, "pending imports are not deleted")
+
+	changes, err = Plan(resources, &state)
+	require.NoError(t, err)
+	require.Equal(t, PlanUnchanged, changes[0].Action)
+
+	history, err := GetHistory(ctx, storage)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	require.Equal(t, string(PlanImport), history[2].Action)
+}
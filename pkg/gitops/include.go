@@ -0,0 +1,135 @@
+package gitops
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// includeTag is the YAML tag that replaces a scalar with the contents of a file: !file policies/admin.hcl
+	includeTag = "!file"
+	// includeKey is the single key of a mapping that is replaced with the contents of a file: {"$file": "..."}
+	includeKey = "$file"
+)
+
+// resolveDataIncludes resolves the file references in the resource data of a document of the
+// given kind: 'data' of resources, 'resource.data' of generators, 'merge.data' and the values of
+// '/data' operations of patches. References elsewhere (path, name, dependencies) are left as is.
+func resolveDataIncludes(node *yaml.Node, kind string, env *renderEnv) error {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	type dataNode struct {
+		field string
+		node  *yaml.Node
+	}
+	var nodes []dataNode
+	switch kind {
+	case KindGenerator:
+		nodes = append(nodes, dataNode{"resource.data", mappingValue(mappingValue(node, "resource"), "data")})
+	case KindPatch:
+		nodes = append(nodes, dataNode{"merge.data", mappingValue(mappingValue(node, "merge"), "data")})
+		if ops := mappingValue(node, "json_patch"); ops != nil && ops.Kind == yaml.SequenceNode {
+			for i, op := range ops.Content {
+				path := mappingValue(op, "path")
+				if path == nil || (path.Value != "/data" && !strings.HasPrefix(path.Value, "/data/")) {
+					continue
+				}
+				nodes = append(nodes, dataNode{fmt.Sprintf("json_patch[%d].value", i), mappingValue(op, "value")})
+			}
+		}
+	default:
+		nodes = append(nodes, dataNode{"data", mappingValue(node, "data")})
+	}
+	for _, n := range nodes {
+		if n.node == nil {
+			continue
+		}
+		if err := resolveIncludes(n.node, env); err != nil {
+			return fmt.Errorf("%s: %w", n.field, err)
+		}
+	}
+	if ref := findInclude(node); ref != nil {
+		return fmt.Errorf("line %d: file includes are only allowed in data", ref.Line)
+	}
+	return nil
+}
+
+// findInclude returns the first file reference left in node; nil if there is none.
+func findInclude(node *yaml.Node) *yaml.Node {
+	if node.Kind == yaml.ScalarNode && node.Tag == includeTag {
+		return node
+	}
+	if node.Kind == yaml.MappingNode && len(node.Content) == 2 && node.Content[0].Value == includeKey {
+		return node
+	}
+	for _, child := range node.Content {
+		if ref := findInclude(child); ref != nil {
+			return ref
+		}
+	}
+	return nil
+}
+
+// mappingValue returns the value of key in a mapping node; nil if node is not a mapping or has
+// no such key.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// resolveIncludes replaces file references in node (in place) with string scalars holding the file contents.
+// Files are read relative to the YAML file and must stay under the loader root (see repoFiles).
+func resolveIncludes(node *yaml.Node, env *renderEnv) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := resolveIncludes(child, env); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		if len(node.Content) == 2 && node.Content[0].Value == includeKey {
+			return includeFile(node, node.Content[1], env)
+		}
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := resolveIncludes(node.Content[i], env); err != nil {
+				return fmt.Errorf("%s: %w", node.Content[i-1].Value, err)
+			}
+		}
+	case yaml.ScalarNode:
+		if node.Tag == includeTag {
+			return includeFile(node, node, env)
+		}
+	}
+	return nil
+}
+
+// includeFile reads the file named by nameNode and turns node into a string scalar with its contents.
+func includeFile(node, nameNode *yaml.Node, env *renderEnv) error {
+	if nameNode.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: %s expects a file name", nameNode.Line, includeTag)
+	}
+	data, err := env.readFile(nameNode.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", nameNode.Line, err)
+	}
+	line, column := node.Line, node.Column
+	*node = yaml.Node{
+		Kind:   yaml.ScalarNode,
+		Tag:    "!!str",
+		Value:  string(data),
+		Line:   line,
+		Column: column,
+	}
+	return nil
+}
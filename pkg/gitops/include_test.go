@@ -0,0 +1,81 @@
+package gitops
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Includes(t *testing.T) {
+	files := map[string]string{
+		"vault/policies/admin.hcl": `path "*" { capabilities = ["sudo"] }`,
+		"vault/acl/policy.yaml": `
+path: sys/policies/acl/admin
+data:
+  policy: !file ../policies/admin.hcl
+---
+path: sys/policies/acl/admin2
+data:
+  nested:
+    - {"$file": "../policies/admin.hcl"}
+`,
+	}
+	resources, err := LoadResourcesFromFS(writeFSFiles(t, files), "vault", LoadOptions{})
+	require.NoError(t, err)
+	require.Len(t, resources, 2)
+	require.Equal(t, `path "*" { capabilities = ["sudo"] }`, resources[0].Data.(map[string]interface{})["policy"])
+	require.Equal(t, []interface{}{`path "*" { capabilities = ["sudo"] }`}, resources[1].Data.(map[string]interface{})["nested"])
+
+	// Included content participates in the digest.
+	digest := func(rs []Resource) string {
+		data, err := resolveResourceData(&rs[0], &State{})
+		require.NoError(t, err)
+		return dataDigestWithRevision(data, 0)
+	}
+	before := digest(resources)
+	files["vault/policies/admin.hcl"] = `path "*" { capabilities = ["read"] }`
+	resources, err = LoadResourcesFromFS(writeFSFiles(t, files), "vault", LoadOptions{})
+	require.NoError(t, err)
+	require.NotEqual(t, before, digest(resources))
+}
+
+func Test_Includes_OutsideRoot(t *testing.T) {
+	for _, name := range []string{"../secret.hcl", "/etc/passwd", "../../vault/../secret.hcl"} {
+		t.Run(name, func(t *testing.T) {
+			fs := writeFSFiles(t, map[string]string{
+				"secret.hcl":   "secret",
+				"vault/a.yaml": "path: a\ndata:\n  v: !file " + name + "\n",
+			})
+			_, err := LoadResourcesFromFS(fs, "vault", LoadOptions{})
+			require.Error(t, err)
+		})
+	}
+}
+
+func Test_Includes_OnlyData(t *testing.T) {
+	tests := []struct {
+		description string
+		doc         string
+		err         string
+	}{
+		{description: "path", doc: "path: !file name.txt\ndata: {v: 1}\n", err: "line 1: file includes are only allowed in data"},
+		{description: "dependencies", doc: "path: a\ndependencies:\n  - {\"$file\": name.txt}\n", err: "line 3: file includes are only allowed in data"},
+		{description: "generator data", doc: "kind: generator\nname: g\nfor_each: [x]\nresource:\n  path: a/{{ .each.key }}\n  data:\n    v: !file name.txt\n"},
+		{description: "patch outside overlay", doc: "kind: patch\ntarget: a\nmerge:\n  data:\n    v: !file name.txt\n", err: "patch"},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			fs := writeFSFiles(t, map[string]string{
+				"vault/name.txt": "secret/x",
+				"vault/a.yaml":   test.doc,
+			})
+			resources, err := LoadResourcesFromFS(fs, "vault", LoadOptions{})
+			if test.err != "" {
+				require.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "secret/x", resources[0].Data.(map[string]interface{})["v"])
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package gitops
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// applyJSONPatch applies JSON Patch operations (RFC 6902) to doc in order and returns the result.
+// Supported operations: add, remove, replace, move, copy, test.
+func applyJSONPatch(doc interface{}, ops []map[string]interface{}) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		if doc, err = applyJSONPatchOp(doc, op); err != nil {
+			return nil, fmt.Errorf("json_patch operation %d: %w", i+1, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyJSONPatchOp(doc interface{}, op map[string]interface{}) (interface{}, error) {
+	name, _ := op["op"].(string)
+	path, err := jsonPointerField(op, "path")
+	if err != nil {
+		return nil, err
+	}
+	value, hasValue := op["value"]
+	switch name {
+	case "add", "replace", "test":
+		if !hasValue {
+			return nil, fmt.Errorf("%s: 'value' is required", name)
+		}
+	case "move", "copy":
+		from, err := jsonPointerField(op, "from")
+		if err != nil {
+			return nil, err
+		}
+		if name == "move" {
+			if isPointerPrefix(from, path) && len(from) != len(path) {
+				return nil, fmt.Errorf("move: cannot move a value into one of its children")
+			}
+			doc, value, err = jsonPointerRemove(doc, from)
+		} else {
+			value, err = jsonPointerGet(doc, from)
+			value = copyJSONValue(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: from: %w", name, err)
+		}
+	case "remove":
+	default:
+		return nil, fmt.Errorf("unknown op %q", name)
+	}
+
+	switch name {
+	case "add", "move", "copy":
+		doc, err = jsonPointerAdd(doc, path, value)
+	case "remove":
+		doc, _, err = jsonPointerRemove(doc, path)
+	case "replace":
+		if doc, _, err = jsonPointerRemove(doc, path); err == nil {
+			doc, err = jsonPointerAdd(doc, path, value)
+		}
+	case "test":
+		var current interface{}
+		if current, err = jsonPointerGet(doc, path); err == nil && !reflect.DeepEqual(current, value) {
+			err = fmt.Errorf("value at %q does not match", "/"+strings.Join(path, "/"))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return doc, nil
+}
+
+// jsonPointerField parses the JSON pointer (RFC 6901) in op[field] into unescaped reference tokens.
+func jsonPointerField(op map[string]interface{}, field string) ([]string, error) {
+	s, ok := op[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("'%s' is required", field)
+	}
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("%s %q: must start with '/'", field, s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isPointerPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses an array reference token; max is the largest allowed index.
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+func jsonPointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, tok := range path {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[tok]
+			if !ok {
+				return nil, fmt.Errorf("key %q not found", tok)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(tok, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, fmt.Errorf("cannot reference %q in a scalar", tok)
+		}
+	}
+	return doc, nil
+}
+
+// jsonPointerAdd adds value at path and returns the updated document.
+// Maps are updated in place; lists are rebuilt, so the parent is updated with the result.
+func jsonPointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	tok, last := path[0], len(path) == 1
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		if last {
+			c[tok] = value
+			return c, nil
+		}
+		child, ok := c[tok]
+		if !ok {
+			return nil, fmt.Errorf("key %q not found", tok)
+		}
+		v, err := jsonPointerAdd(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		c[tok] = v
+		return c, nil
+	case []interface{}:
+		if last {
+			i := len(c)
+			if tok != "-" {
+				var err error
+				if i, err = arrayIndex(tok, len(c)); err != nil {
+					return nil, err
+				}
+			}
+			out := make([]interface{}, 0, len(c)+1)
+			out = append(out, c[:i]...)
+			out = append(out, value)
+			return append(out, c[i:]...), nil
+		}
+		i, err := arrayIndex(tok, len(c)-1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := jsonPointerAdd(c[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = v
+		return c, nil
+	default:
+		return nil, fmt.Errorf("cannot reference %q in a scalar", tok)
+	}
+}
+
+// jsonPointerRemove removes the value at path and returns the updated document and the removed value.
+func jsonPointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole document")
+	}
+	tok, last := path[0], len(path) == 1
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[tok]
+		if !ok {
+			return nil, nil, fmt.Errorf("key %q not found", tok)
+		}
+		if last {
+			delete(c, tok)
+			return c, child, nil
+		}
+		v, removed, err := jsonPointerRemove(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		c[tok] = v
+		return c, removed, nil
+	case []interface{}:
+		i, err := arrayIndex(tok, len(c)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if last {
+			out := make([]interface{}, 0, len(c)-1)
+			out = append(out, c[:i]...)
+			return append(out, c[i+1:]...), c[i], nil
+		}
+		v, removed, err := jsonPointerRemove(c[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		c[i] = v
+		return c, removed, nil
+	default:
+		return nil, nil, fmt.Errorf("cannot reference %q in a scalar", tok)
+	}
+}
+
+// copyJSONValue returns a deep copy of maps and lists in v.
+func copyJSONValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k, val := range x {
+			out[k] = copyJSONValue(val)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, val := range x {
+			out[i] = copyJSONValue(val)
+		}
+		return out
+	default:
+		return v
+	}
+}
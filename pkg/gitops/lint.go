@@ -2,7 +2,9 @@ package gitops
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 )
 
 func isObject(v interface{}) bool {
@@ -16,29 +18,87 @@ func isObject(v interface{}) bool {
 	return false
 }
 
-// Lint validates resources and returns an error on first failure.
+// SeverityOff in LintOptions.Severity disables a rule.
+const SeverityOff Severity = "off"
+
+// LintOptions are optional settings for LintDiagnostics.
+type LintOptions struct {
+	// OpenAPI, if set, enables validation of data against the Vault OpenAPI spec (see LintOpenAPI).
+	OpenAPI *OpenAPISpec
+	// Severity overrides the severity of rules by rule ID; SeverityOff drops the rule's findings.
+	Severity map[string]Severity
+}
+
+// Lint validates resources with default options and returns an error listing every error found
+// (see LintDiagnostics). Warnings do not fail.
 func Lint(resources []Resource) error {
+	return LintDiagnostics(resources, LintOptions{}).Err()
+}
+
+// LintDiagnostics validates resources and returns all findings, sorted by source position.
+func LintDiagnostics(resources []Resource, opts LintOptions) Diagnostics {
+	var ds Diagnostics
+	report := func(r *Resource, rule, format string, args ...interface{}) {
+		ds = append(ds, newDiagnostic(r, SeverityError, rule, format, args...))
+	}
+
 	byEffectiveName := make(map[string]int)
 	for i := range resources {
 		r := &resources[i]
 		if r.Path == "" {
-			return fmt.Errorf("resource at index %d: missing 'path'", i+1)
+			report(r, RuleMissingPath, "missing 'path'")
 		}
-		if r.Data == nil {
-			return fmt.Errorf("resource at index %d (path %q): missing 'data'", i+1, r.Path)
+		if r.Lifecycle != "" && !r.Abandoned() {
+			report(r, RuleInvalidLifecycle, "lifecycle must be %q (got %q)", LifecycleAbandon, r.Lifecycle)
 		}
-		if !isObject(r.Data) {
-			return fmt.Errorf("resource at index %d (path %q): 'data' must be an object", i+1, r.Path)
+		for _, field := range r.KeepResponse {
+			if strings.TrimSpace(field) == "" {
+				report(r, RuleInvalidKeepResponse, "keep_response: field names must be non-empty")
+				break
+			}
+		}
+		if r.Retry != nil {
+			if err := r.Retry.Validate(); err != nil {
+				report(r, RuleInvalidRetry, "retry: %v", err)
+			}
+		}
+		method := normalizeMethod(r.Method)
+		if r.IsDataSource() {
+			lintDataSource(r, report)
+		} else if r.TTL != "" {
+			report(r, RuleInvalidDataSource, "'ttl' is only allowed with kind %q", KindData)
+		}
+		if r.Data == nil {
+			if !r.Abandoned() && method != "DELETE" && !r.IsDataSource() {
+				report(r, RuleMissingData, "missing 'data'")
+			}
+		} else if !isObject(r.Data) {
+			report(r, RuleDataNotObject, "'data' must be an object")
 		}
 		if r.Revision < 0 {
-			return fmt.Errorf("resource at index %d (path %q): revision must be non-negative (unsigned)", i+1, r.Path)
+			report(r, RuleNegativeRevision, "revision must be non-negative (unsigned)")
 		}
-		if m := strings.ToUpper(strings.TrimSpace(r.Method)); m != "" && m != "GET" && m != "POST" {
-			return fmt.Errorf("resource at index %d (path %q): method must be GET or POST (got %q)", i+1, r.Path, r.Method)
+		if m := strings.ToUpper(strings.TrimSpace(r.Method)); m != "" && m != method {
+			report(r, RuleInvalidMethod, "method must be GET, POST, PUT, PATCH or DELETE (got %q)", r.Method)
+		}
+		if d := r.Delete; d != nil && !r.Abandoned() && !r.IsDataSource() {
+			if method == "DELETE" {
+				report(r, RuleInvalidDelete, "'delete' is not allowed with method DELETE: the resource deletes nothing when removed")
+			} else if !d.None {
+				if m := strings.ToUpper(strings.TrimSpace(d.Method)); m != "" && (m != normalizeMethod(m) || m == "GET") {
+					report(r, RuleInvalidDelete, "delete: method must be DELETE, POST, PUT or PATCH (got %q)", d.Method)
+				}
+				if d.Data != nil && !isObject(d.Data) {
+					report(r, RuleInvalidDelete, "delete: 'data' must be an object")
+				}
+			}
+		} else if method == "PATCH" && !r.Abandoned() && !r.IsDataSource() {
+			ds = append(ds, newDiagnostic(r, SeverityWarning, RulePatchWithoutDelete, "removing a PATCH resource sends DELETE to %s; set 'delete' (e.g. 'delete: none')", r.Path))
 		}
 		eff := r.EffectiveName()
 		if prev, exists := byEffectiveName[eff]; exists {
-			return fmt.Errorf("duplicate name %q: resources at documents %d and %d", eff, prev+1, i+1)
+			report(r, RuleDuplicateName, "duplicate name %q (first defined at %s)", eff, locationOrIndex(resources, prev))
+			continue
 		}
 		byEffectiveName[eff] = i
 	}
@@ -47,12 +107,130 @@ func Lint(resources []Resource) error {
 		r := &resources[i]
 		for j, depName := range r.Dependencies {
 			if depName == "" {
-				return fmt.Errorf("resource %q (doc %d): dependency %d: name must be non-empty", r.Path, i+1, j+1)
+				report(r, RuleEmptyDependency, "dependency %d: name must be non-empty", j+1)
+				continue
+			}
+			if idx, exists := byEffectiveName[depName]; !exists {
+				report(r, RuleUnknownDependency, "dependency %q not found", depName)
+			} else if resources[idx].Abandoned() && !r.Abandoned() {
+				report(r, RuleUnknownDependency, "dependency %q is abandoned", depName)
+			}
+		}
+		for _, ref := range responseRefs(r) {
+			idx, exists := byEffectiveName[ref[0]]
+			if exists && !keepsResponseField(resources[idx].KeepResponse, ref[1]) {
+				report(r, RuleInvalidKeepResponse, "template <%s:%s>: %q is not in keep_response of %q", ref[0], ref[1], ref[1], ref[0])
+			}
+		}
+		if r.Delete != nil && !r.Abandoned() {
+			for _, name := range r.Delete.templateRefs() {
+				if _, exists := byEffectiveName[name]; !exists {
+					report(r, RuleInvalidDelete, "delete: template refers to unknown resource %q", name)
+				}
+			}
+		}
+	}
+
+	// Templates are evaluated statically: vars and files are known, refs to state become placeholders.
+	// Policies are checked after rendering.
+	for i := range resources {
+		r := &resources[i]
+		data := r.Data
+		if r.Abandoned() {
+			continue
+		}
+		if r.Templating != "" {
+			if r.Templating != TemplatingGo {
+				report(r, RuleInvalidTemplating, "templating must be %q (got %q)", TemplatingGo, r.Templating)
+				continue
 			}
-			if _, exists := byEffectiveName[depName]; !exists {
-				return fmt.Errorf("resource %q (doc %d): dependency %q not found", r.Path, i+1, depName)
+			if r.Data == nil || !isObject(r.Data) {
+				continue
+			}
+			var err error
+			if data, err = renderData(r, staticRef(byEffectiveName)); err != nil {
+				report(r, RuleTemplateError, "template: %v", err)
+				continue
 			}
 		}
+		ds = append(ds, lintPolicies(r, data)...)
+	}
+
+	if opts.OpenAPI != nil {
+		ds = append(ds, LintOpenAPI(resources, opts.OpenAPI)...)
+	}
+	ds = ds.withSeverity(opts.Severity)
+	ds.Sort()
+	return ds
+}
+
+// responseRefs returns the <name:key> templates in the data and 'delete' of r as {name, key}.
+func responseRefs(r *Resource) [][2]string {
+	var refs [][2]string
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			for _, m := range inlineTemplateRe.FindAllStringSubmatch(v, -1) {
+				refs = append(refs, [2]string{m[1], m[2]})
+			}
+		case map[string]interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	walk(r.Data)
+	if r.Delete != nil {
+		walk(r.Delete.Path)
+		walk(r.Delete.Data)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i][0]+":"+refs[i][1] < refs[j][0]+":"+refs[j][1] })
+	return refs
+}
+
+// keepsResponseField reports whether keep_response keeps the response field at path (or part of it).
+func keepsResponseField(keep []string, path string) bool {
+	if keep == nil {
+		return true
+	}
+	for _, k := range keep {
+		if k == path || strings.HasPrefix(path, k+".") || strings.HasPrefix(k, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// lintDataSource reports fields that make no sense for a data source: it only reads.
+func lintDataSource(r *Resource, report func(r *Resource, rule, format string, args ...interface{})) {
+	if m := strings.TrimSpace(r.Method); m != "" && !strings.EqualFold(m, "GET") {
+		report(r, RuleInvalidDataSource, "a data source is read with GET (got method %q)", r.Method)
+	}
+	if r.Delete != nil {
+		report(r, RuleInvalidDataSource, "a data source is never deleted, remove 'delete'")
+	}
+	if r.PreventDestroy {
+		report(r, RuleInvalidDataSource, "a data source is never deleted, remove 'prevent_destroy'")
+	}
+	if r.Lifecycle != "" {
+		report(r, RuleInvalidDataSource, "a data source is not managed, remove 'lifecycle'")
+	}
+	if r.TTL != "" {
+		if d, err := time.ParseDuration(r.TTL); err != nil || d <= 0 {
+			report(r, RuleInvalidDataSource, "ttl must be a positive duration (e.g. 1h), got %q", r.TTL)
+		}
+	}
+}
+
+// locationOrIndex describes where resources[i] is defined, for messages about another resource.
+func locationOrIndex(resources []Resource, i int) string {
+	if loc := resources[i].Location(); loc != "" {
+		return loc
 	}
-	return nil
+	return fmt.Sprintf("resource %d", i+1)
 }
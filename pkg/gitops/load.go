@@ -13,56 +13,196 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-// collectYAMLPaths returns paths of all .yaml and .yml files under dir (recursive), sorted.
-func collectYAMLPaths(dir string) ([]string, error) {
-	var paths []string
-	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+// collectResourcePaths returns paths of all resource files (.yaml, .yml, .json, .gitops.hcl) under dir (recursive), sorted.
+// The directory skipDir (if not empty) is not descended into. Files matching an ignore pattern
+// (relative to root, see ignoredPath) are returned separately.
+func collectResourcePaths(root, dir, skipDir string, ignore []string) (paths, ignored []string, err error) {
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 		if d.IsDir() {
+			if skipDir != "" && path == skipDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isResourceFile(path) {
 			return nil
 		}
-		ext := strings.ToLower(filepath.Ext(path))
-		if ext == ".yaml" || ext == ".yml" {
-			paths = append(paths, path)
+		if rel, err := filepath.Rel(root, path); err == nil && ignoredPath(filepath.ToSlash(rel), ignore) {
+			ignored = append(ignored, path)
+			return nil
 		}
+		paths = append(paths, path)
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	sort.Strings(paths)
-	return paths, nil
+	return paths, ignored, nil
+}
+
+// ignoredPath reports whether the resource file rel (slash-separated, relative to the root path)
+// matches one of the ignore patterns. A pattern with a slash matches the whole relative path (a
+// leading slash is optional); a pattern without one matches the file name in any directory.
+func ignoredPath(rel string, ignore []string) bool {
+	for _, pattern := range ignore {
+		name := path.Base(rel)
+		if strings.Contains(pattern, "/") {
+			pattern, name = strings.TrimPrefix(pattern, "/"), rel
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateIgnore checks the syntax of ignore patterns (see LoadOptions.Ignore).
+func ValidateIgnore(ignore []string) error {
+	for _, pattern := range ignore {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid ignore pattern %q", pattern)
+		}
+	}
+	return nil
 }
 
-// parseYAMLDocuments decodes multi-document YAML from data into resources (skips empty docs, normalizes).
-func parseYAMLDocuments(data []byte) ([]Resource, error) {
+// IgnoredFiles returns the resource files under the directory dir that are not loaded because
+// they match opts.Ignore, sorted; nil if dir is a file.
+func IgnoredFiles(dir string, opts LoadOptions) ([]string, error) {
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return nil, err
+	}
+	_, ignored, err := collectResourcePaths(dir, dir, "", opts.Ignore)
+	return ignored, err
+}
+
+// Document kinds. A document without 'kind' is a resource.
+const (
+	KindResource  = "resource"
+	KindData      = "data" // a data source, decoded as a Resource
+	KindGenerator = "generator"
+	KindPatch     = "patch"
+)
+
+// parseDocuments decodes the documents of a resource file (YAML, JSON or HCL, by extension of fpath)
+// into resources (skips empty docs, normalizes).
+// Generator documents are expanded in place; env is attached to every resource.
+// Patch documents are returned separately; only overlays may contain them.
+func (l *loader) parseDocuments(fpath string, data []byte, env *renderEnv) ([]Resource, []overlayDoc, error) {
+	nodes, err := decodeDocuments(fpath, data)
+	if err != nil {
+		return nil, nil, err
+	}
 	var resources []Resource
-	dec := yaml.NewDecoder(strings.NewReader(string(data)))
-	dec.KnownFields(false)
-	for {
-		var doc Resource
-		if err := dec.Decode(&doc); err != nil {
-			if err == io.EOF {
-				break
+	var patches []overlayDoc
+	for i, node := range nodes {
+		docNum := i + 1
+		line, column := nodePosition(node)
+		at := func(err error) error {
+			return fmt.Errorf("document %d (line %d): %w", docNum, line, err)
+		}
+		var head struct {
+			Kind string `yaml:"kind"`
+		}
+		if err := node.Decode(&head); err != nil {
+			return nil, nil, at(err)
+		}
+		if err := resolveDataIncludes(node, head.Kind, env); err != nil {
+			return nil, nil, at(err)
+		}
+		switch head.Kind {
+		case "", KindResource, KindData:
+		case KindGenerator:
+			var gen generatorDoc
+			if err := node.Decode(&gen); err != nil {
+				return nil, nil, at(err)
+			}
+			generated, err := gen.expand(l.vars, env)
+			if err != nil {
+				return nil, nil, at(fmt.Errorf("generator %q: %w", gen.Name, err))
+			}
+			for j := range generated {
+				generated[j].setPosition(fpath, line, column)
+			}
+			resources = append(resources, generated...)
+			continue
+		case KindPatch:
+			var p patchDoc
+			if err := node.Decode(&p); err != nil {
+				return nil, nil, at(err)
+			}
+			if err := p.validate(); err != nil {
+				return nil, nil, at(err)
 			}
-			return nil, err
+			patches = append(patches, overlayDoc{patchDoc: p, docNum: docNum, line: line})
+			continue
+		default:
+			return nil, nil, at(fmt.Errorf("unknown kind %q", head.Kind))
+		}
+		var doc Resource
+		if err := node.Decode(&doc); err != nil {
+			return nil, nil, at(err)
 		}
 		if doc.Path == "" && doc.Data == nil && len(doc.Dependencies) == 0 && doc.Namespace == "" {
 			continue
 		}
 		if doc.Data != nil && !isObject(doc.Data) {
-			return nil, fmt.Errorf("document %d: 'data' must be an object (map)", len(resources)+1)
+			return nil, nil, at(fmt.Errorf("'data' must be an object (map)"))
 		}
 		NormalizeResource(&doc)
+		doc.env = env
+		doc.setPosition(fpath, line, column)
 		resources = append(resources, doc)
 	}
-	return resources, nil
+	return resources, patches, nil
+}
+
+// nodePosition returns the line and column where a document starts.
+func nodePosition(node *yaml.Node) (int, int) {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	return node.Line, node.Column
+}
+
+// LoadOptions are optional settings for LoadResourcesFromPath and LoadResourcesFromFS.
+type LoadOptions struct {
+	// VarsFile is a YAML file with template variables (available as .vars in templates).
+	// For LoadResourcesFromFS the path is relative to the filesystem root.
+	VarsFile string
+	// Overlay selects the overlay directory overlays/<name>/ under the root path, applied on top
+	// of the base resources (everything under the root except overlays/). Empty = no overlay:
+	// overlays/ is then an ordinary directory of the base.
+	Overlay string
+	// Ignore lists glob patterns of files under the root path that are not resource files, e.g.
+	// 'openapi.json' or 'generated/*.json'. A pattern with a slash matches the path relative to
+	// the root, one without a slash matches the file name in any directory. A file path given
+	// explicitly is always loaded.
+	Ignore []string
+}
+
+// loader holds state shared by all files of one load: template variables and repository file access.
+type loader struct {
+	files *repoFiles
+	vars  map[string]interface{}
+}
+
+// parseVars decodes a vars file: a YAML mapping of variable names to values.
+func parseVars(data []byte) (map[string]interface{}, error) {
+	vars := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &vars); err != nil {
+		return nil, err
+	}
+	return vars, nil
 }
 
 // parseResourceFiles sorts file paths and parses YAML documents from each into resources.
-func parseResourceFiles(fileContents map[string][]byte) ([]Resource, error) {
+func (l *loader) parseResourceFiles(fileContents map[string][]byte) ([]Resource, error) {
 	paths := make([]string, 0, len(fileContents))
 	for p := range fileContents {
 		paths = append(paths, p)
@@ -71,36 +211,95 @@ func parseResourceFiles(fileContents map[string][]byte) ([]Resource, error) {
 
 	var resources []Resource
 	for _, fpath := range paths {
-		docs, err := parseYAMLDocuments(fileContents[fpath])
+		env := &renderEnv{vars: l.vars, files: l.files, dir: filepath.Dir(fpath)}
+		docs, patches, err := l.parseDocuments(fpath, fileContents[fpath], env)
 		if err != nil {
 			return nil, fmt.Errorf("%s: %w", fpath, err)
 		}
+		if len(patches) > 0 {
+			return nil, fmt.Errorf("%s: document %d (line %d): patch documents are only allowed in %s/<name>/ of the selected overlay", fpath, patches[0].docNum, patches[0].line, OverlaysDir)
+		}
 		resources = append(resources, docs...)
 	}
 	return resources, nil
 }
 
 // LoadResourcesFromPath loads resources from a file or directory.
-// If path is a directory, all .yaml and .yml files under it (recursive) are collected and parsed.
+// If path is a directory, all resource files under it (recursive; see isResourceFile) are collected and parsed.
+// opts.Overlay selects an overlay applied on top; only then the overlays/ directory is not part of the base.
 // If path is a file, that file is read. Returns parsed and normalized resources.
-func LoadResourcesFromPath(path string) ([]Resource, error) {
+// Files referenced from templates are confined to the directory (or the file's directory).
+func LoadResourcesFromPath(path string, opts LoadOptions) ([]Resource, error) {
 	info, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
-	var files []string
+	if err := ValidateIgnore(opts.Ignore); err != nil {
+		return nil, err
+	}
+	l := &loader{files: &repoFiles{root: path, readFunc: os.ReadFile}}
+	if opts.VarsFile != "" {
+		data, err := os.ReadFile(opts.VarsFile)
+		if err != nil {
+			return nil, fmt.Errorf("read vars %s: %w", opts.VarsFile, err)
+		}
+		if l.vars, err = parseVars(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", opts.VarsFile, err)
+		}
+	}
+	var files, overlayFiles []string
 	if info.IsDir() {
-		files, err = collectYAMLPaths(path)
+		skipDir := ""
+		if opts.Overlay != "" {
+			skipDir = filepath.Join(path, OverlaysDir)
+		}
+		files, _, err = collectResourcePaths(path, path, skipDir, opts.Ignore)
 		if err != nil {
-			return nil, fmt.Errorf("collect yaml in %s: %w", path, err)
+			return nil, fmt.Errorf("collect resource files in %s: %w", path, err)
 		}
+		files = excludePath(files, opts.VarsFile)
 		if len(files) == 0 {
-			return nil, fmt.Errorf("no .yaml or .yml files in %s", path)
+			return nil, fmt.Errorf("no resource files (.yaml, .yml, %s, %s) in %s", JSONExt, HCLExt, path)
+		}
+		if opts.Overlay != "" {
+			if !validOverlayName(opts.Overlay) {
+				return nil, fmt.Errorf("invalid overlay name %q", opts.Overlay)
+			}
+			dir := overlayPath(path, opts.Overlay)
+			if _, err := os.Stat(dir); err != nil {
+				return nil, fmt.Errorf("overlay %q: %w", opts.Overlay, err)
+			}
+			overlayFiles, _, err = collectResourcePaths(path, dir, "", opts.Ignore)
+			if err != nil {
+				return nil, fmt.Errorf("collect resource files in %s: %w", dir, err)
+			}
+			overlayFiles = excludePath(overlayFiles, opts.VarsFile)
 		}
 	} else {
+		if opts.Overlay != "" {
+			return nil, fmt.Errorf("overlay %q: path must be a directory", opts.Overlay)
+		}
+		l.files.root = filepath.Dir(path)
 		files = []string{path}
 	}
 
+	fileContents, err := readFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := l.parseResourceFiles(fileContents)
+	if err != nil || opts.Overlay == "" {
+		return resources, err
+	}
+	overlayContents, err := readFiles(overlayFiles)
+	if err != nil {
+		return nil, err
+	}
+	return l.applyOverlay(resources, overlayContents)
+}
+
+// readFiles reads the given files from disk into a map keyed by path.
+func readFiles(files []string) (map[string][]byte, error) {
 	fileContents := make(map[string][]byte, len(files))
 	for _, f := range files {
 		data, err := os.ReadFile(f)
@@ -109,19 +308,69 @@ func LoadResourcesFromPath(path string) ([]Resource, error) {
 		}
 		fileContents[f] = data
 	}
-	return parseResourceFiles(fileContents)
+	return fileContents, nil
 }
 
-// LoadResourcesFromFS extracts .yaml/.yml files from the given filesystem under rootPath and parses them into resources.
-func LoadResourcesFromFS(worktreeFS billy.Filesystem, rootPath string) ([]Resource, error) {
+// excludePath removes the file p (compared by absolute path) from paths.
+func excludePath(paths []string, p string) []string {
+	if p == "" {
+		return paths
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return paths
+	}
+	out := paths[:0]
+	for _, f := range paths {
+		if fAbs, err := filepath.Abs(f); err == nil && fAbs == abs {
+			continue
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// readFSFile reads a whole file from the billy filesystem.
+func readFSFile(worktreeFS billy.Filesystem, name string) ([]byte, error) {
+	f, err := worktreeFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// LoadResourcesFromFS extracts resource files (YAML, JSON, HCL) from the given filesystem under rootPath and parses them into resources.
+// opts.Overlay selects an overlay applied on top; only then files under rootPath/overlays/ are not base resources.
+func LoadResourcesFromFS(worktreeFS billy.Filesystem, rootPath string, opts LoadOptions) ([]Resource, error) {
+	if err := ValidateIgnore(opts.Ignore); err != nil {
+		return nil, err
+	}
 	fileContents := make(map[string][]byte)
+	overlayContents := make(map[string][]byte)
 	normalizedPath := filepath.Clean(rootPath)
 	if normalizedPath == "." {
 		normalizedPath = ""
 	}
+	l := &loader{files: &repoFiles{root: normalizedPath, readFunc: func(name string) ([]byte, error) {
+		return readFSFile(worktreeFS, name)
+	}}}
+	varsFile := ""
+	if opts.VarsFile != "" {
+		varsFile = filepath.Clean(opts.VarsFile)
+		data, err := readFSFile(worktreeFS, varsFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading vars %q: %w", opts.VarsFile, err)
+		}
+		if l.vars, err = parseVars(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", opts.VarsFile, err)
+		}
+	}
 
-	var walk func(dir string) error
-	walk = func(dir string) error {
+	overlaysRoot := path.Join(normalizedPath, OverlaysDir)
+
+	var walk func(dir string, into map[string][]byte) error
+	walk = func(dir string, into map[string][]byte) error {
 		entries, err := worktreeFS.ReadDir(dir)
 		if err != nil {
 			return fmt.Errorf("reading directory %q: %w", dir, err)
@@ -129,7 +378,10 @@ func LoadResourcesFromFS(worktreeFS billy.Filesystem, rootPath string) ([]Resour
 		for _, entry := range entries {
 			filePath := path.Join(dir, entry.Name())
 			if entry.IsDir() {
-				if err := walk(filePath); err != nil {
+				if opts.Overlay != "" && filePath == overlaysRoot {
+					continue
+				}
+				if err := walk(filePath, into); err != nil {
 					return err
 				}
 				continue
@@ -141,15 +393,22 @@ func LoadResourcesFromFS(worktreeFS billy.Filesystem, rootPath string) ([]Resour
 			if info.Mode()&os.ModeSymlink != 0 {
 				continue
 			}
-			ext := strings.ToLower(path.Ext(entry.Name()))
-			if ext != ".yaml" && ext != ".yml" {
+			if !isResourceFile(entry.Name()) {
 				continue
 			}
 			normalizedFilePath := filepath.Clean(filePath)
+			if normalizedFilePath == varsFile {
+				continue
+			}
+			rel := normalizedFilePath
 			if normalizedPath != "" {
 				if normalizedFilePath != normalizedPath && !strings.HasPrefix(normalizedFilePath, normalizedPath+string(filepath.Separator)) {
 					continue
 				}
+				rel = strings.TrimPrefix(normalizedFilePath, normalizedPath+string(filepath.Separator))
+			}
+			if normalizedFilePath != normalizedPath && ignoredPath(filepath.ToSlash(rel), opts.Ignore) {
+				continue
 			}
 			f, err := worktreeFS.Open(filePath)
 			if err != nil {
@@ -160,13 +419,27 @@ func LoadResourcesFromFS(worktreeFS billy.Filesystem, rootPath string) ([]Resour
 			if err != nil {
 				return fmt.Errorf("reading %q: %w", filePath, err)
 			}
-			fileContents[filePath] = data
+			into[filePath] = data
 		}
 		return nil
 	}
 
-	if err := walk(""); err != nil {
+	if err := walk("", fileContents); err != nil {
+		return nil, err
+	}
+	resources, err := l.parseResourceFiles(fileContents)
+	if err != nil || opts.Overlay == "" {
+		return resources, err
+	}
+	if !validOverlayName(opts.Overlay) {
+		return nil, fmt.Errorf("invalid overlay name %q", opts.Overlay)
+	}
+	overlayDir := path.Join(overlaysRoot, opts.Overlay)
+	if _, err := worktreeFS.Stat(overlayDir); err != nil {
+		return nil, fmt.Errorf("overlay %q: %w", opts.Overlay, err)
+	}
+	if err := walk(overlayDir, overlayContents); err != nil {
 		return nil, err
 	}
-	return parseResourceFiles(fileContents)
+	return l.applyOverlay(resources, overlayContents)
 }
@@ -0,0 +1,72 @@
+package gitops
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+)
+
+// resourceDoc is the YAML form of a Resource with default values omitted.
+type resourceDoc struct {
+	Kind           string       `yaml:"kind,omitempty"`
+	Name           string       `yaml:"name,omitempty"`
+	Path           string       `yaml:"path"`
+	Namespace      string       `yaml:"namespace,omitempty"`
+	Method         string       `yaml:"method,omitempty"`
+	Revision       int          `yaml:"revision,omitempty"`
+	Dependencies   []string     `yaml:"dependencies,omitempty"`
+	IgnoreFailures bool         `yaml:"ignore_failures,omitempty"`
+	Templating     string       `yaml:"templating,omitempty"`
+	PreventDestroy bool         `yaml:"prevent_destroy,omitempty"`
+	Lifecycle      string       `yaml:"lifecycle,omitempty"`
+	Retry          *RetryPolicy `yaml:"retry,omitempty"`
+	Delete         *DeleteSpec  `yaml:"delete,omitempty"`
+	TTL            string       `yaml:"ttl,omitempty"`
+	KeepResponse   []string     `yaml:"keep_response,omitempty"`
+	Data           interface{}  `yaml:"data"`
+}
+
+func newResourceDoc(r Resource) resourceDoc {
+	data := r.Data
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	kind := r.Kind
+	if kind == KindResource {
+		kind = ""
+	}
+	return resourceDoc{
+		Kind:           kind,
+		Name:           r.Name,
+		Path:           r.Path,
+		Namespace:      r.Namespace,
+		Method:         r.Method,
+		Revision:       r.Revision,
+		Dependencies:   r.Dependencies,
+		IgnoreFailures: r.IgnoreFailures,
+		Templating:     r.Templating,
+		PreventDestroy: r.PreventDestroy,
+		Lifecycle:      r.Lifecycle,
+		Retry:          r.Retry,
+		Delete:         r.Delete,
+		TTL:            r.TTL,
+		KeepResponse:   r.KeepResponse,
+		Data:           data,
+	}
+}
+
+// MarshalResourcesYAML encodes resources as multi-document YAML in the declarative format.
+func MarshalResourcesYAML(resources []Resource) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	for _, r := range resources {
+		if err := enc.Encode(newResourceDoc(r)); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
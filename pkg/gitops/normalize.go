@@ -21,4 +21,10 @@ func normalizePath(s string) string {
 func NormalizeResource(r *Resource) {
 	r.Namespace = normalizeNamespace(r.Namespace)
 	r.Path = normalizePath(r.Path)
-}
\ No newline at end of file
+}
+
+// stateLocation returns namespace and path as recorded in a state entry. Every entry is written
+// with it, and migrateStateV1 applies it to entries written by older versions.
+func stateLocation(namespace, path string) (string, string) {
+	return normalizeNamespace(namespace), normalizePath(path)
+}
@@ -0,0 +1,290 @@
+package gitops
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OpenAPISpec is the subset of a Vault OpenAPI document used to validate resource data:
+// templated paths, their operations and request body schemas.
+type OpenAPISpec struct {
+	paths   []*openAPIPath
+	schemas map[string]*openAPISchema
+}
+
+type openAPIPath struct {
+	template   string
+	segments   []string
+	operations map[string]*openAPIOperation // lower-case HTTP method
+}
+
+type openAPIOperation struct {
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema *openAPISchema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+type openAPISchema struct {
+	Ref        string                    `json:"$ref"`
+	Type       string                    `json:"type"`
+	Properties map[string]*openAPISchema `json:"properties"`
+	Required   []string                  `json:"required"`
+}
+
+// LoadOpenAPISpec parses a Vault OpenAPI document (JSON), as returned by sys/internal/specs/openapi.
+// The output of 'vault read -format=json sys/internal/specs/openapi' (wrapped in "data") is accepted too.
+func LoadOpenAPISpec(data []byte) (*OpenAPISpec, error) {
+	var doc struct {
+		OpenAPI    string                                      `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage       `json:"paths"`
+		Components struct{ Schemas map[string]*openAPISchema } `json:"components"`
+		Data       json.RawMessage                             `json:"data"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse OpenAPI document: %w", err)
+	}
+	if doc.OpenAPI == "" && len(doc.Data) > 0 {
+		return LoadOpenAPISpec(doc.Data)
+	}
+	if doc.OpenAPI == "" || len(doc.Paths) == 0 {
+		return nil, fmt.Errorf("not an OpenAPI document: missing 'openapi' or 'paths'")
+	}
+	spec := &OpenAPISpec{schemas: doc.Components.Schemas}
+	for template, item := range doc.Paths {
+		p := &openAPIPath{
+			template:   template,
+			segments:   strings.Split(strings.Trim(template, "/"), "/"),
+			operations: map[string]*openAPIOperation{},
+		}
+		for method, raw := range item {
+			switch method {
+			case "get", "post", "put", "patch", "delete":
+			default:
+				continue // parameters, summary, x-vault-* extensions
+			}
+			var op openAPIOperation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return nil, fmt.Errorf("path %s: %s: %w", template, method, err)
+			}
+			p.operations[method] = &op
+		}
+		spec.paths = append(spec.paths, p)
+	}
+	sort.Slice(spec.paths, func(i, j int) bool { return spec.paths[i].template < spec.paths[j].template })
+	return spec, nil
+}
+
+// match returns the spec path for a request path. Each {param} matches one segment; when no
+// path matches segment by segment, a trailing {param} may match the rest of the path
+// (e.g. kv paths). Among matches the one with the most literal segments wins.
+func (s *OpenAPISpec) match(path string) *openAPIPath {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, greedy := range []bool{false, true} {
+		var best *openAPIPath
+		bestLiterals := -1
+		for _, p := range s.paths {
+			if literals, ok := p.matchSegments(segments, greedy); ok && literals > bestLiterals {
+				best, bestLiterals = p, literals
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+	return nil
+}
+
+func isPathParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+func (p *openAPIPath) matchSegments(segments []string, greedy bool) (int, bool) {
+	n := len(p.segments)
+	if len(segments) != n && !(greedy && len(segments) > n && isPathParam(p.segments[n-1])) {
+		return 0, false
+	}
+	literals := 0
+	for i, tmpl := range p.segments {
+		if isPathParam(tmpl) {
+			if segments[i] == "" {
+				return 0, false
+			}
+			continue
+		}
+		if tmpl != segments[i] {
+			return 0, false
+		}
+		literals++
+	}
+	return literals, true
+}
+
+// requestSchema returns the resolved JSON request body schema of op, or nil if it has none.
+func (s *OpenAPISpec) requestSchema(op *openAPIOperation) *openAPISchema {
+	if op.RequestBody == nil {
+		return nil
+	}
+	content, ok := op.RequestBody.Content["application/json"]
+	if !ok {
+		return nil
+	}
+	return s.resolve(content.Schema)
+}
+
+func (s *OpenAPISpec) resolve(schema *openAPISchema) *openAPISchema {
+	for i := 0; schema != nil && schema.Ref != "" && i < 10; i++ {
+		schema = s.schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+// LintOpenAPI checks resources against the spec: the path must be known (warning otherwise),
+// the method must exist for it, and data must match the request body schema (known field names,
+// compatible types, required properties). Values with templates are not type-checked.
+func LintOpenAPI(resources []Resource, spec *OpenAPISpec) Diagnostics {
+	var ds Diagnostics
+	for i := range resources {
+		r := &resources[i]
+		if r.Path == "" || r.Abandoned() {
+			continue
+		}
+		p := spec.match(r.Path)
+		if p == nil {
+			ds = append(ds, newDiagnostic(r, SeverityWarning, RuleOpenAPIUnknownPath, "path %q not found in the OpenAPI spec", r.Path))
+			continue
+		}
+		method := strings.ToLower(normalizeMethod(r.Method))
+		if r.IsDataSource() {
+			method = "get"
+		}
+		if method == "put" {
+			method = "post" // Vault handles PUT as POST; the spec only lists post
+		}
+		op, ok := p.operations[method]
+		if !ok {
+			ds = append(ds, newDiagnostic(r, SeverityWarning, RuleOpenAPIMethod, "%s is not defined for %s in the OpenAPI spec", strings.ToUpper(method), p.template))
+			continue
+		}
+		data, ok := r.Data.(map[string]interface{})
+		if method == "get" || method == "delete" || !ok {
+			continue
+		}
+		schema := spec.requestSchema(op)
+		if schema != nil && method == "patch" {
+			partial := *schema
+			partial.Required = nil // a patch sends only the fields it changes
+			schema = &partial
+		}
+		if schema == nil {
+			if len(data) > 0 {
+				ds = append(ds, newDiagnostic(r, SeverityWarning, RuleOpenAPIUnknownField, "%s %s takes no request body, 'data' is ignored", strings.ToUpper(method), p.template))
+			}
+			continue
+		}
+		for _, msg := range spec.validateObject("", data, schema) {
+			ds = append(ds, newDiagnostic(r, SeverityError, msg.rule, "%s (%s)", msg.text, p.template))
+		}
+	}
+	ds.Sort()
+	return ds
+}
+
+type schemaViolation struct {
+	rule string
+	text string
+}
+
+// validateObject validates the fields of an object against schema; prefix is the field path so far.
+func (s *OpenAPISpec) validateObject(prefix string, data map[string]interface{}, schema *openAPISchema) []schemaViolation {
+	var out []schemaViolation
+	for _, name := range schema.Required {
+		if _, ok := data[name]; !ok {
+			out = append(out, schemaViolation{RuleOpenAPIRequired, fmt.Sprintf("required field %q is missing", prefix+name)})
+		}
+	}
+	if len(schema.Properties) == 0 {
+		return out // free-form object
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		prop, ok := schema.Properties[k]
+		if !ok {
+			out = append(out, schemaViolation{RuleOpenAPIUnknownField, fmt.Sprintf("unknown field %q", prefix+k)})
+			continue
+		}
+		prop = s.resolve(prop)
+		if prop == nil {
+			continue
+		}
+		if msg := checkType(data[k], prop); msg != "" {
+			out = append(out, schemaViolation{RuleOpenAPIType, fmt.Sprintf("field %q: %s", prefix+k, msg)})
+			continue
+		}
+		if nested, ok := data[k].(map[string]interface{}); ok && prop.Type == "object" {
+			out = append(out, s.validateObject(prefix+k+".", nested, prop)...)
+		}
+	}
+	return out
+}
+
+// legacyTemplateRe matches <name:key> placeholders (see ResolveTemplates).
+var legacyTemplateRe = regexp.MustCompile(`<[^<>:]+:[^<>]+>`)
+
+// checkType reports whether v is acceptable for a field of the schema type. Vault parses request
+// fields leniently (numbers and booleans from strings, comma-separated strings for lists),
+// so only values Vault would reject are reported.
+func checkType(v interface{}, schema *openAPISchema) string {
+	if s, ok := v.(string); ok && (strings.Contains(s, "{{") || legacyTemplateRe.MatchString(s)) {
+		return ""
+	}
+	switch schema.Type {
+	case "string":
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return "expected a string"
+		}
+	case "integer", "number":
+		switch x := v.(type) {
+		case int, int64, uint64, float64:
+		case string:
+			if _, err := strconv.ParseFloat(x, 64); err != nil {
+				return fmt.Sprintf("expected a number (got %q)", x)
+			}
+		default:
+			return fmt.Sprintf("expected a number (got %T)", v)
+		}
+	case "boolean":
+		switch x := v.(type) {
+		case bool:
+		case string:
+			if _, err := strconv.ParseBool(x); err != nil {
+				return fmt.Sprintf("expected a boolean (got %q)", x)
+			}
+		default:
+			return fmt.Sprintf("expected a boolean (got %T)", v)
+		}
+	case "array":
+		switch v.(type) {
+		case []interface{}, string:
+		default:
+			return fmt.Sprintf("expected a list (got %T)", v)
+		}
+	case "object":
+		switch v.(type) {
+		case map[string]interface{}, string:
+		default:
+			return fmt.Sprintf("expected an object (got %T)", v)
+		}
+	}
+	return ""
+}
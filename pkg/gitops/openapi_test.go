@@ -0,0 +1,120 @@
+package gitops
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testOpenAPI = `{
+  "openapi": "3.0.2",
+  "paths": {
+    "/sys/mounts/{path}": {
+      "parameters": [{"name": "path", "in": "path"}],
+      "post": {"requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/MountsEnableSecretsEngineRequest"}}}}}
+    },
+    "/sys/mounts/{path}/tune": {
+      "post": {"requestBody": {"content": {"application/json": {"schema": {"type": "object", "properties": {"default_lease_ttl": {"type": "string"}}}}}}}
+    },
+    "/secret/data/{path}": {
+      "post": {"requestBody": {"content": {"application/json": {"schema": {"type": "object", "properties": {"data": {"type": "object"}}}}}}}
+    },
+    "/sys/health": {"get": {}}
+  },
+  "components": {
+    "schemas": {
+      "MountsEnableSecretsEngineRequest": {
+        "type": "object",
+        "required": ["type"],
+        "properties": {
+          "type": {"type": "string"},
+          "local": {"type": "boolean"},
+          "options": {"type": "object"},
+          "allowed_managed_keys": {"type": "array"},
+          "config": {"type": "object", "properties": {"default_lease_ttl": {"type": "string"}, "max_versions": {"type": "integer"}}}
+        }
+      }
+    }
+  }
+}`
+
+func Test_LintOpenAPI(t *testing.T) {
+	spec, err := LoadOpenAPISpec([]byte(`{"data": ` + testOpenAPI + `}`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		description string
+		resource    Resource
+		rules       []string
+	}{
+		{
+			description: "valid",
+			resource: Resource{Path: "sys/mounts/kv", Data: map[string]interface{}{
+				"type": "kv", "local": "true", "options": map[string]interface{}{"version": "2"},
+				"allowed_managed_keys": "a,b", "config": map[string]interface{}{"max_versions": 5},
+			}},
+		},
+		{
+			description: "typo in field",
+			resource:    Resource{Path: "sys/mounts/kv", Data: map[string]interface{}{"type": "kv", "defualt_ttl": "1h"}},
+			rules:       []string{RuleOpenAPIUnknownField},
+		},
+		{
+			description: "nested typo and wrong types",
+			resource: Resource{Path: "sys/mounts/kv", Data: map[string]interface{}{
+				"type": "kv", "local": "yes", "options": 1,
+				"config": map[string]interface{}{"max_version": 5},
+			}},
+			rules: []string{RuleOpenAPIUnknownField, RuleOpenAPIType, RuleOpenAPIType},
+		},
+		{
+			description: "missing required",
+			resource:    Resource{Path: "sys/mounts/kv", Data: map[string]interface{}{"local": true}},
+			rules:       []string{RuleOpenAPIRequired},
+		},
+		{
+			description: "templates are not type-checked",
+			resource: Resource{Path: "sys/mounts/kv", Data: map[string]interface{}{
+				"type": "kv", "local": "{{ .vars.local }}", "config": map[string]interface{}{"max_versions": "<kv:data.max>"},
+			}},
+		},
+		{
+			description: "literal segments win",
+			resource:    Resource{Path: "sys/mounts/kv/tune", Data: map[string]interface{}{"default_lease_ttl": "1h"}},
+		},
+		{
+			description: "trailing parameter matches the rest of the path",
+			resource:    Resource{Path: "secret/data/team/app", Data: map[string]interface{}{"data": map[string]interface{}{"any": "thing"}}},
+		},
+		{
+			description: "unknown path",
+			resource:    Resource{Path: "auth/nope/role/x", Data: map[string]interface{}{}},
+			rules:       []string{RuleOpenAPIUnknownPath},
+		},
+		{
+			description: "unsupported method",
+			resource:    Resource{Path: "sys/health", Data: map[string]interface{}{}},
+			rules:       []string{RuleOpenAPIMethod},
+		},
+		{
+			description: "get",
+			resource:    Resource{Path: "sys/health", Method: "GET", Data: map[string]interface{}{}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var rules []string
+			for _, d := range LintOpenAPI([]Resource{test.resource}, spec) {
+				rules = append(rules, d.Rule)
+			}
+			require.Equal(t, test.rules, rules)
+		})
+	}
+}
+
+func Test_LoadOpenAPISpec_Invalid(t *testing.T) {
+	_, err := LoadOpenAPISpec([]byte(`{"paths": {}}`))
+	require.Error(t, err)
+	_, err = LoadOpenAPISpec([]byte(`not json`))
+	require.Error(t, err)
+}
@@ -0,0 +1,156 @@
+package gitops
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OverlaysDir is the directory under the root path that holds overlays (overlays/<name>/).
+// It is reserved: files under it are never loaded as base resources.
+const OverlaysDir = "overlays"
+
+// patchDoc modifies one base resource (kind: patch). Exactly one of Merge and JSONPatch is set.
+//
+// Both operate on the resource document (path, namespace, name, dependencies, data, ...):
+// Merge is a JSON merge patch (RFC 7386; maps are merged recursively, null removes a key,
+// lists are replaced), JSONPatch is a list of JSON Patch operations (RFC 6902).
+type patchDoc struct {
+	Kind      string                   `yaml:"kind"`
+	Target    string                   `yaml:"target"`
+	Merge     interface{}              `yaml:"merge"`
+	JSONPatch []map[string]interface{} `yaml:"json_patch"`
+}
+
+// overlayDoc is a patch with the location it was loaded from (for errors).
+type overlayDoc struct {
+	patchDoc
+	file   string
+	docNum int
+	line   int
+}
+
+// validate checks the patch document shape.
+func (p *patchDoc) validate() error {
+	if p.Target == "" {
+		return fmt.Errorf("patch: 'target' is required")
+	}
+	if (p.Merge == nil) == (p.JSONPatch == nil) {
+		return fmt.Errorf("patch %q: exactly one of 'merge' and 'json_patch' is required", p.Target)
+	}
+	if p.Merge != nil && !isObject(p.Merge) {
+		return fmt.Errorf("patch %q: 'merge' must be an object (map)", p.Target)
+	}
+	return nil
+}
+
+// overlayPath returns the directory of overlay name under root.
+func overlayPath(root, name string) string {
+	return filepath.Join(root, OverlaysDir, name)
+}
+
+// validOverlayName reports whether name is a single directory name.
+func validOverlayName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name && filepath.Clean(name) == name
+}
+
+// applyOverlay parses overlay files and combines them with base resources: patches are applied
+// to the resources they target (in file and document order), plain resources are appended.
+func (l *loader) applyOverlay(base []Resource, overlayFiles map[string][]byte) ([]Resource, error) {
+	paths := make([]string, 0, len(overlayFiles))
+	for p := range overlayFiles {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	resources := append([]Resource(nil), base...)
+	var added []Resource
+	for _, fpath := range paths {
+		env := &renderEnv{vars: l.vars, files: l.files, dir: filepath.Dir(fpath)}
+		docs, patches, err := l.parseDocuments(fpath, overlayFiles[fpath], env)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fpath, err)
+		}
+		for _, p := range patches {
+			p.file = fpath
+			if err := applyOverlayDoc(resources, p); err != nil {
+				return nil, err
+			}
+		}
+		added = append(added, docs...)
+	}
+	return append(resources, added...), nil
+}
+
+// applyOverlayDoc applies p to the base resource whose key equals p.Target.
+func applyOverlayDoc(resources []Resource, p overlayDoc) error {
+	for i := range resources {
+		if resources[i].Key() != p.Target {
+			continue
+		}
+		patched, err := patchResource(resources[i], &p.patchDoc)
+		if err != nil {
+			return fmt.Errorf("%s: document %d (line %d): patch %q: %w", p.file, p.docNum, p.line, p.Target, err)
+		}
+		resources[i] = patched
+		return nil
+	}
+	return fmt.Errorf("%s: document %d (line %d): patch target %q not found in base resources", p.file, p.docNum, p.line, p.Target)
+}
+
+// patchResource applies p to the YAML form of r and decodes the result back into a resource.
+// Templating inputs of the base resource are kept.
+func patchResource(r Resource, p *patchDoc) (Resource, error) {
+	raw, err := yaml.Marshal(newResourceDoc(r))
+	if err != nil {
+		return Resource{}, err
+	}
+	var doc interface{} = map[string]interface{}{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return Resource{}, err
+	}
+	if p.Merge != nil {
+		doc = mergePatch(doc, p.Merge)
+	} else if doc, err = applyJSONPatch(doc, p.JSONPatch); err != nil {
+		return Resource{}, err
+	}
+	if !isObject(doc) {
+		return Resource{}, fmt.Errorf("patched resource must be an object (map)")
+	}
+	if raw, err = yaml.Marshal(doc); err != nil {
+		return Resource{}, err
+	}
+	var out Resource
+	if err := yaml.Unmarshal(raw, &out); err != nil {
+		return Resource{}, err
+	}
+	if out.Data != nil && !isObject(out.Data) {
+		return Resource{}, fmt.Errorf("'data' must be an object (map)")
+	}
+	NormalizeResource(&out)
+	out.env = r.env
+	out.setPosition(r.File, r.Line, r.Column)
+	return out, nil
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386) to target and returns the result.
+func mergePatch(target, patch interface{}) interface{} {
+	patchMap, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetMap, ok := target.(map[string]interface{})
+	if !ok {
+		targetMap = map[string]interface{}{}
+	}
+	for k, v := range patchMap {
+		if v == nil {
+			delete(targetMap, k)
+			continue
+		}
+		targetMap[k] = mergePatch(targetMap[k], v)
+	}
+	return targetMap
+}
@@ -0,0 +1,190 @@
+package gitops
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var overlayFiles = map[string]string{
+	"vault/mounts.yaml": `
+path: sys/mounts/kv
+data:
+  type: kv
+  description: shared kv
+  config:
+    default_lease_ttl: 1h
+---
+name: team-policy
+path: sys/policies/password/team
+data:
+  policy: base
+  tags: [a, b]
+`,
+	"vault/overlays/prod/patches.yaml": `
+kind: patch
+target: sys/mounts/kv
+merge:
+  data:
+    description: null
+    config:
+      max_lease_ttl: 24h
+---
+kind: patch
+target: team-policy
+json_patch:
+  - {op: replace, path: /data/policy, value: prod}
+  - {op: add, path: /data/tags/-, value: c}
+  - {op: remove, path: /data/tags/0}
+---
+path: sys/mounts/prod-only
+data: {type: kv}
+`,
+	"vault/overlays/dev/patches.yaml": `
+kind: patch
+target: team-policy
+merge: {data: {policy: dev}}
+`,
+}
+
+func Test_Overlay(t *testing.T) {
+	fs := writeFSFiles(t, overlayFiles)
+
+	// Without an overlay, overlays/ is an ordinary directory: its patches are errors.
+	_, err := LoadResourcesFromFS(fs, "vault", LoadOptions{})
+	require.ErrorContains(t, err, "patch documents are only allowed in overlays/<name>/ of the selected overlay")
+
+	prod, err := LoadResourcesFromFS(fs, "vault", LoadOptions{Overlay: "prod"})
+	require.NoError(t, err)
+	require.NoError(t, Lint(prod))
+	require.Len(t, prod, 3)
+	require.Equal(t, map[string]interface{}{
+		"type":   "kv",
+		"config": map[string]interface{}{"default_lease_ttl": "1h", "max_lease_ttl": "24h"},
+	}, prod[0].Data)
+	require.Equal(t, map[string]interface{}{"policy": "prod", "tags": []interface{}{"b", "c"}}, prod[1].Data)
+	require.Equal(t, "team-policy", prod[1].Key())
+	require.Equal(t, "sys/mounts/prod-only", prod[2].Path)
+
+	dev, err := LoadResourcesFromFS(fs, "vault", LoadOptions{Overlay: "dev"})
+	require.NoError(t, err)
+	require.Len(t, dev, 2)
+	require.Equal(t, "dev", dev[1].Data.(map[string]interface{})["policy"])
+}
+
+func Test_Overlay_NotConfigured(t *testing.T) {
+	files := map[string]string{
+		"vault/a.yaml":          "path: sys/mounts/kv\ndata: {type: kv}\n",
+		"vault/overlays/b.yaml": "path: sys/mounts/other\ndata: {type: kv}\n",
+	}
+	resources, err := LoadResourcesFromFS(writeFSFiles(t, files), "vault", LoadOptions{})
+	require.NoError(t, err)
+	require.Len(t, resources, 2)
+	require.Equal(t, "sys/mounts/other", resources[1].Path)
+
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o644))
+	}
+	resources, err = LoadResourcesFromPath(filepath.Join(dir, "vault"), LoadOptions{})
+	require.NoError(t, err)
+	require.Len(t, resources, 2)
+}
+
+func Test_Overlay_FromPath(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range overlayFiles {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o644))
+	}
+	fromPath, err := LoadResourcesFromPath(filepath.Join(dir, "vault"), LoadOptions{Overlay: "prod"})
+	require.NoError(t, err)
+	fromFS, err := LoadResourcesFromFS(writeFSFiles(t, overlayFiles), "vault", LoadOptions{Overlay: "prod"})
+	require.NoError(t, err)
+	require.Len(t, fromPath, len(fromFS))
+	for i := range fromFS {
+		require.Equal(t, fromFS[i].Key(), fromPath[i].Key())
+		require.Equal(t, fromFS[i].Data, fromPath[i].Data)
+	}
+}
+
+func Test_Overlay_Errors(t *testing.T) {
+	tests := []struct {
+		description string
+		overlay     string
+		files       map[string]string
+	}{
+		{
+			description: "unknown target",
+			overlay:     "prod",
+			files:       map[string]string{"overlays/prod/a.yaml": "kind: patch\ntarget: nope\nmerge: {data: {}}\n"},
+		},
+		{
+			description: "merge and json_patch",
+			overlay:     "prod",
+			files:       map[string]string{"overlays/prod/a.yaml": "kind: patch\ntarget: kv\nmerge: {}\njson_patch: []\n"},
+		},
+		{
+			description: "failed test op",
+			overlay:     "prod",
+			files:       map[string]string{"overlays/prod/a.yaml": "kind: patch\ntarget: kv\njson_patch: [{op: test, path: /data/type, value: pki}]\n"},
+		},
+		{
+			description: "missing path",
+			overlay:     "prod",
+			files:       map[string]string{"overlays/prod/a.yaml": "kind: patch\ntarget: kv\njson_patch: [{op: remove, path: /data/nope}]\n"},
+		},
+		{
+			description: "patch in base",
+			files:       map[string]string{"b.yaml": "kind: patch\ntarget: kv\nmerge: {data: {}}\n"},
+		},
+		{
+			description: "unknown overlay",
+			overlay:     "stage",
+		},
+		{
+			description: "invalid overlay name",
+			overlay:     "../prod",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			files := map[string]string{"a.yaml": "name: kv\npath: sys/mounts/kv\ndata: {type: kv}\n"}
+			for k, v := range test.files {
+				files[k] = v
+			}
+			_, err := LoadResourcesFromFS(writeFSFiles(t, files), "", LoadOptions{Overlay: test.overlay})
+			require.Error(t, err)
+		})
+	}
+}
+
+func Test_ApplyJSONPatch(t *testing.T) {
+	doc := map[string]interface{}{
+		"a": map[string]interface{}{"b": "c", "x/y": 1},
+		"l": []interface{}{"one", "two"},
+	}
+	ops := []map[string]interface{}{
+		{"op": "add", "path": "/l/1", "value": "between"},
+		{"op": "copy", "from": "/a", "path": "/copy"},
+		{"op": "move", "from": "/a/b", "path": "/moved"},
+		{"op": "replace", "path": "/a/x~1y", "value": 2},
+		{"op": "test", "path": "/copy/b", "value": "c"},
+	}
+	out, err := applyJSONPatch(doc, ops)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"a":     map[string]interface{}{"x/y": 2},
+		"l":     []interface{}{"one", "between", "two"},
+		"copy":  map[string]interface{}{"b": "c", "x/y": 1},
+		"moved": "c",
+	}, out)
+
+	_, err = applyJSONPatch(out, []map[string]interface{}{{"op": "move", "from": "/a", "path": "/a/child"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,490 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/trublast/vault-plugin-gitops/pkg/vault_client"
+)
+
+const (
+	FieldNameKey           = "key"
+	FieldNameNamespace     = "namespace"
+	FieldNameRead          = "read"
+	FieldNameReadPath      = "read_path"
+	FieldNameShowSensitive = "show_sensitive"
+	FieldNameFormat        = "format"
+	FieldNameCommit        = "commit"
+
+	// FormatDOT is the Graphviz format of state/graph.
+	FormatDOT = "dot"
+
+	redactedValue = "<redacted>"
+)
+
+// statePaths returns the endpoints that inspect and change the stored state.
+func (b *backend) statePaths() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "^state/forget/(?P<key>.+)$",
+			Fields: map[string]*framework.FieldSchema{
+				FieldNameKey: {
+					Type:        framework.TypeString,
+					Description: "State key of the resource (its name, or namespace+path).",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathStateForget,
+					Summary:  "Remove a resource from state without deleting it in Vault.",
+				},
+			},
+			HelpSynopsis:    "Stop managing a resource without deleting it in Vault.",
+			HelpDescription: "Drops the key from the gitops state; no Vault API call is made. If the resource is still declared in the repository, the next commit creates it again; use 'lifecycle: abandon' to hand it over from the repository instead.",
+		},
+		{
+			Pattern: "^state/import/?$",
+			Fields: map[string]*framework.FieldSchema{
+				FieldNameKey: {
+					Type:        framework.TypeString,
+					Description: "State key of the resource as declared in the repository (its name, or namespace+path).",
+					Required:    true,
+				},
+				FieldNamePath: {
+					Type:        framework.TypeString,
+					Description: "Vault API path of the resource (without /v1/).",
+					Required:    true,
+				},
+				FieldNameNamespace: {
+					Type:        framework.TypeString,
+					Description: "Vault namespace of the resource, e.g. 'ns1/'; empty = root.",
+				},
+				FieldNameRead: {
+					Type:        framework.TypeBool,
+					Default:     false,
+					Description: "Read the current response data of the resource from Vault (GET on path or read_path).",
+				},
+				FieldNameReadPath: {
+					Type:        framework.TypeString,
+					Description: "Path to read the response data from instead of path (e.g. 'pki/cert/ca'); implies read.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathStateImport,
+					Summary:  "Record an existing Vault resource as already applied.",
+				},
+			},
+			HelpSynopsis:    "Adopt an existing Vault resource without re-creating it.",
+			HelpDescription: "Adds a pending import to the gitops state. The next apply records the digest of the declared resource with this key and does not send its request; with read or read_path the response data is read from Vault now, for resources that reference it. A pending import that is not declared in the repository is never deleted; use state/forget/<key> to drop it.",
+		},
+		{
+			Pattern: "^state/snapshots/?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathStateSnapshots,
+					Summary:  "List the state snapshots of applied commits.",
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathStateSnapshots,
+					Summary:  "List the state snapshots of applied commits.",
+				},
+			},
+			HelpSynopsis:    "Snapshots of the gitops state.",
+			HelpDescription: fmt.Sprintf("Every successful apply stores a copy of the state under the commit hash. Returns the commits, oldest first, with the time and size of the snapshot (key_info); the last %d snapshots are kept.", MaxStateSnapshots),
+		},
+		{
+			Pattern: "^state/restore/?$",
+			Fields: map[string]*framework.FieldSchema{
+				FieldNameCommit: {
+					Type:        framework.TypeString,
+					Description: "Commit hash of the snapshot to restore (see state/snapshots).",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathStateRestore,
+					Summary:  "Replace the state with a snapshot.",
+				},
+			},
+			HelpSynopsis:    "Roll the gitops state back to a snapshot.",
+			HelpDescription: "Replaces the stored state with the snapshot taken after the given commit was applied. No Vault API call is made: the next commit is planned against the restored state, so resources created since the snapshot are not in state and are not deleted.",
+		},
+		{
+			Pattern: "^state/?$",
+			Fields: map[string]*framework.FieldSchema{
+				FieldNamePath: {
+					Type:        framework.TypeString,
+					Description: "Only entries whose path starts with this prefix.",
+				},
+				FieldNameNamespace: {
+					Type:        framework.TypeString,
+					Description: "Only entries in this namespace, e.g. 'ns1/'; empty = all.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathStateList,
+					Summary:  "List the resources managed by gitops.",
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathStateList,
+					Summary:  "List the resources managed by gitops, filtered by path and namespace.",
+				},
+			},
+			HelpSynopsis:    "Resources in the gitops state.",
+			HelpDescription: "Returns the state keys with namespace, path and digest of every entry (key_info). Read with path=<prefix> answers whether gitops manages a Vault path; state/key/<key> returns one entry.",
+		},
+		{
+			Pattern: "^state/graph/?$",
+			Fields: map[string]*framework.FieldSchema{
+				FieldNameFormat: {
+					Type:        framework.TypeString,
+					Default:     FormatJSON,
+					Description: "Output format: json (nodes and edges) or dot (Graphviz).",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathStateGraph,
+					Summary:  "Read the dependency graph of the state.",
+				},
+			},
+			HelpSynopsis:    "Dependency graph of the gitops state.",
+			HelpDescription: "Nodes are state keys; an edge goes from a dependency to the resource that depends on it. format=dot returns a Graphviz digraph in 'dot'.",
+		},
+		{
+			Pattern: "^state/key/(?P<key>.+)$",
+			Fields: map[string]*framework.FieldSchema{
+				FieldNameKey: {
+					Type:        framework.TypeString,
+					Description: "State key of the resource (its name, or namespace+path).",
+					Required:    true,
+				},
+				FieldNameShowSensitive: {
+					Type:        framework.TypeBool,
+					Default:     false,
+					Description: "Return response_data and applied_data as stored instead of redacted.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathStateRead,
+					Summary:  "Read one state entry.",
+				},
+			},
+			HelpSynopsis:    "One resource of the gitops state.",
+			HelpDescription: "Returns namespace, path, digest, dependencies and dependents, flags, and the commit and time of the last apply. Values of response_data and applied_data are replaced with '<redacted>' unless show_sensitive is set.",
+		},
+		{
+			Pattern: "^history/?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathHistoryRead,
+					Summary:  "Read the history of state changes.",
+				},
+			},
+			HelpSynopsis:    "History of state changes.",
+			HelpDescription: fmt.Sprintf("Creates, updates, deletes, imports, abandons, forgets and restores, oldest first; the last %d entries are kept.", MaxHistoryEntries),
+		},
+	}
+}
+
+func (b *backend) pathStateForget(ctx context.Context, req *logical.Request, fields *framework.FieldData) (*logical.Response, error) {
+	key := fields.Get(FieldNameKey).(string)
+	if !b.stateLock.TryLock() {
+		return logical.ErrorResponse("a commit is being applied, try again later"), nil
+	}
+	defer b.stateLock.Unlock()
+
+	if _, err := UpgradeState(ctx, req.Storage); err != nil {
+		return nil, err
+	}
+	state, err := LoadState(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	res, ok := state.Resources[key]
+	if !ok {
+		return logical.ErrorResponse("key %q not found in state", key), nil
+	}
+	delete(state.Resources, key)
+	if err := NewStorageStateWriter(req.Storage).SaveState(ctx, state); err != nil {
+		return nil, err
+	}
+	if err := recordHistory(ctx, req.Storage, HistoryEntry{Action: HistoryForget, Key: key, Namespace: res.Namespace, Path: res.Path}); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("Removed resource from state", "key", key, "path", res.Namespace+res.Path)
+	return &logical.Response{Data: map[string]interface{}{
+		FieldNameKey:       key,
+		FieldNameNamespace: res.Namespace,
+		FieldNamePath:      res.Path,
+	}}, nil
+}
+
+func (b *backend) pathStateImport(ctx context.Context, req *logical.Request, fields *framework.FieldData) (*logical.Response, error) {
+	key := fields.Get(FieldNameKey).(string)
+	path := strings.TrimPrefix(fields.Get(FieldNamePath).(string), "/")
+	namespace := normalizeNamespace(fields.Get(FieldNameNamespace).(string))
+	readPath := fields.Get(FieldNameReadPath).(string)
+	if key == "" || path == "" {
+		return logical.ErrorResponse("%q and %q are required", FieldNameKey, FieldNamePath), nil
+	}
+	if !b.stateLock.TryLock() {
+		return logical.ErrorResponse("a commit is being applied, try again later"), nil
+	}
+	defer b.stateLock.Unlock()
+
+	if _, err := UpgradeState(ctx, req.Storage); err != nil {
+		return nil, err
+	}
+	state, err := LoadState(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := state.Resources[key]; ok {
+		return logical.ErrorResponse("key %q is already in state", key), nil
+	}
+	var client *api.Client
+	if fields.Get(FieldNameRead).(bool) || readPath != "" {
+		vaultConfig, err := vault_client.GetConfig(ctx, req.Storage)
+		if err != nil {
+			return logical.ErrorResponse("unable to get vault configuration: %s", err.Error()), nil
+		}
+		if client, err = vault_client.NewClientFromConfig(vaultConfig); err != nil {
+			return logical.ErrorResponse("vault client: %s", err.Error()), nil
+		}
+	}
+	res, err := PendingImport(ctx, client, namespace, path, readPath)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	state.Resources[key] = res
+	if err := NewStorageStateWriter(req.Storage).SaveState(ctx, state); err != nil {
+		return nil, err
+	}
+	if err := recordHistory(ctx, req.Storage, HistoryEntry{Action: string(PlanImport), Key: key, Namespace: namespace, Path: path}); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("Added pending import to state", "key", key, "path", namespace+path)
+	return &logical.Response{Data: map[string]interface{}{
+		FieldNameKey:       key,
+		FieldNameNamespace: namespace,
+		FieldNamePath:      path,
+		"response_data":    res.ResponseData != nil,
+	}}, nil
+}
+
+func (b *backend) pathStateSnapshots(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	snapshots, err := GetStateSnapshots(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(snapshots))
+	info := make(map[string]interface{}, len(snapshots))
+	for _, s := range snapshots {
+		keys = append(keys, s.Commit)
+		info[s.Commit] = map[string]interface{}{
+			"time": s.Time.Format(time.RFC3339),
+			"size": s.Size,
+		}
+	}
+	return logical.ListResponseWithInfo(keys, info), nil
+}
+
+func (b *backend) pathStateRestore(ctx context.Context, req *logical.Request, fields *framework.FieldData) (*logical.Response, error) {
+	commit := fields.Get(FieldNameCommit).(string)
+	if commit == "" {
+		return logical.ErrorResponse("%q is required", FieldNameCommit), nil
+	}
+	if !b.stateLock.TryLock() {
+		return logical.ErrorResponse("a commit is being applied, try again later"), nil
+	}
+	defer b.stateLock.Unlock()
+
+	state, err := RestoreState(ctx, req.Storage, commit)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := recordHistory(ctx, req.Storage, HistoryEntry{Action: HistoryRestore, Commit: commit, Detail: fmt.Sprintf("state restored from snapshot, %d resource(s)", len(state.Resources))}); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("Restored state from snapshot", "commit", commit, "resources", len(state.Resources))
+	return &logical.Response{Data: map[string]interface{}{
+		FieldNameCommit: commit,
+		"resources":     len(state.Resources),
+	}}, nil
+}
+
+func (b *backend) pathStateList(ctx context.Context, req *logical.Request, fields *framework.FieldData) (*logical.Response, error) {
+	prefix := normalizePath(fields.Get(FieldNamePath).(string))
+	namespace := normalizeNamespace(fields.Get(FieldNameNamespace).(string))
+	state, err := LoadState(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(state.Resources))
+	info := make(map[string]interface{}, len(state.Resources))
+	for key, res := range state.Resources {
+		if prefix != "" && !strings.HasPrefix(normalizePath(res.Path), prefix) {
+			continue
+		}
+		if namespace != "" && normalizeNamespace(res.Namespace) != namespace {
+			continue
+		}
+		keys = append(keys, key)
+		info[key] = map[string]interface{}{
+			FieldNameNamespace: res.Namespace,
+			FieldNamePath:      res.Path,
+			"data_digest":      res.DataDigest,
+		}
+	}
+	sort.Strings(keys)
+	return logical.ListResponseWithInfo(keys, info), nil
+}
+
+func (b *backend) pathStateRead(ctx context.Context, req *logical.Request, fields *framework.FieldData) (*logical.Response, error) {
+	key := fields.Get(FieldNameKey).(string)
+	state, err := LoadState(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	res, ok := state.Resources[key]
+	if !ok {
+		return nil, nil
+	}
+	dependents := []string{}
+	for k, other := range state.Resources {
+		for _, dep := range other.Dependencies {
+			if dep == key {
+				dependents = append(dependents, k)
+				break
+			}
+		}
+	}
+	sort.Strings(dependents)
+	responseData, appliedData := res.ResponseData, res.AppliedData
+	if !fields.Get(FieldNameShowSensitive).(bool) {
+		responseData, appliedData = redactValues(responseData), redactValues(appliedData)
+	}
+	dependencies := res.Dependencies
+	if dependencies == nil {
+		dependencies = []string{}
+	}
+	data := map[string]interface{}{
+		FieldNameKey:       key,
+		FieldNameNamespace: res.Namespace,
+		FieldNamePath:      res.Path,
+		"data_digest":      res.DataDigest,
+		"dependencies":     dependencies,
+		"dependents":       dependents,
+		"ignore_failures":  res.IgnoreFailures,
+		"prevent_destroy":  res.PreventDestroy,
+		"imported":         res.Imported,
+		"data_source":      res.DataSource,
+		"commit":           res.Commit,
+		"applied_at":       formatTime(res.AppliedAt),
+		"read_at":          formatTime(res.ReadAt),
+		"response_data":    responseData,
+		"applied_data":     appliedData,
+	}
+	if res.Delete != nil {
+		data["delete"] = res.Delete
+	}
+	return &logical.Response{Data: data}, nil
+}
+
+func (b *backend) pathStateGraph(ctx context.Context, req *logical.Request, fields *framework.FieldData) (*logical.Response, error) {
+	format := fields.Get(FieldNameFormat).(string)
+	if format != FormatJSON && format != FormatDOT {
+		return logical.ErrorResponse("unknown format %q (use %s or %s)", format, FormatJSON, FormatDOT), nil
+	}
+	state, err := LoadState(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(state.Resources))
+	for key := range state.Resources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	nodes := make([]map[string]interface{}, 0, len(keys))
+	edges := make([]map[string]interface{}, 0)
+	var dot strings.Builder
+	dot.WriteString("digraph gitops {\n")
+	for _, key := range keys {
+		res := state.Resources[key]
+		nodes = append(nodes, map[string]interface{}{FieldNameKey: key, FieldNameNamespace: res.Namespace, FieldNamePath: res.Path})
+		fmt.Fprintf(&dot, "  %q;\n", key)
+	}
+	for _, key := range keys {
+		for _, dep := range state.Resources[key].Dependencies {
+			edges = append(edges, map[string]interface{}{"from": dep, "to": key})
+			fmt.Fprintf(&dot, "  %q -> %q;\n", dep, key)
+		}
+	}
+	dot.WriteString("}\n")
+	if format == FormatDOT {
+		return &logical.Response{Data: map[string]interface{}{FormatDOT: dot.String()}}, nil
+	}
+	return &logical.Response{Data: map[string]interface{}{"nodes": nodes, "edges": edges}}, nil
+}
+
+// redactValues returns a copy of v with every scalar replaced by "<redacted>"; the field names stay.
+func redactValues(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = redactValues(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redactValues(item)
+		}
+		return out
+	}
+	return redactedValue
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (b *backend) pathHistoryRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	entries, err := GetHistory(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]map[string]interface{}, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, map[string]interface{}{
+			"time":      e.Time.Format(time.RFC3339),
+			"commit":    e.Commit,
+			"action":    e.Action,
+			"key":       e.Key,
+			"namespace": e.Namespace,
+			"path":      e.Path,
+			"detail":    e.Detail,
+		})
+	}
+	return &logical.Response{Data: map[string]interface{}{"entries": out}}, nil
+}
@@ -0,0 +1,136 @@
+package gitops
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+
+	"github.com/trublast/vault-plugin-gitops/pkg/engine"
+)
+
+func Test_StateRead(t *testing.T) {
+	ctx := context.Background()
+	fb := &framework.Backend{}
+	fb.Paths = Paths(fb)
+	storage := &logical.InmemStorage{}
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+	require.NoError(t, fb.Setup(ctx, config))
+
+	appliedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	state := &State{Resources: map[string]StateResource{
+		"kv":       {Path: "sys/mounts/kv", DataDigest: "d1", Commit: "c1", AppliedAt: &appliedAt},
+		"reader":   {Path: "sys/policies/acl/reader", DataDigest: "d2", Dependencies: []string{"kv"}},
+		"team/app": {Namespace: "team/", Path: "auth/approle/role/app/secret-id", Dependencies: []string{"kv", "reader"}, ResponseData: map[string]interface{}{"secret_id": "s.1", "ttl": 60}},
+	}}
+	require.NoError(t, NewStorageStateWriter(storage).SaveState(ctx, state))
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := fb.HandleRequest(ctx, &logical.Request{Operation: op, Path: path, Storage: storage, Data: data})
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := request(logical.ListOperation, "state/", nil)
+	require.Equal(t, []string{"kv", "reader", "team/app"}, resp.Data["keys"])
+	require.Equal(t, map[string]interface{}{"namespace": "", "path": "sys/mounts/kv", "data_digest": "d1"}, resp.Data["key_info"].(map[string]interface{})["kv"])
+	resp = request(logical.ReadOperation, "state", map[string]interface{}{"path": "sys/"})
+	require.Equal(t, []string{"kv", "reader"}, resp.Data["keys"])
+	resp = request(logical.ReadOperation, "state", map[string]interface{}{"namespace": "team"})
+	require.Equal(t, []string{"team/app"}, resp.Data["keys"])
+
+	resp = request(logical.ReadOperation, "state/key/kv", nil)
+	require.Equal(t, "c1", resp.Data["commit"])
+	require.Equal(t, "2026-01-02T03:04:05Z", resp.Data["applied_at"])
+	require.Equal(t, []string{"reader", "team/app"}, resp.Data["dependents"])
+
+	resp = request(logical.ReadOperation, "state/key/team/app", nil)
+	require.Equal(t, map[string]interface{}{"secret_id": "<redacted>", "ttl": "<redacted>"}, resp.Data["response_data"])
+	resp = request(logical.ReadOperation, "state/key/team/app", map[string]interface{}{"show_sensitive": true})
+	require.Equal(t, "s.1", resp.Data["response_data"].(map[string]interface{})["secret_id"])
+
+	require.Nil(t, request(logical.ReadOperation, "state/key/nope", nil))
+
+	resp = request(logical.ReadOperation, "state/graph", nil)
+	require.Len(t, resp.Data["nodes"], 3)
+	require.Equal(t, []map[string]interface{}{
+		{"from": "kv", "to": "reader"},
+		{"from": "kv", "to": "team/app"},
+		{"from": "reader", "to": "team/app"},
+	}, resp.Data["edges"])
+	resp = request(logical.ReadOperation, "state/graph", map[string]interface{}{"format": "dot"})
+	require.Equal(t, "digraph gitops {\n  \"kv\";\n  \"reader\";\n  \"team/app\";\n  \"kv\" -> \"reader\";\n  \"kv\" -> \"team/app\";\n  \"reader\" -> \"team/app\";\n}\n", resp.Data["dot"])
+	require.True(t, request(logical.ReadOperation, "state/graph", map[string]interface{}{"format": "svg"}).IsError())
+
+	state.Resources["graph"] = StateResource{Path: "sys/policies/acl/graph", DataDigest: "d3"}
+	require.NoError(t, NewStorageStateWriter(storage).SaveState(ctx, state))
+	resp = request(logical.ReadOperation, "state/key/graph", nil)
+	require.Equal(t, "sys/policies/acl/graph", resp.Data["path"], "a key may have the name of a state endpoint")
+}
+
+func Test_StateSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	fb := &framework.Backend{}
+	fb.Paths = Paths(fb)
+	storage := &logical.InmemStorage{}
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+	require.NoError(t, fb.Setup(ctx, config))
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := fb.HandleRequest(ctx, &logical.Request{Operation: op, Path: path, Storage: storage, Data: data})
+		require.NoError(t, err)
+		return resp
+	}
+
+	writer := NewStorageStateWriter(storage)
+	first := &State{Resources: map[string]StateResource{
+		"kv":  {Path: "sys/mounts/kv", DataDigest: "d1"},
+		"sid": {Path: "auth/approle/role/app/secret-id", ResponseData: map[string]interface{}{"secret_id": "s.1"}},
+	}}
+	require.NoError(t, writer.SaveState(ctx, first))
+	require.NoError(t, SnapshotState(ctx, storage, "c1"))
+	require.NoError(t, writer.SaveState(ctx, &State{Resources: map[string]StateResource{}}))
+	require.NoError(t, SnapshotState(ctx, storage, "c2"))
+
+	resp := request(logical.ListOperation, "state/snapshots", nil)
+	require.Equal(t, []string{"c1", "c2"}, resp.Data["keys"])
+
+	require.True(t, request(logical.UpdateOperation, "state/restore", map[string]interface{}{"commit": "nope"}).IsError())
+	resp = request(logical.UpdateOperation, "state/restore", map[string]interface{}{"commit": "c1"})
+	require.Equal(t, 2, resp.Data["resources"])
+	state, err := LoadState(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, "s.1", state.Resources["sid"].ResponseData.(map[string]interface{})["secret_id"])
+
+	history, err := GetHistory(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, HistoryRestore, history[len(history)-1].Action)
+	require.Equal(t, "c1", history[len(history)-1].Commit)
+}
+
+func Test_StateLockPerMount(t *testing.T) {
+	ctx := context.Background()
+	forget := func(e *engineImpl) *logical.Response {
+		fb := &framework.Backend{}
+		fb.Paths = e.Paths(fb)
+		storage := &logical.InmemStorage{}
+		config := logical.TestBackendConfig()
+		config.StorageView = storage
+		require.NoError(t, fb.Setup(ctx, config))
+		resp, err := fb.HandleRequest(ctx, &logical.Request{Operation: logical.UpdateOperation, Path: "state/forget/nope", Storage: storage})
+		require.NoError(t, err)
+		return resp
+	}
+	first, ok := engine.Get("gitops")
+	require.True(t, ok)
+	second, _ := engine.Get("gitops")
+	require.NotSame(t, first, second, "every mount gets its own engine")
+
+	first.(*engineImpl).backend.stateLock.Lock()
+	defer first.(*engineImpl).backend.stateLock.Unlock()
+	require.Contains(t, forget(first.(*engineImpl)).Error().Error(), "a commit is being applied")
+	require.NotContains(t, forget(second.(*engineImpl)).Error().Error(), "a commit is being applied", "the lock of another mount does not block")
+}
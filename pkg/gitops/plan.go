@@ -0,0 +1,113 @@
+package gitops
+
+import "time"
+
+// PlanAction is what Apply would do with a resource.
+type PlanAction string
+
+const (
+	PlanCreate    PlanAction = "create"
+	PlanUpdate    PlanAction = "update"
+	PlanUnchanged PlanAction = "unchanged"
+	PlanDelete    PlanAction = "delete"
+	// PlanAbandon drops the state entry of a 'lifecycle: abandon' resource without calling Vault.
+	PlanAbandon PlanAction = "abandon"
+	// PlanImport adopts a pending import: the digest is recorded without calling Vault.
+	PlanImport PlanAction = "import"
+	// PlanRead reads a data source; nothing is written.
+	PlanRead PlanAction = "read"
+)
+
+// PlanChange is one planned action for a state key.
+type PlanChange struct {
+	Key       string
+	Namespace string
+	Path      string
+	Action    PlanAction
+	// Unknown is set when data could not be resolved before apply (e.g. refs to resources not applied yet).
+	Unknown bool
+	// Delete is the 'delete' recorded in state for a delete; nil = DELETE on Path.
+	Delete *DeleteSpec
+}
+
+// Plan compares resources with state and reports what Apply would do, without calling Vault.
+// Changes are returned in apply order: reads, creates, updates and abandons, then deletes.
+// Abandoned resources that are not in state are not reported.
+func Plan(resources []Resource, state *State) ([]PlanChange, error) {
+	if state == nil || state.Resources == nil {
+		state = &State{Resources: make(map[string]StateResource)}
+	}
+	order, err := topologicalOrder(resources)
+	if err != nil {
+		return nil, err
+	}
+	currentKeys := make(map[string]bool)
+	for _, r := range resources {
+		currentKeys[r.Key()] = true
+	}
+
+	var changes []PlanChange
+	migrated := make(map[string]bool)
+	for _, idx := range order {
+		r := &resources[idx]
+		key := r.Key()
+		change := PlanChange{Key: key, Namespace: r.NamespaceOrDefault(), Path: r.Path}
+		prev, inState := state.Resources[key]
+		if r.Abandoned() {
+			if inState {
+				change.Action = PlanAbandon
+				changes = append(changes, change)
+			}
+			continue
+		}
+		if inState && prev.Imported && !r.IsDataSource() {
+			change.Action = PlanImport
+			changes = append(changes, change)
+			continue
+		}
+		resolvedData, err := resolveResourceData(r, state)
+		if err != nil {
+			change.Unknown = true
+			change.Action = PlanUpdate
+			if r.IsDataSource() {
+				change.Action = PlanRead
+			} else if !inState {
+				change.Action = PlanCreate
+			}
+			changes = append(changes, change)
+			continue
+		}
+		digest := dataDigestWithRevision(resolvedData, revisionForDigest(r.Revision))
+		switch {
+		case r.IsDataSource():
+			change.Action = PlanRead
+			if dataSourceFresh(r, prev, digest, time.Now()) {
+				change.Action = PlanUnchanged
+			}
+		case inState && prev.DataDigest == digest:
+			change.Action = PlanUnchanged
+		case inState:
+			change.Action = PlanUpdate
+		default:
+			change.Action = PlanCreate
+			// Same as Apply: unchanged data under an old key (name added) only moves the key.
+			if oldKey, p, found := state.FindByNsPath(r.NamespaceOrDefault(), r.Path); found && p.DataDigest == digest {
+				change.Action = PlanUnchanged
+				migrated[oldKey] = true
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	var toDelete []string
+	for key := range state.Resources {
+		if !currentKeys[key] && !migrated[key] && !state.Resources[key].Imported {
+			toDelete = append(toDelete, key)
+		}
+	}
+	for _, key := range deleteOrderFromState(state, toDelete) {
+		res := state.Resources[key]
+		changes = append(changes, PlanChange{Key: key, Namespace: res.Namespace, Path: res.Path, Action: PlanDelete, Delete: res.Delete})
+	}
+	return changes, nil
+}
@@ -0,0 +1,262 @@
+package gitops
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	hclparser "github.com/hashicorp/hcl/hcl/parser"
+	hcltoken "github.com/hashicorp/hcl/hcl/token"
+)
+
+// Policy lint rules and their default severities (see LintOptions.Severity to change them).
+const (
+	RulePolicySyntax         = "policy-syntax"
+	RulePolicyRootSudo       = "policy-root-sudo"
+	RulePolicySysWrite       = "policy-sys-write"
+	RulePolicyTokenCreate    = "policy-token-create-glob"
+	RulePolicySelfEscalation = "policy-self-escalation"
+)
+
+// aclPolicyPrefixes are API paths of ACL policies; data.policy holds the policy text.
+var aclPolicyPrefixes = []string{"sys/policies/acl/", "sys/policy/"}
+
+// policyPathKeys are the keys Vault accepts in a path block.
+var policyPathKeys = map[string]bool{
+	"comment": true, "policy": true, "capabilities": true,
+	"allowed_parameters": true, "denied_parameters": true, "required_parameters": true,
+	"min_wrapping_ttl": true, "max_wrapping_ttl": true, "control_group": true,
+	"mfa_methods": true, "subscribe_event_types": true,
+}
+
+var policyCapabilities = map[string]bool{
+	"create": true, "read": true, "update": true, "patch": true, "delete": true,
+	"list": true, "sudo": true, "deny": true, "subscribe": true, "recover": true,
+}
+
+// policyShorthand maps the deprecated 'policy = "..."' form to capabilities.
+var policyShorthand = map[string][]string{
+	"deny":  {"deny"},
+	"read":  {"read", "list"},
+	"write": {"create", "read", "update", "delete", "list"},
+	"sudo":  {"create", "read", "update", "delete", "list", "sudo"},
+}
+
+// policyRule is one 'path' block of an ACL policy.
+type policyRule struct {
+	Pattern      string
+	Capabilities []string
+	Line         int // line in the policy text
+}
+
+func (p policyRule) has(caps ...string) bool {
+	for _, c := range p.Capabilities {
+		for _, want := range caps {
+			if c == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writes reports whether the rule grants a capability that changes data.
+func (p policyRule) writes() bool {
+	return !p.has("deny") && p.has("create", "update", "patch", "delete", "sudo")
+}
+
+// parsePolicy parses an ACL policy (HCL or JSON) into its path rules, rejecting keys and
+// capabilities Vault does not accept.
+func parsePolicy(text string) ([]policyRule, error) {
+	file, err := hcl.ParseString(text)
+	if err != nil {
+		var posErr *hclparser.PosError
+		if errors.As(err, &posErr) {
+			return nil, fmt.Errorf("line %d: %v", posErr.Pos.Line, posErr.Err)
+		}
+		return nil, err
+	}
+	list, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, fmt.Errorf("policy must be an object")
+	}
+	var rules []policyRule
+	for _, item := range list.Items {
+		key := hclKey(item.Keys[0])
+		switch key {
+		case "name":
+			continue
+		case "path":
+		default:
+			return nil, fmt.Errorf("line %d: invalid key %q", item.Pos().Line, key)
+		}
+		if len(item.Keys) == 2 {
+			rule, err := parsePolicyPath(hclKey(item.Keys[1]), item.Val)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+			continue
+		}
+		// path = { "<pattern>" = { ... } } (JSON form)
+		obj, ok := item.Val.(*ast.ObjectType)
+		if !ok || len(item.Keys) != 1 {
+			return nil, fmt.Errorf("line %d: path must be a block", item.Pos().Line)
+		}
+		for _, p := range obj.List.Items {
+			rule, err := parsePolicyPath(hclKey(p.Keys[0]), p.Val)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func parsePolicyPath(pattern string, val ast.Node) (policyRule, error) {
+	rule := policyRule{Pattern: strings.TrimPrefix(pattern, "/"), Line: val.Pos().Line}
+	obj, ok := val.(*ast.ObjectType)
+	if !ok {
+		return rule, fmt.Errorf("line %d: path %q must be a block", rule.Line, pattern)
+	}
+	for _, item := range obj.List.Items {
+		key := hclKey(item.Keys[0])
+		line := item.Pos().Line
+		if !policyPathKeys[key] {
+			return rule, fmt.Errorf("line %d: path %q: invalid key %q", line, pattern, key)
+		}
+		switch key {
+		case "capabilities":
+			caps, ok := item.Val.(*ast.ListType)
+			if !ok {
+				return rule, fmt.Errorf("line %d: path %q: capabilities must be a list", line, pattern)
+			}
+			for _, c := range caps.List {
+				lit, ok := c.(*ast.LiteralType)
+				if !ok || lit.Token.Type != hcltoken.STRING {
+					return rule, fmt.Errorf("line %d: path %q: capabilities must be strings", line, pattern)
+				}
+				capability := strings.ToLower(fmt.Sprint(lit.Token.Value()))
+				if !policyCapabilities[capability] {
+					return rule, fmt.Errorf("line %d: path %q: unknown capability %q", line, pattern, capability)
+				}
+				rule.Capabilities = append(rule.Capabilities, capability)
+			}
+		case "policy":
+			lit, ok := item.Val.(*ast.LiteralType)
+			if !ok {
+				return rule, fmt.Errorf("line %d: path %q: policy must be a string", line, pattern)
+			}
+			caps, ok := policyShorthand[strings.ToLower(fmt.Sprint(lit.Token.Value()))]
+			if !ok {
+				return rule, fmt.Errorf("line %d: path %q: unknown policy %q", line, pattern, lit.Token.Value())
+			}
+			rule.Capabilities = append(rule.Capabilities, caps...)
+		}
+	}
+	return rule, nil
+}
+
+// policyPatternMatches reports whether a policy path pattern covers path: '+' matches one
+// segment, a trailing '*' matches any suffix.
+func policyPatternMatches(pattern, path string) bool {
+	glob := strings.HasSuffix(pattern, "*")
+	pattern = strings.TrimSuffix(pattern, "*")
+	patternSegs := strings.Split(pattern, "/")
+	segs := strings.Split(path, "/")
+	if len(segs) < len(patternSegs) || (!glob && len(segs) != len(patternSegs)) {
+		return false
+	}
+	for i, ps := range patternSegs {
+		last := i == len(patternSegs)-1
+		switch {
+		case ps == "+":
+			if segs[i] == "" {
+				return false
+			}
+		case last && glob:
+			return strings.HasPrefix(strings.Join(segs[i:], "/"), ps)
+		case ps != segs[i]:
+			return false
+		}
+	}
+	return true
+}
+
+// patternPrefix returns the literal part of a pattern before the first wildcard.
+func patternPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "+*"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// policyName returns the policy name if r writes an ACL policy.
+func policyName(r *Resource) (string, bool) {
+	p := normalizePath(r.Path)
+	for _, prefix := range aclPolicyPrefixes {
+		if strings.HasPrefix(p, prefix) && len(p) > len(prefix) {
+			return p[len(prefix):], true
+		}
+	}
+	return "", false
+}
+
+// lintPolicies parses data.policy of ACL policy resources and reports syntax errors and risky grants.
+// data is the resource data with Go templates rendered (nil to use r.Data).
+func lintPolicies(r *Resource, data interface{}) Diagnostics {
+	name, ok := policyName(r)
+	if !ok {
+		return nil
+	}
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	text, ok := m["policy"].(string)
+	if !ok || legacyTemplateRe.MatchString(text) {
+		return nil
+	}
+	var ds Diagnostics
+	report := func(severity Severity, rule, format string, args ...interface{}) {
+		ds = append(ds, newDiagnostic(r, severity, rule, "policy "+format, args...))
+	}
+	rules, err := parsePolicy(text)
+	if err != nil {
+		report(SeverityError, RulePolicySyntax, "%v", err)
+		return ds
+	}
+	ownPaths := make([]string, len(aclPolicyPrefixes))
+	for i, prefix := range aclPolicyPrefixes {
+		ownPaths[i] = prefix + name
+	}
+	for _, p := range rules {
+		isGlob := strings.ContainsAny(p.Pattern, "+*")
+		if p.Pattern == "*" && p.has("sudo") {
+			report(SeverityWarning, RulePolicyRootSudo, "line %d: path %q grants sudo on every path", p.Line, p.Pattern)
+		}
+		if p.writes() && isGlob && strings.HasPrefix("sys/", patternPrefix(p.Pattern)) {
+			report(SeverityWarning, RulePolicySysWrite, "line %d: path %q grants write access to all of sys/", p.Line, p.Pattern)
+		}
+		if isGlob && p.has("create", "update", "sudo") && !p.has("deny") {
+			for _, target := range []string{"auth/token/create", "auth/token/create-orphan", "auth/token/create/role"} {
+				if policyPatternMatches(p.Pattern, target) {
+					report(SeverityWarning, RulePolicyTokenCreate, "line %d: path %q allows creating tokens (%s) through a glob", p.Line, p.Pattern, target)
+					break
+				}
+			}
+		}
+		if p.has("create", "update", "patch", "sudo") && !p.has("deny") {
+			for _, own := range ownPaths {
+				if policyPatternMatches(p.Pattern, own) {
+					report(SeverityWarning, RulePolicySelfEscalation, "line %d: path %q lets holders of %q rewrite this policy and escalate", p.Line, p.Pattern, name)
+					break
+				}
+			}
+		}
+	}
+	return ds
+}
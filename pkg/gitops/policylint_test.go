@@ -0,0 +1,136 @@
+package gitops
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LintPolicies(t *testing.T) {
+	tests := []struct {
+		description string
+		path        string
+		policy      string
+		rules       []string
+	}{
+		{
+			description: "safe policy",
+			path:        "sys/policies/acl/app",
+			policy:      `path "secret/data/app/*" { capabilities = ["read", "list"] }`,
+		},
+		{
+			description: "json policy",
+			path:        "sys/policies/acl/app",
+			policy:      `{"path": {"secret/data/app/*": {"capabilities": ["read"]}}}`,
+		},
+		{
+			description: "syntax error",
+			path:        "sys/policies/acl/app",
+			policy:      "path \"secret/*\" {\n  capabilities = [\"read\"\n",
+			rules:       []string{RulePolicySyntax},
+		},
+		{
+			description: "unknown capability",
+			path:        "sys/policies/acl/app",
+			policy:      `path "secret/*" { capabilities = ["reed"] }`,
+			rules:       []string{RulePolicySyntax},
+		},
+		{
+			description: "unknown key",
+			path:        "sys/policies/acl/app",
+			policy:      `path "secret/*" { capability = ["read"] }`,
+			rules:       []string{RulePolicySyntax},
+		},
+		{
+			description: "root sudo",
+			path:        "sys/policies/acl/admin",
+			policy:      `path "*" { capabilities = ["read", "sudo"] }`,
+			rules:       []string{RulePolicyRootSudo, RulePolicySysWrite, RulePolicyTokenCreate, RulePolicySelfEscalation},
+		},
+		{
+			description: "sys write",
+			path:        "sys/policies/acl/ops",
+			policy:      `path "sys/*" { capabilities = ["update"] }`,
+			rules:       []string{RulePolicySysWrite, RulePolicySelfEscalation},
+		},
+		{
+			description: "sys read is fine",
+			path:        "sys/policies/acl/ops",
+			policy:      `path "sys/*" { capabilities = ["read", "list"] }`,
+		},
+		{
+			description: "token create glob",
+			path:        "sys/policies/acl/ci",
+			policy:      `path "auth/token/create*" { capabilities = ["update"] }`,
+			rules:       []string{RulePolicyTokenCreate},
+		},
+		{
+			description: "exact token create",
+			path:        "sys/policies/acl/ci",
+			policy:      `path "auth/token/create" { capabilities = ["update"] }`,
+		},
+		{
+			description: "own policy via plus",
+			path:        "sys/policies/acl/gitops",
+			policy:      `path "sys/policies/acl/+" { capabilities = ["update"] }`,
+			rules:       []string{RulePolicySelfEscalation},
+		},
+		{
+			description: "deny",
+			path:        "sys/policies/acl/gitops",
+			policy:      `path "sys/policies/acl/gitops" { capabilities = ["deny"] }`,
+		},
+		{
+			description: "not an ACL policy",
+			path:        "sys/policies/password/app",
+			policy:      "length = 20",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			r := Resource{Path: test.path, Data: map[string]interface{}{"policy": test.policy}}
+			var rules []string
+			for _, d := range LintDiagnostics([]Resource{r}, LintOptions{}) {
+				rules = append(rules, d.Rule)
+			}
+			require.ElementsMatch(t, test.rules, rules)
+		})
+	}
+}
+
+func Test_LintPolicies_Severity(t *testing.T) {
+	resources := []Resource{{
+		Path:       "sys/policies/acl/admin",
+		Templating: TemplatingGo,
+		Data:       map[string]interface{}{"policy": `path "{{ "*" }}" { capabilities = ["sudo"] }`},
+	}}
+	require.NoError(t, Lint(resources))
+
+	overrides, err := ParseSeverityOverrides("policy-root-sudo=error, policy-sys-write=off,policy-token-create-glob=off,policy-self-escalation=off")
+	require.NoError(t, err)
+	diags := LintDiagnostics(resources, LintOptions{Severity: overrides})
+	require.Len(t, diags, 1)
+	require.Equal(t, RulePolicyRootSudo, diags[0].Rule)
+	require.Equal(t, SeverityError, diags[0].Severity)
+	require.Error(t, diags.Err())
+
+	_, err = ParseSeverityOverrides("policy-root-sudo=fatal")
+	require.Error(t, err)
+	_, err = ParseSeverityOverrides("policy-root-sudo")
+	require.Error(t, err)
+}
+
+func Test_LintPolicies_SyntaxSeverity(t *testing.T) {
+	// A policy Vault would refuse stops the commit unless the rule is downgraded.
+	resources := []Resource{{Path: "sys/policies/acl/app", Data: map[string]interface{}{"policy": `path "secret/*" { capabilities = ["read", "future"] }`}}}
+	diags := LintDiagnostics(resources, LintOptions{})
+	require.Len(t, diags, 1)
+	require.Equal(t, SeverityError, diags[0].Severity)
+	require.Error(t, Lint(resources))
+
+	overrides, err := ParseSeverityOverrides("policy-syntax=warning")
+	require.NoError(t, err)
+	diags = LintDiagnostics(resources, LintOptions{Severity: overrides})
+	require.NoError(t, diags.Err())
+	require.Equal(t, SeverityWarning, diags[0].Severity)
+}
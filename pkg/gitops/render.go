@@ -0,0 +1,271 @@
+package gitops
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// TemplatingGo enables Go text/template rendering of string values in 'data'.
+const TemplatingGo = "go"
+
+// renderEnv holds load-time inputs for templates: variables from the vars file and
+// read access to repository files, relative to the YAML file the resource came from.
+type renderEnv struct {
+	vars  map[string]interface{}
+	files *repoFiles
+	dir   string      // directory of the YAML file (relative to files.root's filesystem)
+	each  interface{} // current generator item (kind: generator), nil otherwise
+}
+
+// readFile reads name relative to the resource's YAML file, refusing paths outside the loader root.
+func (e *renderEnv) readFile(name string) ([]byte, error) {
+	if e == nil || e.files == nil {
+		return nil, fmt.Errorf("file %q: repository files are not available", name)
+	}
+	return e.files.read(e.dir, name)
+}
+
+// repoFiles gives confined access to the files the loader was pointed at.
+type repoFiles struct {
+	root     string
+	readFunc func(name string) ([]byte, error)
+}
+
+// resolve joins name to dir and checks that the result stays under root.
+func (f *repoFiles) resolve(dir, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("empty file name")
+	}
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("file %q: absolute paths are not allowed", name)
+	}
+	p := filepath.Clean(filepath.Join(dir, name))
+	root := filepath.Clean(f.root)
+	if root == "." {
+		if p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("file %q: path is outside of the configuration root", name)
+		}
+		return p, nil
+	}
+	if p != root && !strings.HasPrefix(p, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %q: path is outside of %q", name, f.root)
+	}
+	return p, nil
+}
+
+func (f *repoFiles) read(dir, name string) ([]byte, error) {
+	p, err := f.resolve(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := f.readFunc(p)
+	if err != nil {
+		return nil, fmt.Errorf("file %q: %w", name, err)
+	}
+	return data, nil
+}
+
+// refFunc looks up key in the response_data of resource name.
+type refFunc func(name, key string) (interface{}, error)
+
+// stateRef returns a refFunc reading response_data from state.
+func stateRef(state *State) refFunc {
+	return func(name, key string) (interface{}, error) {
+		if state == nil || state.Resources == nil {
+			return nil, fmt.Errorf("ref %q %q: resource not in state", name, key)
+		}
+		res, ok := state.Resources[name]
+		if !ok {
+			return nil, fmt.Errorf("ref %q %q: resource not in state", name, key)
+		}
+		val, ok := getResponseDataPath(res.ResponseData, key)
+		if !ok {
+			return nil, fmt.Errorf("ref %q %q: path not found in response_data", name, key)
+		}
+		return val, nil
+	}
+}
+
+// staticRef returns a refFunc for evaluation without state: refs to known resources
+// become <name:key> placeholders.
+func staticRef(names map[string]int) refFunc {
+	return func(name, key string) (interface{}, error) {
+		if _, exists := names[name]; !exists {
+			return nil, fmt.Errorf("ref %q %q: resource not found", name, key)
+		}
+		return fmt.Sprintf("<%s:%s>", name, key), nil
+	}
+}
+
+// RenderStatic returns copies of resources with Go templates in data rendered without state,
+// for display. Values of ref are shown as <name:key> placeholders.
+func RenderStatic(resources []Resource) ([]Resource, error) {
+	names := make(map[string]int, len(resources))
+	for i := range resources {
+		names[resources[i].EffectiveName()] = i
+	}
+	out := make([]Resource, len(resources))
+	for i := range resources {
+		r := resources[i]
+		data, err := renderData(&r, staticRef(names))
+		if err != nil {
+			return nil, fmt.Errorf("resource %q: %w", r.EffectiveName(), err)
+		}
+		r.Data = data
+		r.Templating = ""
+		out[i] = r
+	}
+	return out, nil
+}
+
+// templateFuncs returns the functions available in templates. Only side-effect free helpers
+// are provided; 'file' is confined to the loader root.
+func templateFuncs(env *renderEnv, ref refFunc) template.FuncMap {
+	return template.FuncMap{
+		"ref": func(name, key string) (interface{}, error) {
+			return ref(name, key)
+		},
+		"file": func(name string) (string, error) {
+			data, err := env.readFile(name)
+			if err != nil {
+				return "", err
+			}
+			return string(data), nil
+		},
+		"base64": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"base64decode": func(s string) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return "", err
+			}
+			return string(b), nil
+		},
+		"sha256": func(s string) string {
+			h := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(h[:])
+		},
+		"toJson": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+			return string(b), nil
+		},
+		"join": func(sep string, v interface{}) (string, error) {
+			switch list := v.(type) {
+			case []string:
+				return strings.Join(list, sep), nil
+			case []interface{}:
+				parts := make([]string, len(list))
+				for i, item := range list {
+					parts[i] = fmt.Sprint(item)
+				}
+				return strings.Join(parts, sep), nil
+			default:
+				return "", fmt.Errorf("join: expected a list, got %T", v)
+			}
+		},
+		"split": func(sep, s string) []string {
+			return strings.Split(s, sep)
+		},
+		"default": func(def, v interface{}) interface{} {
+			if v == nil {
+				return def
+			}
+			if s, ok := v.(string); ok && s == "" {
+				return def
+			}
+			return v
+		},
+		"upper":   strings.ToUpper,
+		"lower":   strings.ToLower,
+		"trim":    strings.TrimSpace,
+		"replace": func(old, replacement, s string) string { return strings.ReplaceAll(s, old, replacement) },
+	}
+}
+
+// renderer executes Go templates in string values of resource data.
+type renderer struct {
+	funcs template.FuncMap
+	input map[string]interface{}
+}
+
+func newRenderer(r *Resource, ref refFunc) *renderer {
+	input := map[string]interface{}{"vars": map[string]interface{}{}}
+	if r.env != nil {
+		if r.env.vars != nil {
+			input["vars"] = r.env.vars
+		}
+		if r.env.each != nil {
+			input["each"] = r.env.each
+		}
+	}
+	return &renderer{
+		funcs: templateFuncs(r.env, ref),
+		input: input,
+	}
+}
+
+func (rd *renderer) renderString(s string) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	t, err := template.New("data").Option("missingkey=error").Funcs(rd.funcs).Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, rd.input); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (rd *renderer) render(data interface{}) (interface{}, error) {
+	switch x := data.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k, v := range x {
+			res, err := rd.render(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			out[k] = res
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, v := range x {
+			res, err := rd.render(v)
+			if err != nil {
+				return nil, fmt.Errorf("%d: %w", i, err)
+			}
+			out[i] = res
+		}
+		return out, nil
+	case string:
+		return rd.renderString(x)
+	default:
+		return data, nil
+	}
+}
+
+// renderData renders Go templates in r.Data when templating is enabled on the resource.
+func renderData(r *Resource, ref refFunc) (interface{}, error) {
+	if r.Templating == "" {
+		return r.Data, nil
+	}
+	if r.Templating != TemplatingGo {
+		return nil, fmt.Errorf("unsupported templating %q", r.Templating)
+	}
+	return newRenderer(r, ref).render(r.Data)
+}
@@ -0,0 +1,108 @@
+package gitops
+
+import (
+	"testing"
+
+	"github.com/go-git/go-billy/v6"
+	"github.com/go-git/go-billy/v6/memfs"
+	"github.com/go-git/go-billy/v6/util"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFSFiles(t *testing.T, files map[string]string) billy.Filesystem {
+	t.Helper()
+	fs := memfs.New()
+	for name, content := range files {
+		require.NoError(t, util.WriteFile(fs, name, []byte(content), 0o644))
+	}
+	return fs
+}
+
+func Test_RenderData(t *testing.T) {
+	fs := writeFSFiles(t, map[string]string{
+		"vars/prod.yaml":          "team: core\nregions: [eu, us]\n",
+		"vault/policies/base.hcl": `path "sys/health" { capabilities = ["read"] }`,
+		"vault/policy.yaml": `
+path: sys/policies/acl/core
+templating: go
+data:
+  policy: |
+    path "secret/{{ .vars.team }}/*" { capabilities = ["read"] }
+    {{ file "policies/base.hcl" }}
+  regions: '{{ join "," .vars.regions }}'
+  digest: '{{ sha256 .vars.team }}'
+  encoded: '{{ upper .vars.team | base64 }}'
+  fallback: '{{ index .vars "missing" | default "none" }}'
+`,
+		"outside.hcl": "secret",
+	})
+
+	resources, err := LoadResourcesFromFS(fs, "vault", LoadOptions{VarsFile: "vars/prod.yaml"})
+	require.NoError(t, err)
+	require.Len(t, resources, 1)
+	require.NoError(t, Lint(resources))
+
+	data, err := resolveResourceData(&resources[0], &State{})
+	require.NoError(t, err)
+	m := data.(map[string]interface{})
+	require.Equal(t, "path \"secret/core/*\" { capabilities = [\"read\"] }\npath \"sys/health\" { capabilities = [\"read\"] }\n", m["policy"])
+	require.Equal(t, "eu,us", m["regions"])
+	require.Equal(t, "Q09SRQ==", m["encoded"])
+	require.Equal(t, "none", m["fallback"])
+	require.Len(t, m["digest"], 64)
+}
+
+func Test_RenderData_Ref(t *testing.T) {
+	r := Resource{
+		Path:       "kv/app",
+		Templating: TemplatingGo,
+		Data:       map[string]interface{}{"url": "https://{{ ref \"token\" \"auth.client_token\" }}@host"},
+	}
+	state := &State{Resources: map[string]StateResource{
+		"token": {ResponseData: map[string]interface{}{"auth": map[string]interface{}{"client_token": "s.abc"}}},
+	}}
+	data, err := resolveResourceData(&r, state)
+	require.NoError(t, err)
+	require.Equal(t, "https://s.abc@host", data.(map[string]interface{})["url"])
+
+	_, err = resolveResourceData(&r, &State{})
+	require.Error(t, err)
+}
+
+func Test_RenderData_FileOutsideRoot(t *testing.T) {
+	fs := writeFSFiles(t, map[string]string{
+		"secret.txt": "secret",
+		"vault/a.yaml": `
+path: kv/a
+templating: go
+data:
+  value: '{{ file "../secret.txt" }}'
+`,
+	})
+	resources, err := LoadResourcesFromFS(fs, "vault", LoadOptions{})
+	require.NoError(t, err)
+	err = Lint(resources)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "outside")
+}
+
+func Test_Lint_TemplateErrors(t *testing.T) {
+	tests := []struct {
+		description string
+		data        string
+	}{
+		{description: "unknown variable", data: "{{ .vars.nope }}"},
+		{description: "syntax error", data: "{{ .vars.team "},
+		{description: "unknown ref", data: `{{ ref "missing" "id" }}`},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			resources := []Resource{{
+				Path:       "kv/a",
+				Templating: TemplatingGo,
+				Data:       map[string]interface{}{"v": test.data},
+			}}
+			require.Error(t, Lint(resources))
+		})
+	}
+}
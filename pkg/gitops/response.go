@@ -0,0 +1,236 @@
+package gitops
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/trublast/vault-plugin-gitops/pkg/util"
+)
+
+// StorageKeyStateKey holds the random secret the encryption key of sensitive state fields is
+// derived from. Like StorageKeyState it is seal-wrapped.
+const StorageKeyStateKey = "gitops_state_key"
+
+// SensitiveResponseFields are the field names (at any depth, case-insensitive) whose values are
+// credentials: they are encrypted in plugin storage and not written to gitops-tool state files.
+var SensitiveResponseFields = []string{
+	"client_token", "token", "secret_id", "password", "private_key",
+	"secret_key", "access_key", "session_token", "hmac_key",
+}
+
+// encryptedPrefix marks an encrypted value in stored state: prefix + base64(nonce + ciphertext).
+const encryptedPrefix = "vault-gitops:v1:"
+
+func isSensitiveField(name string) bool {
+	for _, f := range SensitiveResponseFields {
+		if strings.EqualFold(name, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepResponse returns the fields of data listed in keep (dotted paths, as in <name:key>
+// templates); nil keep keeps everything. Fields missing in data are skipped.
+func keepResponse(data interface{}, keep []string) interface{} {
+	if keep == nil || data == nil {
+		return data
+	}
+	out := make(map[string]interface{})
+	for _, path := range keep {
+		v, ok := getResponseDataPath(data, path)
+		if !ok {
+			continue
+		}
+		m := out
+		segments := strings.Split(path, ".")
+		for _, seg := range segments[:len(segments)-1] {
+			next, ok := m[seg].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				m[seg] = next
+			}
+			m = next
+		}
+		m[segments[len(segments)-1]] = v
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// mapSensitive returns a copy of v in which fn replaces the value of every sensitive field;
+// fn returning false drops the field.
+func mapSensitive(v interface{}, fn func(v interface{}) (interface{}, bool, error)) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			var err error
+			keep := true
+			if isSensitiveField(k) {
+				item, keep, err = fn(item)
+			} else {
+				item, err = mapSensitive(item, fn)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			if keep {
+				out[k] = item
+			}
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if out[i], err = mapSensitive(item, fn); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// mapStateSensitive returns a copy of state with fn applied to the sensitive fields of the
+// response and applied data of every entry. The copy is always of CurrentStateVersion.
+func mapStateSensitive(state *State, fn func(v interface{}) (interface{}, bool, error)) (*State, error) {
+	out := &State{Version: CurrentStateVersion, Resources: make(map[string]StateResource, len(state.Resources))}
+	for key, res := range state.Resources {
+		var err error
+		if res.ResponseData, err = mapSensitive(res.ResponseData, fn); err != nil {
+			return nil, fmt.Errorf("%s: response_data: %w", key, err)
+		}
+		if res.AppliedData, err = mapSensitive(res.AppliedData, fn); err != nil {
+			return nil, fmt.Errorf("%s: applied_data: %w", key, err)
+		}
+		out.Resources[key] = res
+	}
+	return out, nil
+}
+
+// RedactSensitive returns a copy of state without sensitive fields, for state kept outside Vault
+// (gitops-tool -state). Templates that refer to a dropped field fail on the next run.
+func RedactSensitive(state *State) *State {
+	out, _ := mapStateSensitive(state, func(interface{}) (interface{}, bool, error) {
+		return nil, false, nil
+	})
+	return out
+}
+
+// stateCipher encrypts sensitive state fields with AES-GCM.
+type stateCipher struct {
+	aead cipher.AEAD
+}
+
+// loadStateCipher returns the cipher keyed from StorageKeyStateKey, creating the secret if
+// create is set; nil if there is no secret yet.
+func loadStateCipher(ctx context.Context, storage logical.Storage, create bool) (*stateCipher, error) {
+	secret, err := util.GetString(ctx, storage, StorageKeyStateKey)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		if !create {
+			return nil, nil
+		}
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		secret = base64.StdEncoding.EncodeToString(b)
+		if err := util.PutString(ctx, storage, StorageKeyStateKey, secret); err != nil {
+			return nil, err
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("state key: %w", err)
+	}
+	key, err := hkdf.Key(sha256.New, raw, nil, "gitops state sensitive fields", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &stateCipher{aead: aead}, nil
+}
+
+func (c *stateCipher) encrypt(v interface{}) (interface{}, bool, error) {
+	if s, ok := v.(string); ok && strings.HasPrefix(s, encryptedPrefix) {
+		return v, true, nil
+	}
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return nil, false, err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, false, err
+	}
+	sealed := c.aead.Seal(nonce, nonce, plaintext, nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), true, nil
+}
+
+func (c *stateCipher) decrypt(v interface{}) (interface{}, bool, error) {
+	s, ok := v.(string)
+	if !ok || !strings.HasPrefix(s, encryptedPrefix) {
+		return v, true, nil
+	}
+	if c == nil {
+		return nil, false, fmt.Errorf("encrypted value without %s in storage", StorageKeyStateKey)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, encryptedPrefix))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return nil, false, fmt.Errorf("malformed encrypted value")
+	}
+	n := c.aead.NonceSize()
+	plaintext, err := c.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("decrypt: %w", err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(plaintext, &out); err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// LoadState reads the state from storage and decrypts its sensitive fields. State of an older
+// version is migrated in memory only; UpgradeState persists the migration.
+func LoadState(ctx context.Context, storage logical.Storage) (*State, error) {
+	entry, err := storage.Get(ctx, StorageKeyState)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get key %q from storage: %w", StorageKeyState, err)
+	}
+	state := &State{Version: CurrentStateVersion, Resources: make(map[string]StateResource)}
+	if entry != nil {
+		if state, err = UnmarshalState(entry.Value); err != nil {
+			return nil, err
+		}
+	}
+	c, err := loadStateCipher(ctx, storage, false)
+	if err != nil {
+		return nil, err
+	}
+	return mapStateSensitive(state, c.decrypt)
+}
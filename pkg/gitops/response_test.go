@@ -0,0 +1,91 @@
+package gitops
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_keepResponse(t *testing.T) {
+	data := map[string]interface{}{
+		"secret_id":          "s.1",
+		"secret_id_accessor": "acc",
+		"meta":               map[string]interface{}{"a": "1", "b": "2"},
+	}
+	tests := []struct {
+		keep []string
+		want interface{}
+	}{
+		{keep: nil, want: data},
+		{keep: []string{}, want: nil},
+		{keep: []string{"secret_id_accessor"}, want: map[string]interface{}{"secret_id_accessor": "acc"}},
+		{keep: []string{"meta.a", "missing"}, want: map[string]interface{}{"meta": map[string]interface{}{"a": "1"}}},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, keepResponse(data, tt.keep), "keep=%v", tt.keep)
+	}
+}
+
+func Test_StateEncryption(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	state := &State{Version: CurrentStateVersion, Resources: map[string]StateResource{
+		"approle": {Path: "auth/approle/role/app/secret-id", ResponseData: map[string]interface{}{
+			"secret_id":          "7f1c-secret",
+			"secret_id_accessor": "acc",
+			"nested":             map[string]interface{}{"Token": "hvs.x"},
+		}},
+	}}
+	writer := NewStorageStateWriter(storage)
+	require.NoError(t, writer.SaveState(ctx, state))
+
+	entry, err := storage.Get(ctx, StorageKeyState)
+	require.NoError(t, err)
+	require.NotContains(t, string(entry.Value), "7f1c-secret")
+	require.NotContains(t, string(entry.Value), "hvs.x")
+	require.Contains(t, string(entry.Value), `"secret_id_accessor":"acc"`)
+	require.Contains(t, string(entry.Value), encryptedPrefix)
+	require.Equal(t, "7f1c-secret", state.Resources["approle"].ResponseData.(map[string]interface{})["secret_id"], "the saved state is not modified")
+
+	loaded, err := LoadState(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, state, loaded)
+
+	// Saving a loaded state again (e.g. state/forget) and with a new writer keeps the same key.
+	require.NoError(t, NewStorageStateWriter(storage).SaveState(ctx, loaded))
+	loaded, err = LoadState(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, state, loaded)
+
+	require.NoError(t, storage.Delete(ctx, StorageKeyStateKey))
+	_, err = LoadState(ctx, storage)
+	require.ErrorContains(t, err, "encrypted value without gitops_state_key")
+
+	redacted := RedactSensitive(state)
+	require.Equal(t, map[string]interface{}{"secret_id_accessor": "acc", "nested": map[string]interface{}{}}, redacted.Resources["approle"].ResponseData)
+}
+
+func Test_Apply_KeepResponse(t *testing.T) {
+	client, _ := testVaultClient(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data": {"secret_id": "s.1", "secret_id_accessor": "acc", "secret_id_ttl": 0}}`))
+	})
+	resources := []Resource{
+		{Name: "sid", Path: "auth/approle/role/app/secret-id", Data: map[string]interface{}{}, KeepResponse: []string{"secret_id_accessor"}},
+		{Name: "meta", Path: "kv/meta", Dependencies: []string{"sid"}, Data: map[string]interface{}{"accessor": "<sid:secret_id_accessor>"}},
+	}
+	require.NoError(t, Lint(resources))
+	state := &State{Resources: map[string]StateResource{}}
+	_, err := Apply(context.Background(), resources, client, state, nil, ApplyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"secret_id_accessor": "acc"}, state.Resources["sid"].ResponseData)
+
+	resources[1].Data = map[string]interface{}{"id": "<sid:secret_id>"}
+	var rules []string
+	for _, d := range LintDiagnostics(resources, LintOptions{}) {
+		rules = append(rules, d.Rule)
+	}
+	require.Equal(t, []string{RuleInvalidKeepResponse}, rules)
+}
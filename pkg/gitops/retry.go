@@ -0,0 +1,218 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// RetryPolicy controls how Apply retries Vault requests that fail with a transient error.
+// It is set globally (ApplyOptions.Retry) and per resource ('retry:'); resource fields override global ones.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one; 0 = DefaultRetryMaxAttempts,
+	// 1 = no retries.
+	MaxAttempts int `yaml:"max_attempts,omitempty"`
+	// Backoff is the delay before the first retry (Go duration, default 1s); it doubles with every retry.
+	Backoff string `yaml:"backoff,omitempty"`
+	// MaxBackoff caps the delay, including one requested with Retry-After (default 30s).
+	MaxBackoff string `yaml:"max_backoff,omitempty"`
+	// RetryOn lists the HTTP status codes that are retried (default DefaultRetryOn).
+	// Errors without a response (connection refused, timeout) are always retryable.
+	RetryOn []int `yaml:"retry_on,omitempty"`
+}
+
+// DefaultRetryOn are the status codes retried when RetryOn is empty: rate limit and unavailable/standby Vault.
+var DefaultRetryOn = []int{429, 500, 502, 503, 504}
+
+// DefaultRetryMaxAttempts is the number of attempts when MaxAttempts is not set: a single 503
+// during a standby failover or a 429 does not fail the commit.
+const DefaultRetryMaxAttempts = 3
+
+const (
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = 30 * time.Second
+)
+
+// Merge returns p with the fields set in override replacing its own.
+func (p RetryPolicy) Merge(override *RetryPolicy) RetryPolicy {
+	if override == nil {
+		return p
+	}
+	if override.MaxAttempts != 0 {
+		p.MaxAttempts = override.MaxAttempts
+	}
+	if override.Backoff != "" {
+		p.Backoff = override.Backoff
+	}
+	if override.MaxBackoff != "" {
+		p.MaxBackoff = override.MaxBackoff
+	}
+	if len(override.RetryOn) > 0 {
+		p.RetryOn = override.RetryOn
+	}
+	return p
+}
+
+// Validate checks attempts, durations and status codes.
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("max_attempts must be non-negative")
+	}
+	for name, s := range map[string]string{"backoff": p.Backoff, "max_backoff": p.MaxBackoff} {
+		if s == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			return fmt.Errorf("%s must be a positive duration (e.g. 2s), got %q", name, s)
+		}
+	}
+	for _, code := range p.RetryOn {
+		if code < 400 || code > 599 {
+			return fmt.Errorf("retry_on: %d is not an HTTP error status", code)
+		}
+	}
+	return nil
+}
+
+// ParseRetryOn parses a comma-separated list of status codes ("429,503").
+func ParseRetryOn(s string) ([]int, error) {
+	var codes []int
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		code, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code %q", part)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// maxAttempts returns MaxAttempts, or DefaultRetryMaxAttempts if it is not set.
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts == 0 {
+		return DefaultRetryMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	respErr, ok := err.(*api.ResponseError)
+	if !ok {
+		return true
+	}
+	codes := p.RetryOn
+	if len(codes) == 0 {
+		codes = DefaultRetryOn
+	}
+	for _, code := range codes {
+		if respErr.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the wait before retry number n (1-based): Retry-After if the response had it,
+// otherwise Backoff doubled n-1 times; both capped at MaxBackoff.
+func (p RetryPolicy) delay(n int, retryAfter string) time.Duration {
+	backoff, maxBackoff := defaultRetryBackoff, defaultRetryMaxBackoff
+	if d, err := time.ParseDuration(p.Backoff); err == nil && d > 0 {
+		backoff = d
+	}
+	if d, err := time.ParseDuration(p.MaxBackoff); err == nil && d > 0 {
+		maxBackoff = d
+	}
+	d, ok := parseRetryAfter(retryAfter)
+	if !ok {
+		d = backoff
+		for i := 1; i < n && d < maxBackoff; i++ {
+			d *= 2
+		}
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// parseRetryAfter parses a Retry-After header: seconds or an HTTP date.
+func parseRetryAfter(s string) (time.Duration, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	if sec, err := strconv.Atoi(s); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second, true
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// do calls fn until it succeeds, fails with a non-retryable error or runs out of attempts.
+// Every retry increments retries.
+func (p RetryPolicy) do(ctx context.Context, retries *atomic.Int64, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		var retryAfter string
+		err := fn(context.WithValue(ctx, retryAfterKey{}, &retryAfter))
+		if err == nil || attempt >= p.maxAttempts() || ctx.Err() != nil || !p.retryable(err) {
+			return err
+		}
+		retries.Add(1)
+		timer := time.NewTimer(p.delay(attempt, retryAfter))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryAfterKey holds a *string in a request context; retryAfterTransport stores the
+// Retry-After header of the response in it.
+type retryAfterKey struct{}
+
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if p, ok := req.Context().Value(retryAfterKey{}).(*string); ok && resp != nil {
+		*p = resp.Header.Get("Retry-After")
+	}
+	return resp, err
+}
+
+// withRetryAfter returns a copy of client whose responses report Retry-After to RetryPolicy.do.
+// The retries of the Vault client itself are turned off: RetryPolicy is the only retry layer.
+func withRetryAfter(client *api.Client) (*api.Client, error) {
+	cfg := client.CloneConfig()
+	cfg.MaxRetries = 0
+	cfg.HttpClient.Transport = &retryAfterTransport{base: cfg.HttpClient.Transport}
+	c, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("vault client: %w", err)
+	}
+	c.SetToken(client.Token())
+	c.SetHeaders(client.Headers())
+	return c, nil
+}
@@ -0,0 +1,135 @@
+package gitops
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RetryPolicy_delay(t *testing.T) {
+	p := RetryPolicy{Backoff: "1s", MaxBackoff: "5s"}
+	tests := []struct {
+		n          int
+		retryAfter string
+		want       time.Duration
+	}{
+		{n: 1, want: time.Second},
+		{n: 2, want: 2 * time.Second},
+		{n: 3, want: 4 * time.Second},
+		{n: 4, want: 5 * time.Second},
+		{n: 1, retryAfter: "3", want: 3 * time.Second},
+		{n: 1, retryAfter: "120", want: 5 * time.Second},
+		{n: 2, retryAfter: "soon", want: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, p.delay(tt.n, tt.retryAfter), "n=%d retry-after=%q", tt.n, tt.retryAfter)
+	}
+	require.Equal(t, defaultRetryBackoff, RetryPolicy{}.delay(1, ""))
+}
+
+func Test_RetryPolicy_retryable(t *testing.T) {
+	require.True(t, RetryPolicy{}.retryable(&api.ResponseError{StatusCode: 503}))
+	require.False(t, RetryPolicy{}.retryable(&api.ResponseError{StatusCode: 400}))
+	require.True(t, RetryPolicy{RetryOn: []int{400}}.retryable(&api.ResponseError{StatusCode: 400}))
+	require.False(t, RetryPolicy{RetryOn: []int{400}}.retryable(&api.ResponseError{StatusCode: 503}))
+	require.True(t, RetryPolicy{}.retryable(context.DeadlineExceeded), "errors without a response")
+
+	require.NoError(t, RetryPolicy{MaxAttempts: 3, Backoff: "500ms", RetryOn: []int{429}}.Validate())
+	require.Error(t, RetryPolicy{Backoff: "1"}.Validate())
+	require.Error(t, RetryPolicy{RetryOn: []int{200}}.Validate())
+	require.Error(t, RetryPolicy{MaxAttempts: -1}.Validate())
+}
+
+func Test_Apply_Retry(t *testing.T) {
+	failures := map[string]int{"/v1/sys/policies/acl/a": 2, "/v1/sys/policies/acl/b": 5}
+	client, requests := testVaultClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if failures[r.URL.Path] > 0 {
+			failures[r.URL.Path]--
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"errors": ["Vault is sealed"]}`))
+			return
+		}
+		if r.URL.Path == "/v1/sys/policies/acl/invalid" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errors": ["invalid"]}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ctx := context.Background()
+	opts := ApplyOptions{Retry: RetryPolicy{MaxAttempts: 3, Backoff: "1ms"}}
+
+	resources := []Resource{
+		{Name: "a", Path: "sys/policies/acl/a", Data: map[string]interface{}{}},
+		{Name: "b", Path: "sys/policies/acl/b", Data: map[string]interface{}{}, Retry: &RetryPolicy{MaxAttempts: 6}},
+	}
+	state := &State{Resources: map[string]StateResource{}}
+	result, err := Apply(ctx, resources, client, state, nil, opts)
+	require.NoError(t, err)
+	require.Equal(t, 7, result.Retries)
+	require.Len(t, *requests, 9)
+	require.Len(t, state.Resources, 2)
+
+	*requests = nil
+	failures["/v1/sys/policies/acl/c"] = 5
+	resources = []Resource{
+		{Name: "c", Path: "sys/policies/acl/c", Data: map[string]interface{}{}},
+		{Name: "invalid", Path: "sys/policies/acl/invalid", Data: map[string]interface{}{}, IgnoreFailures: true},
+	}
+	result, err = Apply(ctx, resources, client, &State{Resources: map[string]StateResource{}}, nil, opts)
+	require.ErrorContains(t, err, "sys/policies/acl/c: 503")
+	require.Equal(t, 2, result.Retries)
+	require.Equal(t, []string{"PUT /v1/sys/policies/acl/c", "PUT /v1/sys/policies/acl/c", "PUT /v1/sys/policies/acl/c"}, *requests)
+
+	*requests = nil
+	result, err = Apply(ctx, resources[1:], client, &State{Resources: map[string]StateResource{}}, nil, opts)
+	require.NoError(t, err)
+	require.Zero(t, result.Retries, "400 is not retried")
+	require.Len(t, *requests, 1)
+}
+
+func Test_Apply_Retry_NoClientRetries(t *testing.T) {
+	client, requests := testVaultClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"errors": ["Vault is sealed"]}`))
+	})
+	// The default of the Vault client: 2 retries of 5xx responses.
+	client.SetMaxRetries(2)
+	client.SetMinRetryWait(time.Millisecond)
+	client.SetMaxRetryWait(time.Millisecond)
+
+	resources := []Resource{{Name: "a", Path: "sys/policies/acl/a", Data: map[string]interface{}{}}}
+	result, err := Apply(context.Background(), resources, client, &State{Resources: map[string]StateResource{}}, nil, ApplyOptions{Retry: RetryPolicy{MaxAttempts: 2, Backoff: "1ms"}})
+	require.ErrorContains(t, err, "503")
+	require.Equal(t, 1, result.Retries)
+	require.Len(t, *requests, 2, "only RetryPolicy retries")
+}
+
+func Test_Apply_Retry_Default(t *testing.T) {
+	failed := false
+	client, requests := testVaultClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if !failed {
+			failed = true
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"errors": ["Vault is sealed"]}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	config := Configuration{}
+	resources := []Resource{{Name: "a", Path: "sys/policies/acl/a", Data: map[string]interface{}{}}}
+	result, err := Apply(context.Background(), resources, client, &State{Resources: map[string]StateResource{}}, nil, ApplyOptions{Retry: config.RetryPolicy()})
+	require.NoError(t, err, "a default configuration survives one 503")
+	require.Equal(t, 1, result.Retries)
+	require.Len(t, *requests, 2)
+
+	require.Equal(t, 1, RetryPolicy{MaxAttempts: 1}.maxAttempts())
+	require.Equal(t, DefaultRetryMaxAttempts, RetryPolicy{}.Merge(&RetryPolicy{Backoff: "2s"}).maxAttempts())
+}
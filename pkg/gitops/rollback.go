@@ -0,0 +1,143 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// HistoryRollback is the history action of a change undone by an atomic run.
+const HistoryRollback = "rollback"
+
+// change is one Vault change made by an atomic run (ApplyOptions.Atomic); rollback undoes it.
+type change struct {
+	action    PlanAction // PlanCreate, PlanUpdate or PlanDelete
+	key       string
+	namespace string
+	path      string
+	method    string // request method that restores prev
+	retry     RetryPolicy
+	// prev is the data written back by rollback of an update or delete: the declared data of
+	// the previous apply (StateResource.AppliedData) or, if unknown, what Vault returned before
+	// the change. nil = cannot be restored.
+	prev interface{}
+}
+
+// priorData returns the data to restore path with: the declared data from the previous apply,
+// else the current value read from Vault; nil if neither is available.
+func (a *applier) priorData(reqClient *api.Client, path string, applied interface{}, retry RetryPolicy) interface{} {
+	if applied != nil {
+		return applied
+	}
+	var secret *api.Secret
+	err := retry.do(a.ctx, &a.retries, func(ctx context.Context) (err error) {
+		secret, err = reqClient.Logical().ReadWithContext(ctx, strings.TrimPrefix(path, "/"))
+		return err
+	})
+	if err != nil || secret == nil || secret.Data == nil {
+		return nil
+	}
+	return secret.Data
+}
+
+// record adds a change to the journal; a.mu must be held.
+func (a *applier) record(c change) {
+	a.journal = append(a.journal, c)
+}
+
+// rollback undoes the changes of the run in reverse order after cause stopped it, records every
+// rollback action in history and restores the state from before the run; entries of changes that
+// could not be undone keep their current state. It returns cause with a summary of the rollback.
+func (a *applier) rollback(cause error) error {
+	if !a.opts.Atomic || len(a.journal) == 0 {
+		return cause
+	}
+	// The run may have been stopped by a cancelled context; the rollback still has to finish.
+	ctx := context.WithoutCancel(a.ctx)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var failed []string
+	kept := make(map[string]bool)
+	for i := len(a.journal) - 1; i >= 0; i-- {
+		c := a.journal[i]
+		detail, err := a.undo(ctx, c)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s %s%s: %v", c.action, c.namespace, c.path, err))
+			kept[c.key] = true
+			detail = "failed: " + err.Error()
+		} else {
+			a.rolledBack++
+		}
+		if a.history != nil {
+			if err := a.history.RecordHistory(ctx, HistoryEntry{Commit: a.opts.Commit, Action: HistoryRollback, Key: c.key, Namespace: c.namespace, Path: c.path, Detail: detail}); err != nil {
+				failed = append(failed, fmt.Sprintf("record history of %s: %v", c.key, err))
+			}
+		}
+	}
+
+	restored := make(map[string]StateResource, len(a.snapshot))
+	for key, res := range a.snapshot {
+		if !kept[key] {
+			restored[key] = res
+		}
+	}
+	for key := range kept {
+		if res, ok := a.state.Resources[key]; ok {
+			restored[key] = res
+		}
+	}
+	a.state.Resources = restored
+	if a.writer != nil {
+		if err := a.writer.SaveState(ctx, a.state); err != nil {
+			failed = append(failed, fmt.Sprintf("save state: %v", err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%w; rollback incomplete: %s", cause, strings.Join(failed, "; "))
+	}
+	return fmt.Errorf("%w; rolled back %d change(s)", cause, a.rolledBack)
+}
+
+// undo reverts one change and describes what was done.
+func (a *applier) undo(ctx context.Context, c change) (string, error) {
+	reqClient := a.client
+	if c.namespace != "" {
+		reqClient = a.client.WithNamespace(strings.TrimSuffix(c.namespace, "/"))
+	}
+	if c.action == PlanCreate {
+		method, path, data, ok, err := deleteRequest(a.state.Resources[c.key], a.state)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("delete: none, the created resource is kept")
+		}
+		err = c.retry.do(ctx, &a.retries, func(ctx context.Context) error {
+			_, err := send(ctx, reqClient, method, strings.TrimPrefix(path, "/"), data)
+			return err
+		})
+		if respErr, ok := err.(*api.ResponseError); ok && (respErr.StatusCode == 404 || respErr.StatusCode == 405) {
+			err = nil
+		}
+		return "deleted created resource", err
+	}
+	if c.prev == nil {
+		return "", fmt.Errorf("previous data is unknown")
+	}
+	dataMap, err := dataToDataMap(c.prev)
+	if err != nil {
+		return "", err
+	}
+	err = c.retry.do(ctx, &a.retries, func(ctx context.Context) error {
+		_, err := send(ctx, reqClient, c.method, strings.TrimPrefix(c.path, "/"), dataMap)
+		return err
+	})
+	if c.action == PlanDelete {
+		return "recreated deleted resource", err
+	}
+	return "restored previous data", err
+}
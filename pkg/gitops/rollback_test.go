@@ -0,0 +1,120 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVaultStore serves GET, PUT and DELETE from an in-memory map of path -> JSON data;
+// paths in fail return the given status.
+func fakeVaultStore(store map[string]string, fail map[string]int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v1/")
+		if status, ok := fail[r.Method+" "+path]; ok {
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"errors": ["failed"]}`))
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := store[path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errors": []}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"data": ` + data + `}`))
+		case http.MethodPut, http.MethodPost:
+			body, _ := io.ReadAll(r.Body)
+			store[path] = string(body)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			delete(store, path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+func Test_Apply_Atomic(t *testing.T) {
+	store := map[string]string{}
+	fail := map[string]int{}
+	client, _ := testVaultClient(t, fakeVaultStore(store, fail))
+	ctx := context.Background()
+	data := func(v int) map[string]interface{} { return map[string]interface{}{"v": v} }
+
+	storage := &logical.InmemStorage{}
+	writer := NewStorageStateWriter(storage)
+	state := &State{Resources: map[string]StateResource{}}
+	v1 := []Resource{
+		{Name: "a", Path: "kv/a", Data: data(1)},
+		{Name: "b", Path: "kv/b", Data: data(1)},
+		{Name: "old", Path: "kv/old", Data: data(1)},
+		{Name: "stuck", Path: "kv/stuck", Data: data(1), Dependencies: []string{"old"}}, // deleted after old
+	}
+	_, err := Apply(ctx, v1, client, state, writer, ApplyOptions{Atomic: true, Commit: "c1"})
+	require.NoError(t, err)
+	require.Equal(t, data(1), state.Resources["a"].AppliedData)
+	before := map[string]string{}
+	for k, v := range store {
+		before[k] = v
+	}
+	stateBefore, err := json.Marshal(state)
+	require.NoError(t, err)
+
+	// a is updated, c created, old deleted; deleting stuck fails.
+	fail["DELETE kv/stuck"] = http.StatusBadRequest
+	v2 := []Resource{
+		{Name: "a", Path: "kv/a", Data: data(2)},
+		{Name: "b", Path: "kv/b", Data: data(1)},
+		{Name: "c", Path: "kv/c", Data: data(1)},
+	}
+	result, err := Apply(ctx, v2, client, state, writer, ApplyOptions{Atomic: true, Commit: "c2"})
+	require.ErrorContains(t, err, "kv/stuck: 400")
+	require.ErrorContains(t, err, "rolled back 3 change(s)")
+	require.Equal(t, 3, result.RolledBack)
+	require.Equal(t, before, store)
+	stateAfter, err := json.Marshal(state)
+	require.NoError(t, err)
+	require.JSONEq(t, string(stateBefore), string(stateAfter))
+
+	history, err := GetHistory(ctx, storage)
+	require.NoError(t, err)
+	var rollbacks []string
+	for _, e := range history {
+		if e.Action == HistoryRollback {
+			require.Equal(t, "c2", e.Commit)
+			rollbacks = append(rollbacks, e.Key+": "+e.Detail)
+		}
+	}
+	require.Equal(t, []string{"old: recreated deleted resource", "c: deleted created resource", "a: restored previous data"}, rollbacks)
+
+	// Without declared data in state, the previous value is read from Vault before the update.
+	delete(fail, "DELETE kv/stuck")
+	state = &State{Resources: map[string]StateResource{}}
+	_, err = Apply(ctx, v1[:2], client, state, nil, ApplyOptions{MaxDeletions: "0"})
+	require.NoError(t, err)
+	require.Nil(t, state.Resources["a"].AppliedData)
+	fail["PUT kv/broken"] = http.StatusBadRequest
+	v3 := []Resource{
+		{Name: "a", Path: "kv/a", Data: data(3)},
+		{Name: "broken", Path: "kv/broken", Data: data(1), Dependencies: []string{"a"}},
+	}
+	_, err = Apply(ctx, v3, client, state, nil, ApplyOptions{Atomic: true})
+	require.ErrorContains(t, err, "rolled back 1 change(s)")
+	require.JSONEq(t, `{"v": 1}`, store["kv/a"])
+	require.Nil(t, state.Resources["a"].AppliedData, "state is restored from before the run")
+
+	// A change that cannot be undone is reported and keeps its state entry.
+	delete(store, "kv/a")
+	state.Resources["a"] = StateResource{DataDigest: "x", Path: "kv/a"}
+	_, err = Apply(ctx, v3, client, state, nil, ApplyOptions{Atomic: true})
+	require.ErrorContains(t, err, "rollback incomplete: update kv/a: previous data is unknown")
+	require.Equal(t, dataDigestWithRevision(data(3), 0), state.Resources["a"].DataDigest)
+}
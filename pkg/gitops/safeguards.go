@@ -0,0 +1,113 @@
+package gitops
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AllowDestroyMarker in a commit message permits deleting mounts and auth methods in that run.
+const AllowDestroyMarker = "[allow_destroy]"
+
+// ApplyOptions are optional settings for Apply.
+type ApplyOptions struct {
+	// MaxDeletions limits how many state entries one run may delete: a count ("5") or a
+	// percentage of the entries in state ("20%", rounded down); empty = no limit.
+	MaxDeletions string
+	// AllowDestroy permits deleting mounts and auth methods (sys/mounts/*, sys/auth/*).
+	AllowDestroy bool
+	// Commit is the hash of the commit being applied, recorded in history.
+	Commit string
+	// Concurrency is how many independent resources are applied at a time; 0 or 1 = one by one.
+	Concurrency int
+	// Retry is the retry policy for transient Vault errors; a resource's 'retry' overrides its fields.
+	Retry RetryPolicy
+	// Atomic rolls back the Vault changes of the run when a resource fails (see rollback).
+	Atomic bool
+}
+
+// DeletionBlockedError is returned when deletions would violate a safeguard; nothing is applied.
+type DeletionBlockedError struct {
+	Reasons []string
+}
+
+func (e *DeletionBlockedError) Error() string {
+	return "deletion blocked: " + strings.Join(e.Reasons, "; ")
+}
+
+// ParseMaxDeletions returns the deletion limit for a state of total entries, or -1 for no limit.
+func ParseMaxDeletions(s string, total int) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return -1, nil
+	}
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		n, err := strconv.Atoi(strings.TrimSpace(pct))
+		if err != nil || n < 0 || n > 100 {
+			return 0, fmt.Errorf("max deletions %q: percentage must be between 0%% and 100%%", s)
+		}
+		return total * n / 100, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("max deletions %q: must be a non-negative number or a percentage", s)
+	}
+	return n, nil
+}
+
+// isMountPath reports whether deleting path disables a secrets engine or an auth method.
+func isMountPath(path string) bool {
+	p := normalizePath(path)
+	if strings.HasSuffix(p, "/tune") {
+		return false
+	}
+	for _, prefix := range []string{"sys/mounts/", "sys/auth/"} {
+		if strings.HasPrefix(p, prefix) && len(p) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckDeletions checks the deletes of a plan against the safeguards: resources with
+// prevent_destroy, the MaxDeletions limit and mount/auth deletions without AllowDestroy.
+// Deletes with 'delete: none' change nothing in Vault and are not checked.
+// It returns a *DeletionBlockedError listing every violation.
+func CheckDeletions(changes []PlanChange, state *State, opts ApplyOptions) error {
+	total := 0
+	if state != nil {
+		total = len(state.Resources)
+	}
+	limit, err := ParseMaxDeletions(opts.MaxDeletions, total)
+	if err != nil {
+		return err
+	}
+	var reasons, mounts []string
+	deletes := 0
+	for _, c := range changes {
+		if c.Action != PlanDelete || (c.Delete != nil && c.Delete.None) {
+			continue
+		}
+		deletes++
+		if state != nil && state.Resources[c.Key].PreventDestroy {
+			reasons = append(reasons, fmt.Sprintf("resource %s (%s%s) has prevent_destroy", c.Key, c.Namespace, c.Path))
+		}
+		path := c.Path
+		if c.Delete != nil && c.Delete.Path != "" {
+			path = c.Delete.Path
+		}
+		if isMountPath(path) && !opts.AllowDestroy {
+			mounts = append(mounts, c.Namespace+path)
+		}
+	}
+	if limit >= 0 && deletes > limit {
+		reasons = append(reasons, fmt.Sprintf("%d resources to delete, max_deletions_per_run is %s (%d of %d in state)", deletes, opts.MaxDeletions, limit, total))
+	}
+	if len(mounts) > 0 {
+		reasons = append(reasons, fmt.Sprintf("deleting mounts or auth methods (%s) requires %s in the commit message or the destroy signature quorum", strings.Join(mounts, ", "), AllowDestroyMarker))
+	}
+	if len(reasons) > 0 {
+		return &DeletionBlockedError{Reasons: reasons}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package gitops
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CheckDeletions(t *testing.T) {
+	state := &State{Resources: map[string]StateResource{
+		"kv":        {Path: "sys/mounts/kv"},
+		"kv-tune":   {Path: "sys/mounts/kv/tune"},
+		"approle":   {Path: "sys/auth/approle"},
+		"reader":    {Path: "sys/policies/acl/reader"},
+		"writer":    {Path: "sys/policies/acl/writer", PreventDestroy: true},
+		"role":      {Path: "auth/approle/role/app"},
+		"role2":     {Path: "auth/approle/role/app2"},
+		"role3":     {Path: "auth/approle/role/app3"},
+		"role4":     {Path: "auth/approle/role/app4"},
+		"role5":     {Path: "auth/approle/role/app5"},
+		"unrelated": {Path: "secret/data/x"},
+	}}
+	keep := func(keys ...string) []Resource {
+		var resources []Resource
+		for _, k := range keys {
+			resources = append(resources, Resource{Name: k, Path: state.Resources[k].Path, Data: map[string]interface{}{}})
+		}
+		return resources
+	}
+	all := []string{"kv", "kv-tune", "approle", "reader", "writer", "role", "role2", "role3", "role4", "role5", "unrelated"}
+
+	tests := []struct {
+		description string
+		resources   []Resource
+		opts        ApplyOptions
+		blocked     []string // substrings of the error
+	}{
+		{description: "no deletes", resources: keep(all...), opts: ApplyOptions{MaxDeletions: "0"}},
+		{description: "plain delete", resources: keep("kv", "kv-tune", "approle", "writer", "role", "role2", "role3", "role4", "role5", "unrelated"), opts: ApplyOptions{MaxDeletions: "1"}},
+		{description: "auth method needs allow destroy", resources: keep("kv", "kv-tune", "reader", "writer", "role", "role2", "role3", "role4", "role5", "unrelated"), blocked: []string{"sys/auth/approle"}},
+		{description: "tune is not a mount", resources: keep("kv", "approle", "reader", "writer", "role", "role2", "role3", "role4", "role5", "unrelated")},
+		{description: "prevent destroy", resources: keep("kv", "kv-tune", "approle", "reader", "role", "role2", "role3", "role4", "role5", "unrelated"), opts: ApplyOptions{AllowDestroy: true}, blocked: []string{"writer", "prevent_destroy"}},
+		{description: "mount needs allow destroy", resources: keep("kv-tune", "approle", "reader", "writer", "role", "role2", "role3", "role4", "role5", "unrelated"), blocked: []string{"sys/mounts/kv", AllowDestroyMarker}},
+		{description: "mount with allow destroy", resources: keep("kv-tune", "approle", "reader", "writer", "role", "role2", "role3", "role4", "role5", "unrelated"), opts: ApplyOptions{AllowDestroy: true}},
+		{description: "count limit", resources: keep("kv", "kv-tune", "approle", "reader", "writer", "unrelated"), opts: ApplyOptions{MaxDeletions: "4"}, blocked: []string{"5 resources to delete"}},
+		{description: "count within limit", resources: keep("kv", "kv-tune", "approle", "reader", "writer", "unrelated"), opts: ApplyOptions{MaxDeletions: "5"}},
+		{description: "percentage limit", resources: keep("kv", "kv-tune", "approle", "reader", "writer", "role", "unrelated"), opts: ApplyOptions{MaxDeletions: "30%"}, blocked: []string{"(3 of 11 in state)"}},
+		{description: "percentage within limit", resources: keep("kv", "kv-tune", "approle", "reader", "writer", "role", "role2", "unrelated"), opts: ApplyOptions{MaxDeletions: "30%"}},
+		{description: "changed path wipes everything", resources: nil, opts: ApplyOptions{MaxDeletions: "10%", AllowDestroy: true}, blocked: []string{"11 resources to delete", "prevent_destroy"}},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			changes, err := Plan(test.resources, state)
+			require.NoError(t, err)
+			err = CheckDeletions(changes, state, test.opts)
+			if len(test.blocked) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			var blocked *DeletionBlockedError
+			require.True(t, errors.As(err, &blocked), "expected DeletionBlockedError, got %v", err)
+			for _, s := range test.blocked {
+				require.Contains(t, err.Error(), s)
+			}
+		})
+	}
+}
+
+func Test_ParseMaxDeletions(t *testing.T) {
+	tests := []struct {
+		value string
+		total int
+		want  int
+		err   bool
+	}{
+		{value: "", total: 10, want: -1},
+		{value: "3", total: 10, want: 3},
+		{value: " 25% ", total: 10, want: 2},
+		{value: "100%", total: 7, want: 7},
+		{value: "0%", total: 7, want: 0},
+		{value: "-1", err: true},
+		{value: "101%", err: true},
+		{value: "ten", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := ParseMaxDeletions(test.value, test.total)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
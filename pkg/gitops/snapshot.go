@@ -0,0 +1,68 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/trublast/vault-plugin-gitops/pkg/util"
+)
+
+const (
+	// StorageKeyStateSnapshots is the list of state snapshots; the snapshots themselves are
+	// stored under StorageKeyStateSnapshotPrefix + commit hash and seal-wrapped.
+	StorageKeyStateSnapshots      = "gitops_state_snapshots"
+	StorageKeyStateSnapshotPrefix = "gitops_state_snapshot/"
+
+	// MaxStateSnapshots is how many snapshots are kept; older ones are deleted.
+	MaxStateSnapshots = 20
+)
+
+var stateSnapshots = util.SnapshotStore{
+	IndexKey: StorageKeyStateSnapshots,
+	Prefix:   StorageKeyStateSnapshotPrefix,
+	Max:      MaxStateSnapshots,
+}
+
+// SnapshotState copies the stored state (as stored: sensitive fields stay encrypted) to the
+// snapshot of commit. Called after a successful apply.
+func SnapshotState(ctx context.Context, storage logical.Storage, commit string) error {
+	entry, err := storage.Get(ctx, StorageKeyState)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return nil
+	}
+	return stateSnapshots.Save(ctx, storage, commit, entry.Value)
+}
+
+// GetStateSnapshots returns the state snapshots, oldest first.
+func GetStateSnapshots(ctx context.Context, storage logical.Storage) ([]util.Snapshot, error) {
+	return stateSnapshots.List(ctx, storage)
+}
+
+// RestoreState replaces the stored state with the snapshot of commit, migrated to
+// CurrentStateVersion, and returns the restored state. Nothing is changed in Vault: the next
+// apply plans against the restored state. Callers must hold the stateLock of the backend.
+func RestoreState(ctx context.Context, storage logical.Storage, commit string) (*State, error) {
+	data, err := stateSnapshots.Get(ctx, storage, commit)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("no state snapshot of commit %q", commit)
+	}
+	if data, _, err = migrateState(data); err != nil {
+		return nil, err
+	}
+	state, err := UnmarshalState(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.Put(ctx, &logical.StorageEntry{Key: StorageKeyState, Value: data}); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
@@ -0,0 +1,138 @@
+package gitops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// CurrentStateVersion is the version of the state format written by this plugin. State of an
+// older version is migrated on load (stateMigrations); state of a newer version is rejected.
+const CurrentStateVersion = 1
+
+// StorageKeyStateBackupPrefix prefixes the copies of the stored state taken before a migration:
+// the state of version N is kept unchanged under StorageKeyStateBackupPrefix + "vN".
+const StorageKeyStateBackupPrefix = "gitops_state_backup/"
+
+// stateMigration upgrades the decoded JSON of a stored state by one version.
+type stateMigration struct {
+	description string
+	migrate     func(state map[string]interface{}) error
+}
+
+// stateMigrations[i] upgrades state of version i to version i+1. Migrations work on the raw
+// JSON, so they do not depend on the current State type and never see decrypted values.
+var stateMigrations = []stateMigration{
+	{description: "normalize namespace and path of state entries", migrate: migrateStateV1},
+}
+
+// migrateStateV1 upgrades unversioned state: resources is always an object, and namespace and
+// path of every entry are normalized with stateLocation, as entries are written now.
+func migrateStateV1(state map[string]interface{}) error {
+	resources, ok := state["resources"].(map[string]interface{})
+	if state["resources"] != nil && !ok {
+		return fmt.Errorf("resources: expected an object")
+	}
+	if resources == nil {
+		resources = make(map[string]interface{})
+		state["resources"] = resources
+	}
+	for key, v := range resources {
+		entry, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("resources: %s: expected an object", key)
+		}
+		ns, _ := entry["namespace"].(string)
+		path, _ := entry["path"].(string)
+		ns, path = stateLocation(ns, path)
+		if _, ok := entry["namespace"]; ok {
+			entry["namespace"] = ns
+		}
+		if _, ok := entry["path"]; ok {
+			entry["path"] = path
+		}
+	}
+	return nil
+}
+
+// migrateState upgrades stored state JSON to CurrentStateVersion. It returns the version of
+// the input; data is returned unchanged if it is already current.
+func migrateState(data []byte) ([]byte, int, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, 0, fmt.Errorf("decode state: %w", err)
+	}
+	version := 0
+	if v, ok := doc["version"]; ok {
+		n, ok := v.(json.Number)
+		i, err := n.Int64()
+		if !ok || err != nil || i < 0 {
+			return nil, 0, fmt.Errorf("invalid state version %v", v)
+		}
+		version = int(i)
+	}
+	if version > CurrentStateVersion {
+		return nil, version, fmt.Errorf("state version %d is newer than %d supported by this plugin version, upgrade the plugin", version, CurrentStateVersion)
+	}
+	if version == CurrentStateVersion {
+		return data, version, nil
+	}
+	for v := version; v < CurrentStateVersion; v++ {
+		if err := stateMigrations[v].migrate(doc); err != nil {
+			return nil, version, fmt.Errorf("migrate state to version %d (%s): %w", v+1, stateMigrations[v].description, err)
+		}
+	}
+	doc["version"] = CurrentStateVersion
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, version, err
+	}
+	return out, version, nil
+}
+
+// UnmarshalState decodes state JSON (a stored state or a gitops-tool state file), migrating it
+// to CurrentStateVersion in memory. Sensitive fields are not decrypted.
+func UnmarshalState(data []byte) (*State, error) {
+	data, _, err := migrateState(data)
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.Resources == nil {
+		state.Resources = make(map[string]StateResource)
+	}
+	return &state, nil
+}
+
+// UpgradeState migrates the stored state to CurrentStateVersion. Before the migrated state is
+// written, the stored state is copied unchanged to StorageKeyStateBackupPrefix + "v<version>".
+// It returns the version the state had; callers must hold the stateLock of the backend.
+func UpgradeState(ctx context.Context, storage logical.Storage) (int, error) {
+	entry, err := storage.Get(ctx, StorageKeyState)
+	if err != nil {
+		return 0, err
+	}
+	if entry == nil {
+		return CurrentStateVersion, nil
+	}
+	data, version, err := migrateState(entry.Value)
+	if err != nil || version == CurrentStateVersion {
+		return version, err
+	}
+	backupKey := fmt.Sprintf("%sv%d", StorageKeyStateBackupPrefix, version)
+	if err := storage.Put(ctx, &logical.StorageEntry{Key: backupKey, Value: entry.Value}); err != nil {
+		return version, fmt.Errorf("back up state to %s: %w", backupKey, err)
+	}
+	if err := storage.Put(ctx, &logical.StorageEntry{Key: StorageKeyState, Value: data}); err != nil {
+		return version, fmt.Errorf("save migrated state: %w", err)
+	}
+	return version, nil
+}
@@ -0,0 +1,82 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_migrateStateV1(t *testing.T) {
+	tests := []struct {
+		description string
+		state       string
+		want        string
+		err         string
+	}{
+		{description: "null resources", state: `{"resources": null}`, want: `{"resources": {}}`},
+		{description: "no resources", state: `{}`, want: `{"resources": {}}`},
+		{
+			description: "namespace and path",
+			state:       `{"resources": {"a": {"namespace": "/team", "path": "/kv/a/", "data_digest": "d"}, "b": {"path": "kv/b"}, "c": {"namespace": "/", "path": "kv/c"}}}`,
+			want:        `{"resources": {"a": {"namespace": "team/", "path": "kv/a", "data_digest": "d"}, "b": {"path": "kv/b"}, "c": {"namespace": "", "path": "kv/c"}}}`,
+		},
+		{description: "invalid entry", state: `{"resources": {"a": 1}}`, err: "resources: a: expected an object"},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var state map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(test.state), &state))
+			err := migrateStateV1(state)
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			got, err := json.Marshal(state)
+			require.NoError(t, err)
+			require.JSONEq(t, test.want, string(got))
+		})
+	}
+}
+
+func Test_UpgradeState(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	unversioned := []byte(`{"resources": {"a": {"namespace": "team", "path": "/kv/a", "response_data": {"n": 9007199254740993}}}}`)
+	require.NoError(t, storage.Put(ctx, &logical.StorageEntry{Key: StorageKeyState, Value: unversioned}))
+
+	// Loading migrates in memory only.
+	state, err := LoadState(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, CurrentStateVersion, state.Version)
+	require.Equal(t, "team/", state.Resources["a"].Namespace)
+	entry, err := storage.Get(ctx, StorageKeyState)
+	require.NoError(t, err)
+	require.Equal(t, unversioned, entry.Value)
+
+	from, err := UpgradeState(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, 0, from)
+	backup, err := storage.Get(ctx, StorageKeyStateBackupPrefix+"v0")
+	require.NoError(t, err)
+	require.Equal(t, unversioned, backup.Value)
+	entry, err = storage.Get(ctx, StorageKeyState)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version": 1, "resources": {"a": {"namespace": "team/", "path": "kv/a", "response_data": {"n": 9007199254740993}}}}`, string(entry.Value))
+
+	from, err = UpgradeState(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, CurrentStateVersion, from)
+
+	require.NoError(t, storage.Put(ctx, &logical.StorageEntry{Key: StorageKeyState, Value: []byte(`{"version": 99, "resources": {}}`)}))
+	_, err = UpgradeState(ctx, storage)
+	require.ErrorContains(t, err, "state version 99 is newer than 1 supported by this plugin version")
+	_, err = LoadState(ctx, storage)
+	require.ErrorContains(t, err, "upgrade the plugin")
+	entry, err = storage.Get(ctx, StorageKeyState)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version": 99, "resources": {}}`, string(entry.Value), "newer state is not modified")
+}
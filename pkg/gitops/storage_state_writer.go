@@ -2,6 +2,8 @@ package gitops
 
 import (
 	"context"
+	"fmt"
+	"sync"
 
 	"github.com/hashicorp/vault/sdk/logical"
 
@@ -10,8 +12,13 @@ import (
 
 // StorageStateWriter persists gitops state to logical.Storage.
 // Used by the plugin in gitops mode; not used in terraform mode.
+// Sensitive fields (SensitiveResponseFields) are encrypted; read the state with LoadState.
+// It is safe for concurrent use: saves are serialized; every history record is its own entry.
 type StorageStateWriter struct {
 	Storage logical.Storage
+
+	mu     sync.Mutex
+	cipher *stateCipher
 }
 
 // SaveState implements StateWriter.
@@ -19,7 +26,25 @@ func (w *StorageStateWriter) SaveState(ctx context.Context, state *State) error
 	if state == nil {
 		return nil
 	}
-	return util.PutJSON(ctx, w.Storage, StorageKeyState, state)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cipher == nil {
+		c, err := loadStateCipher(ctx, w.Storage, true)
+		if err != nil {
+			return fmt.Errorf("state key: %w", err)
+		}
+		w.cipher = c
+	}
+	encrypted, err := mapStateSensitive(state, w.cipher.encrypt)
+	if err != nil {
+		return err
+	}
+	return util.PutJSON(ctx, w.Storage, StorageKeyState, encrypted)
+}
+
+// RecordHistory implements HistoryRecorder.
+func (w *StorageStateWriter) RecordHistory(ctx context.Context, entry HistoryEntry) error {
+	return appendHistory(ctx, w.Storage, entry)
 }
 
 // NewStorageStateWriter returns a StateWriter that saves state to the given logical.Storage.
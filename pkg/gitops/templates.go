@@ -5,6 +5,16 @@ import (
 	"strings"
 )
 
+// resolveResourceData renders Go templates (when enabled on the resource), then
+// replaces <name:key> templates with values from state.
+func resolveResourceData(r *Resource, state *State) (interface{}, error) {
+	data, err := renderData(r, stateRef(state))
+	if err != nil {
+		return nil, err
+	}
+	return ResolveTemplates(data, state)
+}
+
 // ResolveTemplates replaces template strings <name:key> in data with values from state.
 func ResolveTemplates(data interface{}, state *State) (interface{}, error) {
 	switch x := data.(type) {
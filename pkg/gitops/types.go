@@ -1,30 +1,79 @@
 package gitops
 
+import (
+	"fmt"
+	"time"
+)
+
 // StateResource is stored per key (effective name: explicit name or namespace+path).
 type StateResource struct {
 	DataDigest     string      `json:"data_digest"`
 	Dependencies   []string    `json:"dependencies"`
 	IgnoreFailures bool        `json:"ignore_failures,omitempty"`
+	PreventDestroy bool        `json:"prevent_destroy,omitempty"`
 	ResponseData   interface{} `json:"response_data,omitempty"`
+	AppliedData    interface{} `json:"applied_data,omitempty"` // declared data of the last apply, kept in atomic mode for rollback
+	Delete         *DeleteSpec `json:"delete,omitempty"`       // 'delete' of the resource; nil = DELETE on path
+	DataSource     bool        `json:"data_source,omitempty"`  // read by a 'kind: data' resource; never deleted in Vault
+	ReadAt         *time.Time  `json:"read_at,omitempty"`      // time of the last read of a data source
+	Commit         string      `json:"commit,omitempty"`       // commit of the last apply (or read) of the resource
+	AppliedAt      *time.Time  `json:"applied_at,omitempty"`   // time of the last apply; nil for data sources and imports
 	Namespace      string      `json:"namespace,omitempty"`
 	Path           string      `json:"path,omitempty"`
+	Imported       bool        `json:"imported,omitempty"` // pending import (state/import): the next apply adopts it without calling Vault; never deleted
 }
 
 // State is persisted to storage.
 type State struct {
+	Version   int                      `json:"version"` // format version, see CurrentStateVersion
 	Resources map[string]StateResource `json:"resources"`
 }
 
 // Resource is one declarative resource from YAML.
 type Resource struct {
-	Path           string      `yaml:"path"`
-	Data           interface{} `yaml:"data"`
-	Namespace      string      `yaml:"namespace"`
-	Name           string      `yaml:"name"`
-	Revision       int         `yaml:"revision"` // optional; default 0; participates in digest (bump to force re-apply)
-	Dependencies   []string    `yaml:"dependencies"`
-	IgnoreFailures bool        `yaml:"ignore_failures"`
-	Method         string      `yaml:"method"` // optional; "GET" or "POST" (default POST)
+	Kind           string       `yaml:"kind"` // "resource" (default) or "data" (see IsDataSource)
+	Path           string       `yaml:"path"`
+	Data           interface{}  `yaml:"data"`
+	Namespace      string       `yaml:"namespace"`
+	Name           string       `yaml:"name"`
+	Revision       int          `yaml:"revision"` // optional; default 0; participates in digest (bump to force re-apply)
+	Dependencies   []string     `yaml:"dependencies"`
+	IgnoreFailures bool         `yaml:"ignore_failures"`
+	Method         string       `yaml:"method"`     // optional; GET, POST (default), PUT, PATCH or DELETE
+	Templating     string       `yaml:"templating"` // optional; "go" renders strings in data as Go templates
+	PreventDestroy bool         `yaml:"prevent_destroy"`
+	Lifecycle      string       `yaml:"lifecycle"`     // optional; "abandon" drops the resource from state without deleting it in Vault
+	Retry          *RetryPolicy `yaml:"retry"`         // optional; overrides fields of the global retry policy
+	Delete         *DeleteSpec  `yaml:"delete"`        // optional; request sent when the resource is removed ('none' = keep in Vault)
+	TTL            string       `yaml:"ttl"`           // data sources only; re-read only when the last read is older (Go duration)
+	KeepResponse   []string     `yaml:"keep_response"` // optional; response fields (dotted paths) kept in state; nil = all
+
+	env *renderEnv // set by the loader; inputs for templating
+
+	// Source position of the document, set by the loader; empty for resources built in code.
+	File   string `yaml:"-"`
+	Line   int    `yaml:"-"`
+	Column int    `yaml:"-"`
+}
+
+// LifecycleAbandon stops managing a resource: its state entry is dropped, Vault is not called.
+const LifecycleAbandon = "abandon"
+
+// Abandoned reports whether the resource has 'lifecycle: abandon'.
+func (r Resource) Abandoned() bool {
+	return r.Lifecycle == LifecycleAbandon
+}
+
+func (r *Resource) setPosition(file string, line, column int) {
+	r.File, r.Line, r.Column = file, line, column
+}
+
+// Location returns "file:line:column" of the resource document, or "" if unknown.
+func (r Resource) Location() string {
+	if r.File == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d:%d", r.File, r.Line, r.Column)
 }
 
 func (r Resource) NamespaceOrDefault() string {
@@ -34,6 +83,11 @@ func (r Resource) NamespaceOrDefault() string {
 	return ""
 }
 
+// location returns the namespace and path of r as recorded in state (see stateLocation).
+func (r Resource) location() (namespace, path string) {
+	return stateLocation(r.NamespaceOrDefault(), r.Path)
+}
+
 // EffectiveName returns the unique name for the resource: Name if set, else namespace+path.
 func (r Resource) EffectiveName() string {
 	if r.Name != "" {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/fatih/structs"
 	"github.com/hashicorp/go-hclog"
@@ -18,6 +19,7 @@ const (
 	FieldNameTfPath         = "terraform_path"
 	FieldNameTfBinary       = "terraform_binary"
 	FieldNameTfBinarySHA256 = "terraform_binary_sha256"
+	FieldNameTfMode         = "terraform_mode"
 
 	StorageKeyConfiguration = "terraform_configuration"
 )
@@ -26,11 +28,17 @@ type Configuration struct {
 	TfPath         string `structs:"terraform_path" json:"terraform_path,omitempty"`
 	TfBinary       string `structs:"terraform_binary" json:"terraform_binary,omitempty"`
 	TfBinarySHA256 string `structs:"terraform_binary_sha256" json:"terraform_binary_sha256,omitempty"`
+	// Mode is TerraformModeApply (empty) or TerraformModePlan.
+	Mode string `structs:"terraform_mode" json:"terraform_mode,omitempty"`
 }
 
 type backend struct {
 	// just for logger provider
 	baseBackend *framework.Backend
+
+	// stateLock serializes changes of the stored terraform state of the mount: commit
+	// processing, rollback and applying a plan.
+	stateLock sync.Mutex
 }
 
 func (b *backend) Logger() hclog.Logger {
@@ -38,11 +46,11 @@ func (b *backend) Logger() hclog.Logger {
 }
 
 func Paths(baseBackend *framework.Backend) []*framework.Path {
-	b := backend{
-		baseBackend: baseBackend,
-	}
+	return (&backend{baseBackend: baseBackend}).paths()
+}
 
-	return []*framework.Path{
+func (b *backend) paths() []*framework.Path {
+	return append([]*framework.Path{
 		{
 			Pattern: "^configure/terraform/?$",
 			Fields: map[string]*framework.FieldSchema{
@@ -63,6 +71,12 @@ func Paths(baseBackend *framework.Backend) []*framework.Path {
 					Description: "Optional SHA256 checksum of the Terraform binary. If set, the binary is verified against this checksum at configuration time and before each run.",
 					Required:    false,
 				},
+				FieldNameTfMode: {
+					Type:        framework.TypeString,
+					Default:     TerraformModeApply,
+					Description: "apply: apply every commit. plan: only plan commits and keep the plan until it is applied by a commit with " + ApplyPlanMarker + " or terraform/plans/<commit>/apply.",
+					Required:    false,
+				},
 			},
 
 			Operations: map[logical.Operation]framework.OperationHandler{
@@ -87,7 +101,7 @@ func Paths(baseBackend *framework.Backend) []*framework.Path {
 			HelpSynopsis:    configureHelpSyn,
 			HelpDescription: configureHelpDesc,
 		},
-	}
+	}, append(append(append(b.terraformStatePaths(), b.snapshotPaths()...), b.planPaths()...), b.runLogPaths()...)...)
 }
 
 // pathConfigExistenceCheck verifies if the configuration exists.
@@ -138,6 +152,13 @@ func (b *backend) pathConfigureCreateOrUpdate(ctx context.Context, req *logical.
 		config.TfBinarySHA256 = strings.TrimSpace(tfBinarySHA256.(string))
 	}
 
+	if tfMode, ok := fields.GetOk(FieldNameTfMode); ok {
+		config.Mode = tfMode.(string)
+	}
+	if config.Mode != "" && config.Mode != TerraformModeApply && config.Mode != TerraformModePlan {
+		return logical.ErrorResponse("%q must be %q or %q", FieldNameTfMode, TerraformModeApply, TerraformModePlan), nil
+	}
+
 	// Validate TfBinary if it was provided or set
 	if config.TfBinary != "" {
 		if _, err := ResolveAndValidateTfBinary(config.TfBinary, config.TfBinarySHA256); err != nil {
@@ -3,9 +3,11 @@
 package terraform
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -14,6 +16,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-git/go-billy/v6"
 	"github.com/hashicorp/go-hclog"
@@ -49,6 +52,8 @@ type CLIConfig struct {
 	TfBinarySHA256   string
 	Storage          logical.Storage
 	Logger           hclog.Logger
+	// RunLog, if set, records the output of every terraform command of the run.
+	RunLog *RunLog
 }
 
 // ApplyTerraformFromFS extracts terraform files from the given filesystem and applies them using Terraform CLI.
@@ -63,28 +68,22 @@ type CLIConfig struct {
 // the prefix, so terraform always runs from workspace/.  The .rootfs
 // sibling is derived from workDir by newSandboxedCommand and never appears
 // inside /workspace after pivot_root.
-func ApplyTerraformFromFS(ctx context.Context, worktreeFS billy.Filesystem, config CLIConfig) error {
-	// Create temporary directory on a tmpfs-backed filesystem so that
-	// sensitive .tf content never touches persistent storage.
-	tmpDir, err := os.MkdirTemp(inMemoryTempDir(), "vault-plugin-terraform-*")
+//
+// The state terraform leaves behind is saved even if a step fails (a failed apply may have
+// changed some resources), unless it fails validation (see checkStateSave): then the stored
+// state is kept and the run fails.
+func ApplyTerraformFromFS(ctx context.Context, worktreeFS billy.Filesystem, config CLIConfig) (retErr error) {
+	tmpDir, workDir, err := newWorkspace(config)
 	if err != nil {
-		return fmt.Errorf("creating temporary directory: %w", err)
+		return err
 	}
-
-	workDir := filepath.Join(tmpDir, "workspace")
 	statePath := filepath.Join(workDir, "terraform.tfstate")
 
 	defer func() {
-		if stateData, readErr := os.ReadFile(statePath); readErr == nil && len(stateData) > 0 {
-			if saveErr := saveTerraformState(ctx, stateData, config); saveErr != nil {
-				config.Logger.Warn(fmt.Sprintf("Failed to save terraform state: %v", saveErr))
-			}
-		}
+		retErr = errors.Join(retErr, saveStateFile(ctx, statePath, config))
 		os.RemoveAll(tmpDir)
 	}()
 
-	config.Logger.Debug(fmt.Sprintf("Created temporary directory for terraform: %q", tmpDir))
-
 	tfFiles, err := extractTerraformFiles(worktreeFS, workDir, config.TfPath, config.Logger)
 	if err != nil {
 		return fmt.Errorf("extracting terraform files: %w", err)
@@ -114,6 +113,32 @@ func ApplyTerraformFromFS(ctx context.Context, worktreeFS billy.Filesystem, conf
 	return nil
 }
 
+// newWorkspace creates the temporary directory of one terraform run and returns it with the
+// workspace directory inside it. The caller removes tmpDir.
+func newWorkspace(config CLIConfig) (tmpDir, workDir string, err error) {
+	// Create temporary directory on a tmpfs-backed filesystem so that
+	// sensitive .tf content never touches persistent storage.
+	tmpDir, err = os.MkdirTemp(inMemoryTempDir(), "vault-plugin-terraform-*")
+	if err != nil {
+		return "", "", fmt.Errorf("creating temporary directory: %w", err)
+	}
+	config.Logger.Debug(fmt.Sprintf("Created temporary directory for terraform: %q", tmpDir))
+	return tmpDir, filepath.Join(tmpDir, "workspace"), nil
+}
+
+// saveStateFile saves the state terraform left at statePath, if any.
+func saveStateFile(ctx context.Context, statePath string, config CLIConfig) error {
+	stateData, err := os.ReadFile(statePath)
+	if err != nil || len(stateData) == 0 {
+		return nil
+	}
+	if err := saveTerraformState(ctx, stateData, config); err != nil {
+		config.Logger.Warn(fmt.Sprintf("Failed to save terraform state: %v", err))
+		return fmt.Errorf("saving terraform state: %w", err)
+	}
+	return nil
+}
+
 // extractTerraformFiles extracts files from the given filesystem to temporary directory.
 func extractTerraformFiles(worktreeFS billy.Filesystem, targetDir string, tfPath string, logger hclog.Logger) ([]string, error) {
 	var tfFiles []string
@@ -234,87 +259,68 @@ func setupTerraformConfigFile(workDir string, cmd *exec.Cmd) {
 }
 
 func runTerraformInit(ctx context.Context, workDir string, config CLIConfig) error {
-	tfBinary, err := getTfBinary(config)
-	if err != nil {
-		return err
-	}
-	cmd, err := newTerraformCommand(ctx, workDir, config, config.Logger, tfBinary, "init", "-no-color", "-input=false")
-	if err != nil {
-		return err
-	}
-	setupTerraformConfigFile(workDir, cmd)
-	cmd.Stdout = io.Discard
-
-	var stderrBuf strings.Builder
-	cmd.Stderr = &stderrBuf
-
-	config.Logger.Info("Running terraform init")
-	if err := cmd.Run(); err != nil {
-		stderr := strings.TrimSpace(stderrBuf.String())
-		if stderr != "" {
-			return fmt.Errorf("terraform init failed: %s", stderr)
-		}
-		return fmt.Errorf("terraform init failed: %w", err)
-	}
-
-	config.Logger.Info("Terraform init completed successfully")
-	return nil
+	_, err := runTerraform(ctx, workDir, config, outputText, "init", "-no-color", "-input=false")
+	return err
 }
 
 func runTerraformPlan(ctx context.Context, workDir string, config CLIConfig) error {
-	tfBinary, err := getTfBinary(config)
-	if err != nil {
-		return err
-	}
-	cmd, err := newTerraformCommand(ctx, workDir, config, config.Logger, tfBinary, "plan", "-no-color", "-input=false", "-out=tfplan")
-	if err != nil {
-		return err
-	}
-	setupTerraformConfigFile(workDir, cmd)
-	cmd.Stdout = io.Discard
-
-	var stderrBuf strings.Builder
-	cmd.Stderr = &stderrBuf
-
-	config.Logger.Info("Running terraform plan")
-	if err := cmd.Run(); err != nil {
-		stderr := strings.TrimSpace(stderrBuf.String())
-		if stderr != "" {
-			return fmt.Errorf("terraform plan failed: %s", stderr)
-		}
-		return fmt.Errorf("terraform plan failed: %w", err)
-	}
+	_, err := runTerraform(ctx, workDir, config, outputJSON, "plan", "-no-color", "-input=false", "-out=tfplan")
+	return err
+}
 
-	config.Logger.Info("Terraform plan completed successfully")
-	return nil
+// runTerraformShowPlan returns the JSON representation of the saved plan tfplan. It contains
+// the planned values, so it is not recorded in the run log.
+func runTerraformShowPlan(ctx context.Context, workDir string, config CLIConfig) ([]byte, error) {
+	return runTerraform(ctx, workDir, config, outputHidden, "show", "-no-color", "-json", "tfplan")
 }
 
 func runTerraformApply(ctx context.Context, workDir string, config CLIConfig) error {
+	_, err := runTerraform(ctx, workDir, config, outputJSON, "apply", "-no-color", "-input=false", "-auto-approve", "tfplan")
+	return err
+}
+
+// runTerraform runs a terraform command (args[0] is the subcommand) in workDir, records its
+// output in config.RunLog and returns its stdout. With outputJSON the command runs with -json
+// and the error of a failed run is made of the error diagnostics it reported.
+func runTerraform(ctx context.Context, workDir string, config CLIConfig, output stepOutput, args ...string) ([]byte, error) {
 	tfBinary, err := getTfBinary(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	cmd, err := newTerraformCommand(ctx, workDir, config, config.Logger, tfBinary, "apply", "-no-color", "-input=false", "-auto-approve", "tfplan")
+	step := args[0]
+	if output == outputJSON {
+		args = append([]string{step, "-json"}, args[1:]...)
+	}
+	cmd, err := newTerraformCommand(ctx, workDir, config, config.Logger, tfBinary, args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	setupTerraformConfigFile(workDir, cmd)
-	cmd.Stdout = io.Discard
-
-	var stderrBuf strings.Builder
+	var stdoutBuf, stderrBuf bytes.Buffer
+	cmd.Stdout = &stdoutBuf
 	cmd.Stderr = &stderrBuf
 
-	config.Logger.Info("Running terraform apply")
-	if err := cmd.Run(); err != nil {
-		stderr := strings.TrimSpace(stderrBuf.String())
-		if stderr != "" {
-			return fmt.Errorf("terraform apply failed: %s", stderr)
+	config.Logger.Info(fmt.Sprintf("Running terraform %s", step))
+	started := time.Now()
+	runErr := cmd.Run()
+	var events []LogEvent
+	if output == outputJSON {
+		events = parseLogEvents(stdoutBuf.Bytes())
+	}
+	config.RunLog.addStep(step, started, output, stdoutBuf.Bytes(), stderrBuf.Bytes(), events, runErr, config.VaultToken)
+	if runErr != nil {
+		msg := errorDiagnostics(events)
+		if msg == "" {
+			msg = strings.TrimSpace(stderrBuf.String())
 		}
-		return fmt.Errorf("terraform apply failed: %w", err)
+		if msg != "" {
+			return nil, fmt.Errorf("terraform %s failed: %s", step, redactOutput(msg, config.VaultToken))
+		}
+		return nil, fmt.Errorf("terraform %s failed: %w", step, runErr)
 	}
 
-	config.Logger.Info("Terraform apply completed successfully")
-	return nil
+	config.Logger.Info(fmt.Sprintf("Terraform %s completed successfully", step))
+	return stdoutBuf.Bytes(), nil
 }
 
 func loadTerraformState(ctx context.Context, statePath string, config CLIConfig) error {
@@ -341,7 +347,8 @@ func loadTerraformState(ctx context.Context, statePath string, config CLIConfig)
 	return nil
 }
 
-// saveTerraformState saves terraform state to storage
+// saveTerraformState saves terraform state to storage. A state that is invalid, has another
+// lineage or a lower serial than the stored one is refused (see checkStateSave).
 func saveTerraformState(ctx context.Context, state []byte, config CLIConfig) error {
 	if config.Storage == nil {
 		config.Logger.Debug("Storage not provided, skipping state save")
@@ -353,13 +360,20 @@ func saveTerraformState(ctx context.Context, state []byte, config CLIConfig) err
 		return nil
 	}
 
-	entry := &logical.StorageEntry{
-		Key:   StorageKeyTerraformState,
-		Value: state,
+	entry, err := config.Storage.Get(ctx, StorageKeyTerraformState)
+	if err != nil {
+		return fmt.Errorf("getting terraform state from storage: %w", err)
+	}
+	var current []byte
+	if entry != nil {
+		current = entry.Value
+	}
+	if err := checkStateSave(current, state); err != nil {
+		return fmt.Errorf("%w; previous state kept", err)
 	}
 
-	if err := config.Storage.Put(ctx, entry); err != nil {
-		return fmt.Errorf("saving terraform state to storage: %w", err)
+	if err := putTerraformState(ctx, config.Storage, state, stateSourceApply); err != nil {
+		return err
 	}
 
 	config.Logger.Info("Saved terraform state to storage")
@@ -5,6 +5,7 @@ package terraform
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/go-git/go-billy/v6"
 	"github.com/hashicorp/go-hclog"
@@ -16,24 +17,113 @@ import (
 )
 
 func init() {
-	engine.Register("terraform", &engineImpl{})
+	engine.Register("terraform", func() engine.Engine { return &engineImpl{backend: &backend{}} })
 }
 
-type engineImpl struct{}
+// engineImpl processes the commits of one mount; its backend serves the endpoints of the mount.
+type engineImpl struct {
+	backend *backend
+}
+
+func (e *engineImpl) ProcessCommit(ctx context.Context, storage logical.Storage, worktreeFS billy.Filesystem, commit engine.Commit, logger hclog.Logger) error {
+	tfConfig, err := GetConfig(ctx, storage)
+	if err != nil {
+		return fmt.Errorf("unable to get terraform configuration: %w", err)
+	}
+	cliCfg, err := newCLIConfig(ctx, storage, logger)
+	if err != nil {
+		return err
+	}
 
-func (e *engineImpl) ProcessCommit(ctx context.Context, storage logical.Storage, worktreeFS billy.Filesystem, logger hclog.Logger) error {
+	kind := RunKindApply
+	switch {
+	case strings.Contains(commit.Message, ApplyPlanMarker):
+		kind = RunKindApplyPlan
+	case tfConfig.Mode == TerraformModePlan || strings.Contains(commit.Message, PlanOnlyMarker):
+		kind = RunKindPlan
+	}
+	cliCfg.RunLog = newRunLog(kind, commit.Hash)
+
+	e.backend.stateLock.Lock()
+	defer e.backend.stateLock.Unlock()
+	err = processCommit(ctx, storage, worktreeFS, commit.Hash, kind, cliCfg)
+	cliCfg.RunLog.finish(err, cliCfg.VaultToken)
+	if logErr := storeRunLog(ctx, storage, cliCfg.RunLog); logErr != nil {
+		logger.Warn(fmt.Sprintf("Failed to store terraform log of commit %q: %v", commit.Hash, logErr))
+	} else if err != nil {
+		err = fmt.Errorf("%w (see terraform/logs/%s)", err, cliCfg.RunLog.ID)
+	}
+	return err
+}
+
+// processCommit runs terraform for a commit: applies it, plans it, or applies the pending plan.
+func processCommit(ctx context.Context, storage logical.Storage, worktreeFS billy.Filesystem, commit, kind string, cliCfg CLIConfig) error {
+	logger := cliCfg.Logger
+	switch kind {
+	case RunKindApplyPlan:
+		plan, err := pendingPlan(ctx, storage)
+		if err != nil {
+			return fmt.Errorf("unable to get pending terraform plan: %w", err)
+		}
+		if plan == nil {
+			return fmt.Errorf("%s: no pending terraform plan", ApplyPlanMarker)
+		}
+		if err := loadPlanFiles(ctx, storage, plan); err != nil {
+			return fmt.Errorf("unable to get pending terraform plan: %w", err)
+		}
+		// Only the saved plan is applied: a commit that also changes the terraform files would
+		// leave its changes unapplied while being reported as applied.
+		changed, err := changedPlanFiles(worktreeFS, plan, cliCfg)
+		if err != nil {
+			return fmt.Errorf("comparing with the plan of commit %q: %w", plan.Commit, err)
+		}
+		if len(changed) > 0 {
+			return fmt.Errorf("%s: files %s differ from the plan of commit %q; a commit approving a plan must not change terraform files: apply the plan with terraform/plans/%s/apply or commit the changes without %s",
+				ApplyPlanMarker, strings.Join(changed, ", "), plan.Commit, plan.Commit, ApplyPlanMarker)
+		}
+		if err := applyPlan(ctx, storage, plan, commit, cliCfg); err != nil {
+			return fmt.Errorf("terraform apply of the plan of commit %q: %w", plan.Commit, err)
+		}
+		logger.Info(fmt.Sprintf("Applied terraform plan of commit %q: %s", plan.Commit, plan.Summary))
+		return nil
+	case RunKindPlan:
+		plan, err := PlanTerraformFromFS(ctx, worktreeFS, cliCfg)
+		if err != nil {
+			return fmt.Errorf("terraform plan: %w", err)
+		}
+		if plan == nil {
+			return nil
+		}
+		if err := storePlan(ctx, storage, commit, plan); err != nil {
+			return fmt.Errorf("saving terraform plan: %w", err)
+		}
+		logger.Info(fmt.Sprintf("Saved terraform plan of commit %q for approval: %s", commit, plan.Summary))
+		return nil
+	}
+
+	if err := ApplyTerraformFromFS(ctx, worktreeFS, cliCfg); err != nil {
+		return fmt.Errorf("terraform apply: %w", err)
+	}
+	if err := snapshotState(ctx, storage, commit); err != nil {
+		logger.Warn(fmt.Sprintf("Failed to snapshot terraform state of commit %q: %v", commit, err))
+	}
+	return nil
+}
+
+// newCLIConfig returns the terraform CLI configuration from the vault and terraform configurations.
+func newCLIConfig(ctx context.Context, storage logical.Storage, logger hclog.Logger) (CLIConfig, error) {
 	vaultConfig, err := vault_client.GetConfig(ctx, storage)
 	if err != nil {
-		return fmt.Errorf("unable to get vault configuration: %w", err)
+		return CLIConfig{}, fmt.Errorf("unable to get vault configuration: %w", err)
 	}
 	if vaultConfig == nil || vaultConfig.VaultToken == "" {
-		return fmt.Errorf("vault configuration is required for terraform mode (configure vault token)")
+		return CLIConfig{}, fmt.Errorf("vault configuration is required for terraform mode (configure vault token)")
 	}
 	tfConfig, err := GetConfig(ctx, storage)
 	if err != nil {
-		return fmt.Errorf("unable to get terraform configuration: %w", err)
+		return CLIConfig{}, fmt.Errorf("unable to get terraform configuration: %w", err)
 	}
-	cliCfg := CLIConfig{
+	return CLIConfig{
 		VaultAddr:        vaultConfig.VaultAddr,
 		VaultToken:       vaultConfig.VaultToken,
 		VaultNamespace:   vaultConfig.VaultNamespace,
@@ -43,13 +133,21 @@ func (e *engineImpl) ProcessCommit(ctx context.Context, storage logical.Storage,
 		TfBinarySHA256:   tfConfig.TfBinarySHA256,
 		Storage:          storage,
 		Logger:           logger,
-	}
-	if err := ApplyTerraformFromFS(ctx, worktreeFS, cliCfg); err != nil {
-		return fmt.Errorf("terraform apply: %w", err)
-	}
-	return nil
+	}, nil
 }
 
 func (e *engineImpl) Paths(baseBackend *framework.Backend) []*framework.Path {
-	return Paths(baseBackend)
+	e.backend.baseBackend = baseBackend
+	return e.backend.paths()
+}
+
+func (e *engineImpl) SealWrapStorage() []string {
+	return []string{
+		StorageKeyTerraformState,
+		StorageKeyTerraformStateSnapshotPrefix,
+		StorageKeyTerraformStateVersionPrefix,
+		StorageKeyTerraformPlanPrefix,
+		StorageKeyTerraformPlanFilePrefix,
+		StorageKeyTerraformLogPrefix,
+	}
 }
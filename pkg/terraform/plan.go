@@ -0,0 +1,634 @@
+//go:build linux
+
+package terraform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-git/go-billy/v6"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/trublast/vault-plugin-gitops/pkg/util"
+)
+
+const (
+	// TerraformModeApply applies every commit (default); TerraformModePlan only plans it and
+	// keeps the plan until it is approved.
+	TerraformModeApply = "apply"
+	TerraformModePlan  = "plan"
+
+	// PlanOnlyMarker in a commit message plans the commit without applying it, whatever the mode.
+	PlanOnlyMarker = "[plan_only]"
+	// ApplyPlanMarker in a commit message applies the pending saved plan instead of the commit.
+	ApplyPlanMarker = "[apply_plan]"
+
+	// StorageKeyTerraformPlans is the list of saved plans; the plans themselves are stored under
+	// StorageKeyTerraformPlanPrefix + commit hash.
+	StorageKeyTerraformPlans      = "terraform_plans"
+	StorageKeyTerraformPlanPrefix = "terraform_plan/"
+	// StorageKeyTerraformPlanFilePrefix holds the plan file and the workspace files of a plan
+	// waiting for approval, one entry each, under <commit>/.
+	StorageKeyTerraformPlanFilePrefix = "terraform_plan_file/"
+
+	// MaxSavedPlans is how many saved plans are kept; older ones are deleted.
+	MaxSavedPlans = 20
+	// MaxPlanFileBytes is the largest plan file or workspace file a plan can keep: every file is
+	// one storage entry, and storage backends limit the size of an entry (1 MiB on raft).
+	MaxPlanFileBytes = 512 << 10
+
+	// lockFileName is the dependency lock file written by terraform init.
+	lockFileName = ".terraform.lock.hcl"
+)
+
+// Statuses of a saved plan. Only the latest plan can be pending: a new plan supersedes it.
+const (
+	PlanStatusPending    = "pending"
+	PlanStatusApplied    = "applied"
+	PlanStatusFailed     = "failed"
+	PlanStatusSuperseded = "superseded"
+)
+
+var savedPlans = util.SnapshotStore{
+	IndexKey: StorageKeyTerraformPlans,
+	Prefix:   StorageKeyTerraformPlanPrefix,
+	Max:      MaxSavedPlans,
+}
+
+// PlanSummary lists the addresses of the resources a plan changes, by action.
+type PlanSummary struct {
+	Create  []string `json:"create"`
+	Update  []string `json:"update"`
+	Delete  []string `json:"delete"`
+	Replace []string `json:"replace"`
+}
+
+// SavedPlan is the plan of a commit in plan mode. While the plan is pending, the plan file and
+// the workspace (files of the repository and the lock file written by init) are stored next to
+// it, one entry per file (see storePlanFiles); they are dropped once the plan is applied or
+// superseded.
+type SavedPlan struct {
+	Commit    string      `json:"commit"`
+	Time      time.Time   `json:"time"`
+	Status    string      `json:"status"`
+	Summary   PlanSummary `json:"summary"`
+	AppliedAt *time.Time  `json:"applied_at,omitempty"`
+	AppliedBy string      `json:"applied_by,omitempty"` // commit hash or "api"
+	Error     string      `json:"error,omitempty"`
+	// Files are the names of the stored workspace files, in the order of their entries.
+	Files []string `json:"files,omitempty"`
+
+	plan  []byte            // the plan file
+	files map[string][]byte // the workspace files by name
+}
+
+// parsePlanSummary parses the output of 'terraform show -json' of a plan.
+func parsePlanSummary(showJSON []byte) (PlanSummary, error) {
+	var plan struct {
+		ResourceChanges []struct {
+			Address string `json:"address"`
+			Change  struct {
+				Actions []string `json:"actions"`
+			} `json:"change"`
+		} `json:"resource_changes"`
+	}
+	summary := PlanSummary{Create: []string{}, Update: []string{}, Delete: []string{}, Replace: []string{}}
+	if err := json.Unmarshal(showJSON, &plan); err != nil {
+		return summary, fmt.Errorf("parsing terraform plan: %w", err)
+	}
+	for _, rc := range plan.ResourceChanges {
+		actions := rc.Change.Actions
+		switch {
+		case len(actions) == 2:
+			// ["delete", "create"] or ["create", "delete"] (create_before_destroy).
+			summary.Replace = append(summary.Replace, rc.Address)
+		case len(actions) == 1 && actions[0] == "create":
+			summary.Create = append(summary.Create, rc.Address)
+		case len(actions) == 1 && actions[0] == "update":
+			summary.Update = append(summary.Update, rc.Address)
+		case len(actions) == 1 && actions[0] == "delete":
+			summary.Delete = append(summary.Delete, rc.Address)
+		}
+	}
+	return summary, nil
+}
+
+func (s PlanSummary) String() string {
+	return fmt.Sprintf("%d to create, %d to update, %d to delete, %d to replace", len(s.Create), len(s.Update), len(s.Delete), len(s.Replace))
+}
+
+// PlanTerraformFromFS runs terraform init and plan on the files of the given filesystem and
+// returns the plan with its summary; nil if there are no terraform files. The state is not
+// changed.
+func PlanTerraformFromFS(ctx context.Context, worktreeFS billy.Filesystem, config CLIConfig) (*SavedPlan, error) {
+	tmpDir, workDir, err := newWorkspace(config)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	statePath := filepath.Join(workDir, "terraform.tfstate")
+
+	tfFiles, err := extractTerraformFiles(worktreeFS, workDir, config.TfPath, config.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("extracting terraform files: %w", err)
+	}
+	if len(tfFiles) == 0 {
+		config.Logger.Info("No terraform files found in repository")
+		return nil, nil
+	}
+	if err := loadTerraformState(ctx, statePath, config); err != nil {
+		return nil, fmt.Errorf("loading terraform state: %w", err)
+	}
+	if err := runTerraformInit(ctx, workDir, config); err != nil {
+		return nil, fmt.Errorf("terraform init: %w", err)
+	}
+	if err := runTerraformPlan(ctx, workDir, config); err != nil {
+		return nil, fmt.Errorf("terraform plan: %w", err)
+	}
+	showJSON, err := runTerraformShowPlan(ctx, workDir, config)
+	if err != nil {
+		return nil, fmt.Errorf("terraform show: %w", err)
+	}
+	summary, err := parsePlanSummary(showJSON)
+	if err != nil {
+		return nil, err
+	}
+	planData, err := os.ReadFile(filepath.Join(workDir, "tfplan"))
+	if err != nil {
+		return nil, fmt.Errorf("reading terraform plan: %w", err)
+	}
+	lockFile := filepath.Join(workDir, lockFileName)
+	if _, err := os.Stat(lockFile); err == nil {
+		tfFiles = append(tfFiles, lockFile)
+	}
+	files, err := readWorkspaceFiles(workDir, tfFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &SavedPlan{Summary: summary, plan: planData, files: files}, nil
+}
+
+// readWorkspaceFiles reads the given files of the workspace, keyed by their path relative to it.
+func readWorkspaceFiles(workDir string, paths []string) (map[string][]byte, error) {
+	files := make(map[string][]byte, len(paths))
+	for _, f := range paths {
+		rel, err := filepath.Rel(workDir, f)
+		if err != nil {
+			return nil, err
+		}
+		if files[rel], err = os.ReadFile(f); err != nil {
+			return nil, fmt.Errorf("reading %q: %w", rel, err)
+		}
+	}
+	return files, nil
+}
+
+// changedPlanFiles returns the terraform files of the given filesystem that differ from the
+// workspace of plan (added, changed or removed), sorted. The lock file is compared only if the
+// repository has one: otherwise init wrote it.
+func changedPlanFiles(worktreeFS billy.Filesystem, plan *SavedPlan, config CLIConfig) ([]string, error) {
+	tmpDir, workDir, err := newWorkspace(config)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	tfFiles, err := extractTerraformFiles(worktreeFS, workDir, config.TfPath, config.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("extracting terraform files: %w", err)
+	}
+	files, err := readWorkspaceFiles(workDir, tfFiles)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for name, data := range files {
+		if planned, ok := plan.files[name]; !ok || !bytes.Equal(planned, data) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range plan.files {
+		if _, ok := files[name]; !ok && name != lockFileName {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// ApplySavedPlan applies exactly the saved plan: the workspace of the plan is restored, init
+// installs the providers of its lock file and 'terraform apply tfplan' runs. Terraform refuses a
+// plan whose state has changed since it was made. The resulting state is saved as by
+// ApplyTerraformFromFS.
+func ApplySavedPlan(ctx context.Context, plan *SavedPlan, config CLIConfig) (retErr error) {
+	if len(plan.plan) == 0 {
+		return fmt.Errorf("plan of commit %q has no plan file", plan.Commit)
+	}
+	tmpDir, workDir, err := newWorkspace(config)
+	if err != nil {
+		return err
+	}
+	statePath := filepath.Join(workDir, "terraform.tfstate")
+	defer func() {
+		retErr = errors.Join(retErr, saveStateFile(ctx, statePath, config))
+		os.RemoveAll(tmpDir)
+	}()
+
+	if err := os.MkdirAll(workDir, 0700); err != nil {
+		return fmt.Errorf("creating workspace: %w", err)
+	}
+	for rel, data := range plan.files {
+		target := filepath.Join(workDir, rel)
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("invalid file %q in saved plan", rel)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return fmt.Errorf("creating directory for %q: %w", rel, err)
+		}
+		if err := os.WriteFile(target, data, 0600); err != nil {
+			return fmt.Errorf("writing %q: %w", rel, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "tfplan"), plan.plan, 0600); err != nil {
+		return fmt.Errorf("writing terraform plan: %w", err)
+	}
+	if err := loadTerraformState(ctx, statePath, config); err != nil {
+		return fmt.Errorf("loading terraform state: %w", err)
+	}
+	if err := runTerraformInit(ctx, workDir, config); err != nil {
+		return fmt.Errorf("terraform init: %w", err)
+	}
+	if err := runTerraformApply(ctx, workDir, config); err != nil {
+		return fmt.Errorf("terraform apply: %w", err)
+	}
+	return nil
+}
+
+// getSavedPlan returns the saved plan of commit; nil if there is none.
+func getSavedPlan(ctx context.Context, storage logical.Storage, commit string) (*SavedPlan, error) {
+	data, err := savedPlans.Get(ctx, storage, commit)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var plan SavedPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("saved plan of commit %q: %w", commit, err)
+	}
+	return &plan, nil
+}
+
+// getSavedPlans returns the saved plans, oldest first.
+func getSavedPlans(ctx context.Context, storage logical.Storage) ([]*SavedPlan, error) {
+	snapshots, err := savedPlans.List(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	plans := make([]*SavedPlan, 0, len(snapshots))
+	for _, s := range snapshots {
+		plan, err := getSavedPlan(ctx, storage, s.Commit)
+		if err != nil {
+			return nil, err
+		}
+		if plan != nil {
+			plans = append(plans, plan)
+		}
+	}
+	return plans, nil
+}
+
+// pendingPlan returns the plan waiting for approval; nil if there is none.
+func pendingPlan(ctx context.Context, storage logical.Storage) (*SavedPlan, error) {
+	plans, err := getSavedPlans(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(plans) - 1; i >= 0; i-- {
+		if plans[i].Status == PlanStatusPending {
+			return plans[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// updateSavedPlan rewrites a saved plan in place, keeping its position in the list.
+func updateSavedPlan(ctx context.Context, storage logical.Storage, plan *SavedPlan) error {
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	return storage.Put(ctx, &logical.StorageEntry{Key: StorageKeyTerraformPlanPrefix + plan.Commit, Value: data})
+}
+
+// planFileKey is the storage key of the plan file of commit.
+func planFileKey(commit string) string {
+	return StorageKeyTerraformPlanFilePrefix + commit + "/tfplan"
+}
+
+// planWorkspaceFileKey is the storage key of the i-th workspace file of the plan of commit.
+func planWorkspaceFileKey(commit string, i int) string {
+	return StorageKeyTerraformPlanFilePrefix + commit + "/files/" + strconv.Itoa(i)
+}
+
+// checkPlanSize refuses a plan whose plan file or a workspace file is larger than
+// MaxPlanFileBytes.
+func checkPlanSize(plan *SavedPlan) error {
+	if len(plan.plan) > MaxPlanFileBytes {
+		return fmt.Errorf("terraform plan is %d bytes, more than the %d bytes a saved plan can keep", len(plan.plan), MaxPlanFileBytes)
+	}
+	for _, name := range sortedFiles(plan) {
+		if len(plan.files[name]) > MaxPlanFileBytes {
+			return fmt.Errorf("file %q is %d bytes, more than the %d bytes a saved plan can keep", name, len(plan.files[name]), MaxPlanFileBytes)
+		}
+	}
+	return nil
+}
+
+// storePlanFiles stores the plan file and the workspace files of plan, one entry each, and
+// records the file names in plan.Files.
+func storePlanFiles(ctx context.Context, storage logical.Storage, plan *SavedPlan) error {
+	if err := storage.Put(ctx, &logical.StorageEntry{Key: planFileKey(plan.Commit), Value: plan.plan}); err != nil {
+		return err
+	}
+	plan.Files = sortedFiles(plan)
+	for i, name := range plan.Files {
+		if err := storage.Put(ctx, &logical.StorageEntry{Key: planWorkspaceFileKey(plan.Commit, i), Value: plan.files[name]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPlanFiles reads the plan file and the workspace files of a pending plan.
+func loadPlanFiles(ctx context.Context, storage logical.Storage, plan *SavedPlan) error {
+	entry, err := storage.Get(ctx, planFileKey(plan.Commit))
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("plan file of commit %q is missing", plan.Commit)
+	}
+	plan.plan = entry.Value
+	plan.files = make(map[string][]byte, len(plan.Files))
+	for i, name := range plan.Files {
+		entry, err := storage.Get(ctx, planWorkspaceFileKey(plan.Commit, i))
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return fmt.Errorf("file %q of the plan of commit %q is missing", name, plan.Commit)
+		}
+		plan.files[name] = entry.Value
+	}
+	return nil
+}
+
+// deletePlanFiles deletes the stored plan file and workspace files of plan.
+func deletePlanFiles(ctx context.Context, storage logical.Storage, plan *SavedPlan) error {
+	if err := storage.Delete(ctx, planFileKey(plan.Commit)); err != nil {
+		return err
+	}
+	for i := range plan.Files {
+		if err := storage.Delete(ctx, planWorkspaceFileKey(plan.Commit, i)); err != nil {
+			return err
+		}
+	}
+	plan.Files, plan.plan, plan.files = nil, nil, nil
+	return nil
+}
+
+// storePlan saves plan as the pending plan of commit; an earlier pending plan is superseded.
+func storePlan(ctx context.Context, storage logical.Storage, commit string, plan *SavedPlan) error {
+	if err := checkPlanSize(plan); err != nil {
+		return err
+	}
+	plans, err := getSavedPlans(ctx, storage)
+	if err != nil {
+		return err
+	}
+	for _, p := range plans {
+		if p.Status != PlanStatusPending {
+			continue
+		}
+		// The files of an earlier plan of the same commit are replaced below.
+		if err := deletePlanFiles(ctx, storage, p); err != nil {
+			return err
+		}
+		if p.Commit != commit {
+			p.Status = PlanStatusSuperseded
+			if err := updateSavedPlan(ctx, storage, p); err != nil {
+				return err
+			}
+		}
+	}
+	plan.Commit = commit
+	plan.Time = time.Now().UTC()
+	plan.Status = PlanStatusPending
+	if err := storePlanFiles(ctx, storage, plan); err != nil {
+		return err
+	}
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	return savedPlans.Save(ctx, storage, commit, data)
+}
+
+// applyPlan applies a pending plan and records the outcome; appliedBy is the approving commit
+// or "api". The state is snapshotted under the commit of the plan.
+func applyPlan(ctx context.Context, storage logical.Storage, plan *SavedPlan, appliedBy string, config CLIConfig) error {
+	if plan.Status != PlanStatusPending {
+		return fmt.Errorf("plan of commit %q is %s, not %s", plan.Commit, plan.Status, PlanStatusPending)
+	}
+	if plan.plan == nil {
+		if err := loadPlanFiles(ctx, storage, plan); err != nil {
+			return err
+		}
+	}
+	applyErr := ApplySavedPlan(ctx, plan, config)
+	if err := deletePlanFiles(ctx, storage, plan); err != nil {
+		config.Logger.Warn(fmt.Sprintf("Failed to delete the files of the plan of commit %q: %v", plan.Commit, err))
+	}
+	now := time.Now().UTC()
+	plan.AppliedAt = &now
+	plan.AppliedBy = appliedBy
+	plan.Status = PlanStatusApplied
+	if applyErr != nil {
+		plan.Status = PlanStatusFailed
+		plan.Error = applyErr.Error()
+	}
+	if err := updateSavedPlan(ctx, storage, plan); err != nil {
+		return errors.Join(applyErr, err)
+	}
+	if applyErr != nil {
+		return applyErr
+	}
+	if err := snapshotState(ctx, storage, plan.Commit); err != nil {
+		config.Logger.Warn(fmt.Sprintf("Failed to snapshot terraform state of commit %q: %v", plan.Commit, err))
+	}
+	return nil
+}
+
+// planSummaryMap is the API representation of a saved plan, without the plan file.
+func planSummaryMap(plan *SavedPlan) map[string]interface{} {
+	out := map[string]interface{}{
+		FieldNameCommit: plan.Commit,
+		"time":          plan.Time.Format(time.RFC3339),
+		"status":        plan.Status,
+		"create":        plan.Summary.Create,
+		"update":        plan.Summary.Update,
+		"delete":        plan.Summary.Delete,
+		"replace":       plan.Summary.Replace,
+	}
+	if plan.AppliedAt != nil {
+		out["applied_at"] = plan.AppliedAt.Format(time.RFC3339)
+		out["applied_by"] = plan.AppliedBy
+	}
+	if plan.Error != "" {
+		out["error"] = plan.Error
+	}
+	return out
+}
+
+// sortedFiles returns the names of the workspace files of a plan.
+func sortedFiles(plan *SavedPlan) []string {
+	names := make([]string, 0, len(plan.files))
+	for name := range plan.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *backend) planPaths() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "^terraform/plans/?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathPlansList,
+					Summary:  "List the saved terraform plans.",
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathPlansList,
+					Summary:  "List the saved terraform plans.",
+				},
+			},
+			HelpSynopsis:    "Saved terraform plans.",
+			HelpDescription: fmt.Sprintf("Commits planned in plan mode, oldest first, with the status of the plan and the number of resources to create, update, delete and replace (key_info); the last %d plans are kept.", MaxSavedPlans),
+		},
+		{
+			Pattern: "^terraform/plans/(?P<commit>[^/]+)/apply$",
+			Fields: map[string]*framework.FieldSchema{
+				FieldNameCommit: {
+					Type:        framework.TypeString,
+					Description: "Commit hash of the plan.",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathPlanApply,
+					Summary:  "Approve and apply a pending terraform plan.",
+				},
+			},
+			HelpSynopsis:    "Apply a pending terraform plan.",
+			HelpDescription: "Applies exactly the saved plan of the commit with 'terraform apply tfplan'. Only the pending (latest) plan can be applied, and terraform refuses it if the state has changed since the plan was made. Terraform runs within the request.",
+		},
+		{
+			Pattern: "^terraform/plans/(?P<commit>[^/]+)$",
+			Fields: map[string]*framework.FieldSchema{
+				FieldNameCommit: {
+					Type:        framework.TypeString,
+					Description: "Commit hash of the plan.",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathPlanRead,
+					Summary:  "Read a saved terraform plan.",
+				},
+			},
+			HelpSynopsis:    "A saved terraform plan.",
+			HelpDescription: "Returns the status of the plan and the addresses of the resources it creates, updates, deletes and replaces.",
+		},
+	}
+}
+
+func (b *backend) pathPlansList(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	plans, err := getSavedPlans(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(plans))
+	info := make(map[string]interface{}, len(plans))
+	for _, plan := range plans {
+		keys = append(keys, plan.Commit)
+		info[plan.Commit] = map[string]interface{}{
+			"time":    plan.Time.Format(time.RFC3339),
+			"status":  plan.Status,
+			"create":  len(plan.Summary.Create),
+			"update":  len(plan.Summary.Update),
+			"delete":  len(plan.Summary.Delete),
+			"replace": len(plan.Summary.Replace),
+		}
+	}
+	return logical.ListResponseWithInfo(keys, info), nil
+}
+
+func (b *backend) pathPlanRead(ctx context.Context, req *logical.Request, fields *framework.FieldData) (*logical.Response, error) {
+	plan, err := getSavedPlan(ctx, req.Storage, fields.Get(FieldNameCommit).(string))
+	if err != nil {
+		return nil, err
+	}
+	if plan == nil {
+		return nil, nil
+	}
+	data := planSummaryMap(plan)
+	if len(plan.Files) > 0 {
+		data["files"] = plan.Files
+	}
+	return &logical.Response{Data: data}, nil
+}
+
+func (b *backend) pathPlanApply(ctx context.Context, req *logical.Request, fields *framework.FieldData) (*logical.Response, error) {
+	commit := fields.Get(FieldNameCommit).(string)
+	if !b.stateLock.TryLock() {
+		return logical.ErrorResponse("a commit is being applied, try again later"), nil
+	}
+	defer b.stateLock.Unlock()
+
+	plan, err := getSavedPlan(ctx, req.Storage, commit)
+	if err != nil {
+		return nil, err
+	}
+	if plan == nil {
+		return logical.ErrorResponse("no saved plan of commit %q", commit), nil
+	}
+	if plan.Status != PlanStatusPending {
+		return logical.ErrorResponse("plan of commit %q is %s, not %s", commit, plan.Status, PlanStatusPending), nil
+	}
+	cliCfg, err := newCLIConfig(ctx, req.Storage, b.Logger())
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	cliCfg.RunLog = newRunLog(RunKindApplyPlan, commit)
+	err = applyPlan(ctx, req.Storage, plan, "api", cliCfg)
+	cliCfg.RunLog.finish(err, cliCfg.VaultToken)
+	if logErr := storeRunLog(ctx, req.Storage, cliCfg.RunLog); logErr != nil {
+		b.Logger().Warn(fmt.Sprintf("Failed to store terraform log of commit %q: %v", commit, logErr))
+	}
+	if err != nil {
+		return logical.ErrorResponse("%s (see terraform/logs/%s)", err.Error(), cliCfg.RunLog.ID), nil
+	}
+	b.Logger().Info("Applied saved terraform plan", "commit", commit, "summary", plan.Summary.String())
+	return &logical.Response{Data: planSummaryMap(plan)}, nil
+}
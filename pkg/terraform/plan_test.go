@@ -0,0 +1,141 @@
+//go:build linux
+
+package terraform
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v6/memfs"
+	"github.com/go-git/go-billy/v6/util"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParsePlanSummary(t *testing.T) {
+	tests := []struct {
+		name    string
+		show    string
+		want    PlanSummary
+		wantErr bool
+	}{
+		{
+			name: "actions",
+			show: `{"resource_changes": [
+				{"address": "vault_mount.a", "change": {"actions": ["create"]}},
+				{"address": "vault_policy.b", "change": {"actions": ["update"]}},
+				{"address": "vault_policy.c", "change": {"actions": ["delete"]}},
+				{"address": "vault_auth_backend.d", "change": {"actions": ["no-op"]}},
+				{"address": "data.vault_policy_document.e", "change": {"actions": ["read"]}}
+			]}`,
+			want: PlanSummary{Create: []string{"vault_mount.a"}, Update: []string{"vault_policy.b"}, Delete: []string{"vault_policy.c"}, Replace: []string{}},
+		},
+		{
+			name: "replace",
+			show: `{"resource_changes": [
+				{"address": "vault_auth_backend.a", "change": {"actions": ["delete", "create"]}},
+				{"address": "vault_auth_backend.b", "change": {"actions": ["create", "delete"]}}
+			]}`,
+			want: PlanSummary{Create: []string{}, Update: []string{}, Delete: []string{}, Replace: []string{"vault_auth_backend.a", "vault_auth_backend.b"}},
+		},
+		{
+			name: "no changes",
+			show: `{"format_version": "1.2"}`,
+			want: PlanSummary{Create: []string{}, Update: []string{}, Delete: []string{}, Replace: []string{}},
+		},
+		{
+			name:    "invalid",
+			show:    `{"resource_changes": `,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePlanSummary([]byte(tt.show))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_StorePlan(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	newPlan := func(tf string) *SavedPlan {
+		return &SavedPlan{plan: []byte("plan " + tf), files: map[string][]byte{"main.tf": []byte(tf), lockFileName: []byte("lock")}}
+	}
+
+	require.NoError(t, storePlan(ctx, storage, "c1", newPlan("one")))
+	plan, err := pendingPlan(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, "c1", plan.Commit)
+	require.Equal(t, []string{lockFileName, "main.tf"}, plan.Files)
+	require.Nil(t, plan.plan, "the plan file is not part of the plan entry")
+	require.NoError(t, loadPlanFiles(ctx, storage, plan))
+	require.Equal(t, []byte("plan one"), plan.plan)
+	require.Equal(t, map[string][]byte{"main.tf": []byte("one"), lockFileName: []byte("lock")}, plan.files)
+
+	require.NoError(t, storePlan(ctx, storage, "c2", newPlan("two")))
+	superseded, err := getSavedPlan(ctx, storage, "c1")
+	require.NoError(t, err)
+	require.Equal(t, PlanStatusSuperseded, superseded.Status)
+	require.Empty(t, superseded.Files)
+	keys, err := logical.CollectKeysWithPrefix(ctx, storage, StorageKeyTerraformPlanFilePrefix)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{
+		planFileKey("c2"), planWorkspaceFileKey("c2", 0), planWorkspaceFileKey("c2", 1),
+	}, keys, "the files of a superseded plan are deleted")
+
+	large := newPlan("three")
+	large.files["big.tf"] = []byte(strings.Repeat("#", MaxPlanFileBytes+1))
+	err = storePlan(ctx, storage, "c3", large)
+	require.ErrorContains(t, err, `file "big.tf" is`)
+	plan, err = pendingPlan(ctx, storage)
+	require.NoError(t, err)
+	require.Equal(t, "c2", plan.Commit, "a plan that is too large does not supersede the pending one")
+}
+
+func Test_ChangedPlanFiles(t *testing.T) {
+	plan := &SavedPlan{files: map[string][]byte{"main.tf": []byte("main"), "vars.tf": []byte("vars"), lockFileName: []byte("lock")}}
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []string
+	}{
+		{
+			name:  "same",
+			files: map[string]string{"tf/main.tf": "main", "tf/vars.tf": "vars"},
+		},
+		{
+			name:  "same with lock file",
+			files: map[string]string{"tf/main.tf": "main", "tf/vars.tf": "vars", "tf/" + lockFileName: "lock"},
+		},
+		{
+			name:  "changed lock file",
+			files: map[string]string{"tf/main.tf": "main", "tf/vars.tf": "vars", "tf/" + lockFileName: "other"},
+			want:  []string{lockFileName},
+		},
+		{
+			name:  "changed, added and removed",
+			files: map[string]string{"tf/main.tf": "changed", "tf/new.tf": "new", "other/ignored.tf": "x"},
+			want:  []string{"main.tf", "new.tf", "vars.tf"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := memfs.New()
+			for name, content := range tt.files {
+				require.NoError(t, util.WriteFile(fs, name, []byte(content), 0644))
+			}
+			got, err := changedPlanFiles(fs, plan, CLIConfig{TfPath: "tf", Logger: hclog.NewNullLogger()})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,362 @@
+//go:build linux
+
+package terraform
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/trublast/vault-plugin-gitops/pkg/util"
+)
+
+const (
+	FieldNameRun = "run"
+
+	// StorageKeyTerraformLogs is the index of terraform run logs (RunLogInfo, oldest first); the
+	// logs themselves are stored under StorageKeyTerraformLogPrefix + run id.
+	StorageKeyTerraformLogs      = "terraform_logs"
+	StorageKeyTerraformLogPrefix = "terraform_log/"
+
+	// MaxRunLogs is how many run logs are kept; older ones are deleted.
+	MaxRunLogs = 20
+	// MaxRunLogBytes caps the output kept per run; the rest is dropped and the log is marked
+	// truncated.
+	MaxRunLogBytes = 256 << 10
+)
+
+// Kinds of terraform runs.
+const (
+	RunKindApply     = "apply"
+	RunKindPlan      = "plan"
+	RunKindApplyPlan = "apply_plan"
+)
+
+// stepOutput is how the output of a terraform command is recorded.
+type stepOutput int
+
+const (
+	outputText   stepOutput = iota // stdout and stderr as text
+	outputJSON                     // run with -json: stdout as events, stderr as text
+	outputHidden                   // only stderr: stdout holds values (terraform show -json)
+)
+
+// vaultTokenRe matches Vault tokens (service, batch and recovery, and the legacy format).
+var vaultTokenRe = regexp.MustCompile(`\bhv[sbr]\.[A-Za-z0-9_-]{20,}|\bs\.[A-Za-z0-9]{24}\b`)
+
+// RunLog is the output of the terraform commands of one run.
+type RunLog struct {
+	ID        string    `json:"id"`
+	Commit    string    `json:"commit"`
+	Kind      string    `json:"kind"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Error     string    `json:"error,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Steps     []StepLog `json:"steps"`
+
+	size int
+}
+
+// RunLogInfo is the entry of a run log in the index.
+type RunLogInfo struct {
+	ID      string    `json:"id"`
+	Commit  string    `json:"commit"`
+	Kind    string    `json:"kind"`
+	Started time.Time `json:"started"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// StepLog is the output of one terraform command.
+type StepLog struct {
+	Command  string     `json:"command"`
+	Started  time.Time  `json:"started"`
+	Duration string     `json:"duration"`
+	Error    string     `json:"error,omitempty"`
+	Output   string     `json:"output,omitempty"`
+	Events   []LogEvent `json:"events,omitempty"`
+}
+
+// LogEvent is one message of the machine-readable (-json) terraform output.
+type LogEvent struct {
+	Time       string         `json:"time,omitempty"`
+	Level      string         `json:"level,omitempty"`
+	Type       string         `json:"type,omitempty"`
+	Message    string         `json:"message"`
+	Address    string         `json:"address,omitempty"`
+	Action     string         `json:"action,omitempty"`
+	Diagnostic *LogDiagnostic `json:"diagnostic,omitempty"`
+}
+
+// LogDiagnostic is a warning or error reported by terraform.
+type LogDiagnostic struct {
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// newRunLog starts the log of a run of commit.
+func newRunLog(kind, commit string) *RunLog {
+	now := time.Now().UTC()
+	id := now.Format("20060102T150405Z")
+	if commit != "" {
+		id += "-" + commit[:min(len(commit), 12)]
+	}
+	return &RunLog{ID: id, Commit: commit, Kind: kind, Started: now, Steps: []StepLog{}}
+}
+
+// parseLogEvents parses the -json output of terraform; lines that are not JSON are kept as
+// messages.
+func parseLogEvents(stdout []byte) []LogEvent {
+	var events []LogEvent
+	scanner := bufio.NewScanner(bytes.NewReader(stdout))
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var raw struct {
+			Level      string         `json:"@level"`
+			Message    string         `json:"@message"`
+			Timestamp  string         `json:"@timestamp"`
+			Type       string         `json:"type"`
+			Diagnostic *LogDiagnostic `json:"diagnostic"`
+			Change     *struct {
+				Resource struct {
+					Addr string `json:"addr"`
+				} `json:"resource"`
+				Action string `json:"action"`
+			} `json:"change"`
+			Hook *struct {
+				Resource struct {
+					Addr string `json:"addr"`
+				} `json:"resource"`
+				Action string `json:"action"`
+			} `json:"hook"`
+		}
+		if err := json.Unmarshal(line, &raw); err != nil {
+			events = append(events, LogEvent{Message: string(line)})
+			continue
+		}
+		event := LogEvent{Time: raw.Timestamp, Level: raw.Level, Type: raw.Type, Message: raw.Message, Diagnostic: raw.Diagnostic}
+		switch {
+		case raw.Change != nil:
+			event.Address, event.Action = raw.Change.Resource.Addr, raw.Change.Action
+		case raw.Hook != nil:
+			event.Address, event.Action = raw.Hook.Resource.Addr, raw.Hook.Action
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// errorDiagnostics joins the error diagnostics of events.
+func errorDiagnostics(events []LogEvent) string {
+	var msgs []string
+	for _, e := range events {
+		if e.Diagnostic == nil || e.Diagnostic.Severity != "error" {
+			continue
+		}
+		msg := e.Diagnostic.Summary
+		if e.Diagnostic.Detail != "" {
+			msg += ": " + e.Diagnostic.Detail
+		}
+		msgs = append(msgs, msg)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// redactOutput replaces the given secrets and anything that looks like a Vault token in s.
+func redactOutput(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redactedValue)
+		}
+	}
+	return vaultTokenRe.ReplaceAllString(s, redactedValue)
+}
+
+// take returns s redacted and cut to the space left in the log, at a rune boundary.
+func (l *RunLog) take(s string, secrets []string) string {
+	s = redactOutput(s, secrets...)
+	if left := MaxRunLogBytes - l.size; len(s) > left {
+		n := max(left, 0)
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = s[:n]
+		l.Truncated = true
+	}
+	l.size += len(s)
+	return s
+}
+
+// addStep records the output of a terraform command; a nil log records nothing.
+func (l *RunLog) addStep(command string, started time.Time, output stepOutput, stdout, stderr []byte, events []LogEvent, runErr error, secrets ...string) {
+	if l == nil {
+		return
+	}
+	step := StepLog{Command: command, Started: started.UTC(), Duration: time.Since(started).Round(time.Millisecond).String()}
+	if runErr != nil {
+		step.Error = l.take(runErr.Error(), secrets)
+	}
+	text := string(stderr)
+	if output == outputText {
+		text = string(stdout) + text
+	}
+	step.Output = l.take(text, secrets)
+	for _, e := range events {
+		if l.Truncated {
+			break
+		}
+		e.Message = l.take(e.Message, secrets)
+		if e.Diagnostic != nil {
+			d := *e.Diagnostic
+			d.Summary = l.take(d.Summary, secrets)
+			d.Detail = l.take(d.Detail, secrets)
+			e.Diagnostic = &d
+		}
+		step.Events = append(step.Events, e)
+	}
+	l.Steps = append(l.Steps, step)
+}
+
+// finish sets the outcome of the run.
+func (l *RunLog) finish(err error, secrets ...string) {
+	l.Finished = time.Now().UTC()
+	if err != nil {
+		l.Error = redactOutput(err.Error(), secrets...)
+	}
+}
+
+// getRunLogIndex returns the index of the stored run logs, oldest first.
+func getRunLogIndex(ctx context.Context, storage logical.Storage) ([]RunLogInfo, error) {
+	var index []RunLogInfo
+	if err := util.GetJSON(ctx, storage, StorageKeyTerraformLogs, &index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// storeRunLog saves the log of a run and adds it to the index, keeping the last MaxRunLogs.
+func storeRunLog(ctx context.Context, storage logical.Storage, l *RunLog) error {
+	index, err := getRunLogIndex(ctx, storage)
+	if err != nil {
+		return err
+	}
+	if err := util.PutJSON(ctx, storage, StorageKeyTerraformLogPrefix+l.ID, l); err != nil {
+		return err
+	}
+	kept := make([]RunLogInfo, 0, len(index)+1)
+	for _, info := range index {
+		if info.ID != l.ID {
+			kept = append(kept, info)
+		}
+	}
+	kept = append(kept, RunLogInfo{ID: l.ID, Commit: l.Commit, Kind: l.Kind, Started: l.Started, Error: l.Error})
+	if len(kept) > MaxRunLogs {
+		for _, info := range kept[:len(kept)-MaxRunLogs] {
+			if err := storage.Delete(ctx, StorageKeyTerraformLogPrefix+info.ID); err != nil {
+				return err
+			}
+		}
+		kept = kept[len(kept)-MaxRunLogs:]
+	}
+	return util.PutJSON(ctx, storage, StorageKeyTerraformLogs, kept)
+}
+
+// getRunLog returns the log of run id; nil if there is none.
+func getRunLog(ctx context.Context, storage logical.Storage, id string) (*RunLog, error) {
+	var l *RunLog
+	if err := util.GetJSON(ctx, storage, StorageKeyTerraformLogPrefix+id, &l); err != nil {
+		return nil, fmt.Errorf("run log %q: %w", id, err)
+	}
+	return l, nil
+}
+
+func (b *backend) runLogPaths() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "^terraform/logs/?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathRunLogsList,
+					Summary:  "List the logs of terraform runs.",
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathRunLogsList,
+					Summary:  "List the logs of terraform runs.",
+				},
+			},
+			HelpSynopsis:    "Logs of terraform runs.",
+			HelpDescription: fmt.Sprintf("Run ids, oldest first, with commit, kind (apply, plan, apply_plan), start time and error (key_info); the last %d runs are kept.", MaxRunLogs),
+		},
+		{
+			Pattern: "^terraform/logs/(?P<run>[^/]+)$",
+			Fields: map[string]*framework.FieldSchema{
+				FieldNameRun: {
+					Type:        framework.TypeString,
+					Description: "Run id (see terraform/logs).",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathRunLogRead,
+					Summary:  "Read the log of a terraform run.",
+				},
+			},
+			HelpSynopsis:    "Log of a terraform run.",
+			HelpDescription: fmt.Sprintf("The output of every terraform command of the run: text output of init, events of the -json output of plan and apply (messages, resource changes, diagnostics). Only the Vault token and values that look like Vault tokens are redacted: other secrets terraform prints, such as non-sensitive attribute values in plan output or provider errors, are kept, so reading the logs needs the same care as reading the terraform state. Output beyond %d bytes is dropped.", MaxRunLogBytes),
+		},
+	}
+}
+
+func (b *backend) pathRunLogsList(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	index, err := getRunLogIndex(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(index))
+	info := make(map[string]interface{}, len(index))
+	for _, l := range index {
+		keys = append(keys, l.ID)
+		info[l.ID] = map[string]interface{}{
+			FieldNameCommit: l.Commit,
+			"kind":          l.Kind,
+			"started":       l.Started.Format(time.RFC3339),
+			"error":         l.Error,
+		}
+	}
+	return logical.ListResponseWithInfo(keys, info), nil
+}
+
+func (b *backend) pathRunLogRead(ctx context.Context, req *logical.Request, fields *framework.FieldData) (*logical.Response, error) {
+	l, err := getRunLog(ctx, req.Storage, fields.Get(FieldNameRun).(string))
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return nil, nil
+	}
+	// The response is the stored JSON, so that events keep their field names.
+	raw, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	return &logical.Response{Data: data}, nil
+}
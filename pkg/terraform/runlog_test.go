@@ -0,0 +1,144 @@
+//go:build linux
+
+package terraform
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseLogEvents(t *testing.T) {
+	stdout := `{"@level":"info","@message":"Terraform 1.9.0","@timestamp":"2026-01-02T03:04:05Z","type":"version"}
+{"@level":"info","@message":"vault_mount.kv: Plan to create","type":"planned_change","change":{"resource":{"addr":"vault_mount.kv"},"action":"create"}}
+
+{"@level":"info","@message":"vault_mount.kv: Creating...","type":"apply_start","hook":{"resource":{"addr":"vault_mount.kv"},"action":"create"}}
+{"@level":"error","@message":"Error: permission denied","type":"diagnostic","diagnostic":{"severity":"error","summary":"permission denied","detail":"Code: 403"}}
+not json
+`
+	want := []LogEvent{
+		{Time: "2026-01-02T03:04:05Z", Level: "info", Type: "version", Message: "Terraform 1.9.0"},
+		{Level: "info", Type: "planned_change", Message: "vault_mount.kv: Plan to create", Address: "vault_mount.kv", Action: "create"},
+		{Level: "info", Type: "apply_start", Message: "vault_mount.kv: Creating...", Address: "vault_mount.kv", Action: "create"},
+		{Level: "error", Type: "diagnostic", Message: "Error: permission denied", Diagnostic: &LogDiagnostic{Severity: "error", Summary: "permission denied", Detail: "Code: 403"}},
+		{Message: "not json"},
+	}
+	require.Equal(t, want, parseLogEvents([]byte(stdout)))
+	require.Nil(t, parseLogEvents(nil))
+}
+
+func Test_ErrorDiagnostics(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []LogEvent
+		want   string
+	}{
+		{name: "no events"},
+		{
+			name: "warnings only",
+			events: []LogEvent{
+				{Message: "m"},
+				{Diagnostic: &LogDiagnostic{Severity: "warning", Summary: "deprecated"}},
+			},
+		},
+		{
+			name: "errors",
+			events: []LogEvent{
+				{Diagnostic: &LogDiagnostic{Severity: "error", Summary: "permission denied", Detail: "Code: 403"}},
+				{Diagnostic: &LogDiagnostic{Severity: "warning", Summary: "deprecated"}},
+				{Diagnostic: &LogDiagnostic{Severity: "error", Summary: "invalid reference"}},
+			},
+			want: "permission denied: Code: 403; invalid reference",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, errorDiagnostics(tt.events))
+		})
+	}
+}
+
+func Test_RedactOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		secrets []string
+		want    string
+	}{
+		{name: "no secrets", s: "vault_mount.kv: Creating...", want: "vault_mount.kv: Creating..."},
+		{name: "given secret", s: "token my-token used", secrets: []string{"my-token", ""}, want: "token <redacted> used"},
+		{name: "service token", s: "token=hvs.CAESIAbcdefghijklmnopqrstuvwxyz0123", want: "token=<redacted>"},
+		{name: "batch token", s: "hvb.AAAAAQJabcdefghijklmnopqrst", want: "<redacted>"},
+		{name: "legacy token", s: "token s.abcdefghijklmnopqrstuvwx.", want: "token <redacted>."},
+		{name: "not a token", s: "vars.abcdefghijklmnopqrstuvwx hvs.short", want: "vars.abcdefghijklmnopqrstuvwx hvs.short"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, redactOutput(tt.s, tt.secrets...))
+		})
+	}
+}
+
+func Test_RunLog_Take(t *testing.T) {
+	l := newRunLog(RunKindApply, "3f2c1a9e0b7d5c4a")
+	require.Equal(t, "3f2c1a9e0b7d5c4a", l.Commit)
+	require.True(t, strings.HasSuffix(l.ID, "-3f2c1a9e0b7d"))
+
+	require.Equal(t, "token <redacted>", l.take("token secret", []string{"secret"}))
+	require.False(t, l.Truncated)
+	require.Equal(t, len("token <redacted>"), l.size, "the redacted output is counted")
+
+	long := strings.Repeat("a", MaxRunLogBytes)
+	got := l.take(long, nil)
+	require.Len(t, got, MaxRunLogBytes-len("token <redacted>"))
+	require.True(t, l.Truncated)
+	require.Equal(t, "", l.take("more", nil), "nothing is kept once the log is full")
+	require.Equal(t, MaxRunLogBytes, l.size)
+
+	l = newRunLog(RunKindApply, "")
+	l.size = MaxRunLogBytes - 2
+	got = l.take("aбв", nil)
+	require.Equal(t, "a", got, "a rune is not cut in half")
+	require.True(t, utf8.ValidString(got))
+
+	l = newRunLog(RunKindApply, "")
+	l.addStep("terraform apply", l.Started, outputJSON, []byte(strings.Repeat(`{"@message":"x"}`+"\n", 3)), []byte("err"), []LogEvent{{Message: long}, {Message: "dropped"}}, nil)
+	require.True(t, l.Truncated)
+	require.Len(t, l.Steps, 1)
+	require.Equal(t, "err", l.Steps[0].Output, "stdout of a -json run is kept as events")
+	require.Len(t, l.Steps[0].Events, 1, "events after the log is full are dropped")
+}
+
+func Test_StoreRunLog(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	for i := 0; i < MaxRunLogs+2; i++ {
+		l := &RunLog{ID: fmt.Sprintf("run-%02d", i), Commit: fmt.Sprintf("c%d", i), Kind: RunKindPlan, Steps: []StepLog{}}
+		l.finish(nil)
+		require.NoError(t, storeRunLog(ctx, storage, l))
+	}
+	failed := &RunLog{ID: "run-05", Commit: "c5", Kind: RunKindApply, Steps: []StepLog{}}
+	failed.finish(fmt.Errorf("boom"))
+	require.NoError(t, storeRunLog(ctx, storage, failed))
+
+	index, err := getRunLogIndex(ctx, storage)
+	require.NoError(t, err)
+	require.Len(t, index, MaxRunLogs)
+	require.Equal(t, "run-02", index[0].ID, "the oldest runs are dropped")
+	require.Equal(t, RunLogInfo{ID: "run-05", Commit: "c5", Kind: RunKindApply, Error: "boom"}, index[len(index)-1], "a stored run moves to the end")
+
+	l, err := getRunLog(ctx, storage, "run-01")
+	require.NoError(t, err)
+	require.Nil(t, l)
+	l, err = getRunLog(ctx, storage, "run-05")
+	require.NoError(t, err)
+	require.Equal(t, "boom", l.Error)
+	keys, err := storage.List(ctx, StorageKeyTerraformLogPrefix)
+	require.NoError(t, err)
+	require.Len(t, keys, MaxRunLogs)
+}
@@ -0,0 +1,81 @@
+//go:build linux
+
+package terraform
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/trublast/vault-plugin-gitops/pkg/util"
+)
+
+const (
+	FieldNameCommit = "commit"
+
+	// StorageKeyTerraformStateSnapshots is the list of terraform state snapshots; the snapshots
+	// themselves are stored under StorageKeyTerraformStateSnapshotPrefix + commit hash.
+	StorageKeyTerraformStateSnapshots      = "terraform_state_snapshots"
+	StorageKeyTerraformStateSnapshotPrefix = "terraform_state_snapshot/"
+
+	// MaxStateSnapshots is how many snapshots are kept; older ones are deleted.
+	MaxStateSnapshots = 20
+)
+
+var stateSnapshots = util.SnapshotStore{
+	IndexKey: StorageKeyTerraformStateSnapshots,
+	Prefix:   StorageKeyTerraformStateSnapshotPrefix,
+	Max:      MaxStateSnapshots,
+}
+
+// snapshotState copies the stored terraform state to the snapshot of commit.
+func snapshotState(ctx context.Context, storage logical.Storage, commit string) error {
+	entry, err := storage.Get(ctx, StorageKeyTerraformState)
+	if err != nil {
+		return err
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil
+	}
+	return stateSnapshots.Save(ctx, storage, commit, entry.Value)
+}
+
+func (b *backend) snapshotPaths() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "^terraform/state/snapshots/?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathStateSnapshots,
+					Summary:  "List the terraform state snapshots of applied commits.",
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathStateSnapshots,
+					Summary:  "List the terraform state snapshots of applied commits.",
+				},
+			},
+			HelpSynopsis:    "Snapshots of the terraform state.",
+			HelpDescription: fmt.Sprintf("Every successful terraform apply stores a copy of the terraform state under the commit hash; terraform/state/rollback with commit restores one. Returns the commits, oldest first, with the time and size of the snapshot (key_info); the last %d snapshots are kept.", MaxStateSnapshots),
+		},
+	}
+}
+
+func (b *backend) pathStateSnapshots(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	snapshots, err := stateSnapshots.List(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(snapshots))
+	info := make(map[string]interface{}, len(snapshots))
+	for _, s := range snapshots {
+		keys = append(keys, s.Commit)
+		info[s.Commit] = map[string]interface{}{
+			"time": s.Time.Format(time.RFC3339),
+			"size": s.Size,
+		}
+	}
+	return logical.ListResponseWithInfo(keys, info), nil
+}
@@ -0,0 +1,475 @@
+//go:build linux
+
+package terraform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/trublast/vault-plugin-gitops/pkg/util"
+)
+
+const (
+	FieldNameState         = "state"
+	FieldNameForce         = "force"
+	FieldNameShowSensitive = "show_sensitive"
+	FieldNameVersion       = "version"
+
+	// StorageKeyTerraformStateVersions is the list of previous terraform states; the states
+	// themselves are stored under StorageKeyTerraformStateVersionPrefix + version number.
+	StorageKeyTerraformStateVersions      = "terraform_state_versions"
+	StorageKeyTerraformStateVersionPrefix = "terraform_state_version/"
+
+	// MaxStateVersions is how many previous terraform states are kept; older ones are deleted.
+	MaxStateVersions = 10
+
+	// supportedStateFormat is the terraform state format version ("version" in the state file)
+	// accepted from terraform runs and by terraform/state import.
+	supportedStateFormat = 4
+
+	redactedValue = "<redacted>"
+)
+
+// Sources of a terraform state change, recorded in the version list.
+const (
+	stateSourceApply    = "apply"
+	stateSourceImport   = "import"
+	stateSourceRollback = "rollback"
+	stateSourceRestore  = "restore"
+)
+
+// stateMeta is the header of a terraform state file.
+type stateMeta struct {
+	Version          int    `json:"version"`
+	TerraformVersion string `json:"terraform_version"`
+	Serial           int64  `json:"serial"`
+	Lineage          string `json:"lineage"`
+}
+
+// StateVersion describes a previous terraform state: the state with this serial and lineage was
+// replaced at Time by a change from ReplacedBy (apply, import, rollback to a version or restore
+// of a commit snapshot).
+type StateVersion struct {
+	Version    int       `json:"version"`
+	Serial     int64     `json:"serial"`
+	Lineage    string    `json:"lineage"`
+	Time       time.Time `json:"time"`
+	ReplacedBy string    `json:"replaced_by"`
+}
+
+func parseStateMeta(data []byte) (stateMeta, error) {
+	var meta stateMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("invalid terraform state: %w", err)
+	}
+	return meta, nil
+}
+
+// getStateVersions returns the previous terraform states, oldest first.
+func getStateVersions(ctx context.Context, storage logical.Storage) ([]StateVersion, error) {
+	var versions []StateVersion
+	if err := util.GetJSON(ctx, storage, StorageKeyTerraformStateVersions, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// putTerraformState replaces the stored terraform state with data, keeping the previous state
+// as a new version (the last MaxStateVersions are kept). Nothing is written if data equals the
+// stored state.
+func putTerraformState(ctx context.Context, storage logical.Storage, data []byte, source string) error {
+	current, err := storage.Get(ctx, StorageKeyTerraformState)
+	if err != nil {
+		return fmt.Errorf("getting terraform state from storage: %w", err)
+	}
+	if current != nil && bytes.Equal(current.Value, data) {
+		return nil
+	}
+	if current != nil && len(current.Value) > 0 {
+		if err := archiveTerraformState(ctx, storage, current.Value, source); err != nil {
+			return fmt.Errorf("keeping previous terraform state: %w", err)
+		}
+	}
+	if err := storage.Put(ctx, &logical.StorageEntry{Key: StorageKeyTerraformState, Value: data}); err != nil {
+		return fmt.Errorf("saving terraform state to storage: %w", err)
+	}
+	return nil
+}
+
+func archiveTerraformState(ctx context.Context, storage logical.Storage, data []byte, replacedBy string) error {
+	versions, err := getStateVersions(ctx, storage)
+	if err != nil {
+		return err
+	}
+	// A state that cannot be parsed is kept as well, with an empty serial and lineage.
+	meta, _ := parseStateMeta(data)
+	next := StateVersion{Version: 1, Serial: meta.Serial, Lineage: meta.Lineage, Time: time.Now().UTC(), ReplacedBy: replacedBy}
+	if len(versions) > 0 {
+		next.Version = versions[len(versions)-1].Version + 1
+	}
+	if err := storage.Put(ctx, &logical.StorageEntry{Key: stateVersionKey(next.Version), Value: data}); err != nil {
+		return err
+	}
+	versions = append(versions, next)
+	if len(versions) > MaxStateVersions {
+		for _, v := range versions[:len(versions)-MaxStateVersions] {
+			if err := storage.Delete(ctx, stateVersionKey(v.Version)); err != nil {
+				return err
+			}
+		}
+		versions = versions[len(versions)-MaxStateVersions:]
+	}
+	return util.PutJSON(ctx, storage, StorageKeyTerraformStateVersions, versions)
+}
+
+func stateVersionKey(version int) string {
+	return StorageKeyTerraformStateVersionPrefix + strconv.Itoa(version)
+}
+
+// validateState parses the header of a terraform state and checks its format version and
+// lineage.
+func validateState(data []byte) (stateMeta, error) {
+	meta, err := parseStateMeta(data)
+	if err != nil {
+		return meta, err
+	}
+	if meta.Version != supportedStateFormat {
+		return meta, fmt.Errorf("unsupported terraform state format version %d, expected %d", meta.Version, supportedStateFormat)
+	}
+	if meta.Lineage == "" {
+		return meta, fmt.Errorf("terraform state has no lineage")
+	}
+	return meta, nil
+}
+
+// checkStateSave verifies that the state left by a terraform run may replace the current state:
+// it is valid, has the same lineage and a serial not lower than the current one. A current
+// state that cannot be parsed may be replaced.
+func checkStateSave(current, data []byte) error {
+	meta, err := validateState(data)
+	if err != nil {
+		return err
+	}
+	cur, err := parseStateMeta(current)
+	if len(current) == 0 || err != nil {
+		return nil
+	}
+	if cur.Lineage != meta.Lineage {
+		return fmt.Errorf("lineage %q differs from the stored state lineage %q", meta.Lineage, cur.Lineage)
+	}
+	if meta.Serial < cur.Serial {
+		return fmt.Errorf("serial %d is lower than the stored state serial %d", meta.Serial, cur.Serial)
+	}
+	return nil
+}
+
+// checkStateImport verifies that data may replace the current state, as 'terraform state push'
+// does: same lineage with a higher serial (or the same serial and content). A different lineage
+// is accepted only with force.
+func checkStateImport(current, data []byte, force bool) error {
+	meta, err := validateState(data)
+	if err != nil {
+		return err
+	}
+	if len(current) == 0 {
+		return nil
+	}
+	cur, err := parseStateMeta(current)
+	if err != nil {
+		return fmt.Errorf("current state: %w", err)
+	}
+	if cur.Lineage != meta.Lineage {
+		if force {
+			return nil
+		}
+		return fmt.Errorf("lineage %q differs from the current state lineage %q; set force=true to replace it", meta.Lineage, cur.Lineage)
+	}
+	if meta.Serial < cur.Serial || (meta.Serial == cur.Serial && !bytes.Equal(bytes.TrimSpace(data), bytes.TrimSpace(current))) {
+		return fmt.Errorf("serial %d is not newer than the current state serial %d", meta.Serial, cur.Serial)
+	}
+	return nil
+}
+
+// redactState replaces the attribute values of every resource instance (except id), their
+// private data and the output values with "<redacted>".
+func redactState(state map[string]interface{}) {
+	resources, _ := state["resources"].([]interface{})
+	for _, r := range resources {
+		resource, _ := r.(map[string]interface{})
+		instances, _ := resource["instances"].([]interface{})
+		for _, i := range instances {
+			instance, _ := i.(map[string]interface{})
+			if attributes, ok := instance["attributes"].(map[string]interface{}); ok {
+				for k := range attributes {
+					if k != "id" {
+						attributes[k] = redactedValue
+					}
+				}
+			}
+			if _, ok := instance["private"]; ok {
+				instance["private"] = redactedValue
+			}
+		}
+	}
+	outputs, _ := state["outputs"].(map[string]interface{})
+	for _, o := range outputs {
+		if output, ok := o.(map[string]interface{}); ok {
+			output["value"] = redactedValue
+		}
+	}
+}
+
+func (b *backend) terraformStatePaths() []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "^terraform/state/?$",
+			Fields: map[string]*framework.FieldSchema{
+				FieldNameShowSensitive: {
+					Type:        framework.TypeBool,
+					Default:     false,
+					Description: "Return attribute and output values as stored instead of redacted.",
+				},
+				FieldNameState: {
+					Type:        framework.TypeString,
+					Description: "Terraform state to import (JSON, format version 4), e.g. the output of 'terraform state pull'.",
+				},
+				FieldNameForce: {
+					Type:        framework.TypeBool,
+					Default:     false,
+					Description: "Import a state with a different lineage than the current one.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathTerraformStateRead,
+					Summary:  "Read the terraform state.",
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathTerraformStateImport,
+					Summary:  "Replace the terraform state with an imported one.",
+				},
+			},
+			HelpSynopsis:    "The terraform state of the plugin.",
+			HelpDescription: "Read returns serial, lineage and the state; values of resource attributes (except id) and outputs are redacted unless show_sensitive is set. Update imports a state: it must have the same lineage and a higher serial than the current state, or force must be set for another lineage. The replaced state is kept in terraform/state/versions.",
+		},
+		{
+			Pattern: "^terraform/state/versions/?$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ListOperation: &framework.PathOperation{
+					Callback: b.pathTerraformStateVersions,
+					Summary:  "List the previous terraform states.",
+				},
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathTerraformStateVersions,
+					Summary:  "List the previous terraform states.",
+				},
+			},
+			HelpSynopsis:    "Previous terraform states.",
+			HelpDescription: fmt.Sprintf("Every change of the terraform state (apply, import, rollback, restore) keeps the replaced state. Returns the version numbers, oldest first, with serial, lineage, time and the change that replaced it (key_info); the last %d versions are kept.", MaxStateVersions),
+		},
+		{
+			Pattern: "^terraform/state/rollback/?$",
+			Fields: map[string]*framework.FieldSchema{
+				FieldNameVersion: {
+					Type:        framework.TypeInt,
+					Description: "Version to roll back to (see terraform/state/versions); default is the latest one.",
+				},
+				FieldNameCommit: {
+					Type:        framework.TypeString,
+					Description: "Commit hash of the snapshot to roll back to (see terraform/state/snapshots), instead of a version.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathTerraformStateRollback,
+					Summary:  "Replace the terraform state with a previous version or the snapshot of a commit.",
+				},
+			},
+			HelpSynopsis:    "Roll the terraform state back to a previous version or to the snapshot of a commit.",
+			HelpDescription: "Replaces the terraform state with a previous version (version) or with the snapshot taken after a commit was applied (commit). The state must be a valid terraform state; if it has the lineage of the current state, its serial is set above the current one, so the rolled back state is newer for terraform. The replaced state is kept in terraform/state/versions. Terraform is not run: the next commit is planned against it.",
+		},
+	}
+}
+
+func (b *backend) pathTerraformStateRead(ctx context.Context, req *logical.Request, fields *framework.FieldData) (*logical.Response, error) {
+	entry, err := req.Storage.Get(ctx, StorageKeyTerraformState)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil, nil
+	}
+	var state map[string]interface{}
+	if err := json.Unmarshal(entry.Value, &state); err != nil {
+		return logical.ErrorResponse("invalid terraform state: %s", err.Error()), nil
+	}
+	if !fields.Get(FieldNameShowSensitive).(bool) {
+		redactState(state)
+	}
+	return &logical.Response{Data: map[string]interface{}{
+		"serial":            state["serial"],
+		"lineage":           state["lineage"],
+		"terraform_version": state["terraform_version"],
+		FieldNameState:      state,
+	}}, nil
+}
+
+func (b *backend) pathTerraformStateImport(ctx context.Context, req *logical.Request, fields *framework.FieldData) (*logical.Response, error) {
+	data := []byte(fields.Get(FieldNameState).(string))
+	if len(bytes.TrimSpace(data)) == 0 {
+		return logical.ErrorResponse("%q is required", FieldNameState), nil
+	}
+	if !b.stateLock.TryLock() {
+		return logical.ErrorResponse("a commit is being applied, try again later"), nil
+	}
+	defer b.stateLock.Unlock()
+
+	var current []byte
+	entry, err := req.Storage.Get(ctx, StorageKeyTerraformState)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		current = entry.Value
+	}
+	if err := checkStateImport(current, data, fields.Get(FieldNameForce).(bool)); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := putTerraformState(ctx, req.Storage, data, stateSourceImport); err != nil {
+		return nil, err
+	}
+	meta, _ := parseStateMeta(data)
+	b.Logger().Info("Imported terraform state", "serial", meta.Serial, "lineage", meta.Lineage)
+	return &logical.Response{Data: map[string]interface{}{
+		"serial":  meta.Serial,
+		"lineage": meta.Lineage,
+	}}, nil
+}
+
+func (b *backend) pathTerraformStateVersions(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	versions, err := getStateVersions(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(versions))
+	info := make(map[string]interface{}, len(versions))
+	for _, v := range versions {
+		key := strconv.Itoa(v.Version)
+		keys = append(keys, key)
+		info[key] = map[string]interface{}{
+			"serial":      v.Serial,
+			"lineage":     v.Lineage,
+			"time":        v.Time.Format(time.RFC3339),
+			"replaced_by": v.ReplacedBy,
+		}
+	}
+	return logical.ListResponseWithInfo(keys, info), nil
+}
+
+func (b *backend) pathTerraformStateRollback(ctx context.Context, req *logical.Request, fields *framework.FieldData) (*logical.Response, error) {
+	commit := fields.Get(FieldNameCommit).(string)
+	v, hasVersion := fields.GetOk(FieldNameVersion)
+	if commit != "" && hasVersion {
+		return logical.ErrorResponse("set either %q or %q", FieldNameVersion, FieldNameCommit), nil
+	}
+	if !b.stateLock.TryLock() {
+		return logical.ErrorResponse("a commit is being applied, try again later"), nil
+	}
+	defer b.stateLock.Unlock()
+
+	// previous is the state to roll back to; from names it in messages.
+	var previous []byte
+	var from, source string
+	respData := map[string]interface{}{}
+	if commit != "" {
+		snapshot, err := stateSnapshots.Get(ctx, req.Storage, commit)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot == nil {
+			return logical.ErrorResponse("no terraform state snapshot of commit %q", commit), nil
+		}
+		previous, from, source = snapshot, fmt.Sprintf("snapshot of commit %q", commit), stateSourceRestore
+		respData[FieldNameCommit] = commit
+	} else {
+		versions, err := getStateVersions(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			return logical.ErrorResponse("no previous terraform state"), nil
+		}
+		version := versions[len(versions)-1].Version
+		if hasVersion {
+			version = v.(int)
+		}
+		entry, err := req.Storage.Get(ctx, stateVersionKey(version))
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return logical.ErrorResponse("terraform state version %d not found", version), nil
+		}
+		previous, from, source = entry.Value, fmt.Sprintf("version %d", version), stateSourceRollback
+		respData[FieldNameVersion] = version
+	}
+
+	current, err := req.Storage.Get(ctx, StorageKeyTerraformState)
+	if err != nil {
+		return nil, err
+	}
+	var currentData []byte
+	if current != nil {
+		currentData = current.Value
+	}
+	data, err := prepareRestore(previous, currentData)
+	if err != nil {
+		return logical.ErrorResponse("terraform state %s: %s", from, err), nil
+	}
+	if err := putTerraformState(ctx, req.Storage, data, source); err != nil {
+		return nil, err
+	}
+	meta, _ := parseStateMeta(data)
+	b.Logger().Info(fmt.Sprintf("Rolled back terraform state to the %s", from), "serial", meta.Serial)
+	respData["serial"] = meta.Serial
+	respData["lineage"] = meta.Lineage
+	return &logical.Response{Data: respData}, nil
+}
+
+// prepareRestore validates a previous state (a version or a snapshot) and raises its serial
+// above the current state, so that it can replace it like a newer state would.
+func prepareRestore(data, current []byte) ([]byte, error) {
+	if _, err := validateState(data); err != nil {
+		return nil, err
+	}
+	if len(current) == 0 {
+		return data, nil
+	}
+	return bumpSerial(data, current)
+}
+
+// bumpSerial returns data with the serial set above the serial of current if both states have
+// the same lineage; otherwise data is returned unchanged.
+func bumpSerial(data, current []byte) ([]byte, error) {
+	meta, err := parseStateMeta(data)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := parseStateMeta(current)
+	if err != nil || cur.Lineage != meta.Lineage || meta.Serial > cur.Serial {
+		return data, nil
+	}
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	state["serial"] = json.RawMessage(strconv.FormatInt(cur.Serial+1, 10))
+	return json.MarshalIndent(state, "", "  ")
+}
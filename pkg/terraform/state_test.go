@@ -0,0 +1,239 @@
+//go:build linux
+
+package terraform
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CheckStateImport(t *testing.T) {
+	current := `{"version": 4, "serial": 5, "lineage": "l1"}`
+	tests := []struct {
+		name    string
+		current string
+		data    string
+		force   bool
+		wantErr string
+	}{
+		{name: "no current state", data: `{"version": 4, "serial": 1, "lineage": "l2"}`},
+		{name: "higher serial", current: current, data: `{"version": 4, "serial": 6, "lineage": "l1"}`},
+		{name: "same serial and content", current: current, data: current + "\n"},
+		{
+			name:    "same serial, other content",
+			current: current,
+			data:    `{"version": 4, "serial": 5, "lineage": "l1", "resources": []}`,
+			wantErr: "serial 5 is not newer than the current state serial 5",
+		},
+		{
+			name:    "lower serial",
+			current: current,
+			data:    `{"version": 4, "serial": 4, "lineage": "l1"}`,
+			wantErr: "serial 4 is not newer",
+		},
+		{
+			name:    "other lineage",
+			current: current,
+			data:    `{"version": 4, "serial": 9, "lineage": "l2"}`,
+			wantErr: "set force=true",
+		},
+		{name: "other lineage with force", current: current, data: `{"version": 4, "serial": 1, "lineage": "l2"}`, force: true},
+		{
+			name:    "force does not skip validation",
+			current: current,
+			data:    `{"version": 3, "serial": 1, "lineage": "l2"}`,
+			force:   true,
+			wantErr: "unsupported terraform state format version 3",
+		},
+		{
+			name:    "no lineage",
+			data:    `{"version": 4, "serial": 1}`,
+			wantErr: "terraform state has no lineage",
+		},
+		{
+			name:    "unparseable current state",
+			current: `not json`,
+			data:    `{"version": 4, "serial": 1, "lineage": "l1"}`,
+			wantErr: "current state",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkStateImport([]byte(tt.current), []byte(tt.data), tt.force)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func Test_BumpSerial(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		current string
+		want    int64
+	}{
+		{name: "lower serial", data: `{"version": 4, "serial": 3, "lineage": "l1"}`, current: `{"version": 4, "serial": 5, "lineage": "l1"}`, want: 6},
+		{name: "same serial", data: `{"version": 4, "serial": 5, "lineage": "l1"}`, current: `{"version": 4, "serial": 5, "lineage": "l1"}`, want: 6},
+		{name: "higher serial", data: `{"version": 4, "serial": 7, "lineage": "l1"}`, current: `{"version": 4, "serial": 5, "lineage": "l1"}`, want: 7},
+		{name: "other lineage", data: `{"version": 4, "serial": 3, "lineage": "l2"}`, current: `{"version": 4, "serial": 5, "lineage": "l1"}`, want: 3},
+		{name: "no current state", data: `{"version": 4, "serial": 3, "lineage": "l1"}`, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bumpSerial([]byte(tt.data), []byte(tt.current))
+			require.NoError(t, err)
+			meta, err := parseStateMeta(got)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, meta.Serial)
+			require.Equal(t, 4, meta.Version)
+		})
+	}
+
+	got, err := bumpSerial([]byte(`{"version": 4, "serial": 1, "lineage": "l1", "resources": [{"name": "a"}]}`), []byte(`{"version": 4, "serial": 1, "lineage": "l1"}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version": 4, "serial": 2, "lineage": "l1", "resources": [{"name": "a"}]}`, string(got), "other fields are kept")
+
+	_, err = bumpSerial([]byte(`not json`), nil)
+	require.Error(t, err)
+}
+
+func Test_RedactState(t *testing.T) {
+	var state map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"version": 4,
+		"lineage": "l1",
+		"outputs": {"token": {"value": "s.secret", "type": "string", "sensitive": true}},
+		"resources": [
+			{"type": "vault_generic_secret", "name": "a", "instances": [
+				{"attributes": {"id": "secret/a", "data_json": "{\"password\":\"p\"}", "path": "secret/a"}, "private": "cHJpdmF0ZQ=="}
+			]},
+			{"type": "vault_mount", "name": "b", "instances": [{"attributes": {"id": "kv"}}]}
+		]
+	}`), &state))
+	redactState(state)
+
+	want := `{
+		"version": 4,
+		"lineage": "l1",
+		"outputs": {"token": {"value": "<redacted>", "type": "string", "sensitive": true}},
+		"resources": [
+			{"type": "vault_generic_secret", "name": "a", "instances": [
+				{"attributes": {"id": "secret/a", "data_json": "<redacted>", "path": "<redacted>"}, "private": "<redacted>"}
+			]},
+			{"type": "vault_mount", "name": "b", "instances": [{"attributes": {"id": "kv"}}]}
+		]
+	}`
+	got, err := json.Marshal(state)
+	require.NoError(t, err)
+	require.JSONEq(t, want, string(got))
+}
+
+func Test_CheckStateSave(t *testing.T) {
+	current := `{"version": 4, "serial": 5, "lineage": "l1"}`
+	tests := []struct {
+		name    string
+		current string
+		data    string
+		wantErr string
+	}{
+		{name: "no current state", data: `{"version": 4, "serial": 1, "lineage": "l2"}`},
+		{name: "same serial", current: current, data: `{"version": 4, "serial": 5, "lineage": "l1", "resources": []}`},
+		{name: "higher serial", current: current, data: `{"version": 4, "serial": 6, "lineage": "l1"}`},
+		{name: "unparseable current state", current: `not json`, data: `{"version": 4, "serial": 1, "lineage": "l2"}`},
+		{
+			name:    "other lineage",
+			current: current,
+			data:    `{"version": 4, "serial": 9, "lineage": "l2"}`,
+			wantErr: `lineage "l2" differs from the stored state lineage "l1"`,
+		},
+		{
+			name:    "lower serial",
+			current: current,
+			data:    `{"version": 4, "serial": 4, "lineage": "l1"}`,
+			wantErr: "serial 4 is lower than the stored state serial 5",
+		},
+		{
+			name:    "invalid state",
+			current: current,
+			data:    `not json`,
+			wantErr: "invalid terraform state",
+		},
+		{
+			name:    "unsupported format version",
+			data:    `{"version": 3, "serial": 1, "lineage": "l1"}`,
+			wantErr: "unsupported terraform state format version 3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkStateSave([]byte(tt.current), []byte(tt.data))
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func Test_StateRollback(t *testing.T) {
+	ctx := context.Background()
+	fb := &framework.Backend{}
+	fb.Paths = Paths(fb)
+	storage := &logical.InmemStorage{}
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+	require.NoError(t, fb.Setup(ctx, config))
+	rollback := func(data map[string]interface{}) *logical.Response {
+		resp, err := fb.HandleRequest(ctx, &logical.Request{Operation: logical.UpdateOperation, Path: "terraform/state/rollback", Storage: storage, Data: data})
+		require.NoError(t, err)
+		return resp
+	}
+	stateOf := func() string {
+		entry, err := storage.Get(ctx, StorageKeyTerraformState)
+		require.NoError(t, err)
+		return string(entry.Value)
+	}
+
+	current := `{"version": 4, "serial": 5, "lineage": "l1", "resources": []}`
+	require.NoError(t, storage.Put(ctx, &logical.StorageEntry{Key: StorageKeyTerraformState, Value: []byte(current)}))
+	require.NoError(t, stateSnapshots.Save(ctx, storage, "c1", []byte(`{"version": 4, "serial": 3, "lineage": "l1", "resources": [{"name": "a"}]}`)))
+	require.NoError(t, stateSnapshots.Save(ctx, storage, "c2", []byte(`{"version": 3, "serial": 9, "lineage": "l1"}`)))
+
+	resp := rollback(map[string]interface{}{FieldNameCommit: "c2"})
+	require.True(t, resp.IsError())
+	require.Contains(t, resp.Error().Error(), `snapshot of commit "c2": unsupported terraform state format version 3`)
+	require.True(t, rollback(map[string]interface{}{FieldNameCommit: "nope"}).IsError())
+	require.True(t, rollback(map[string]interface{}{FieldNameCommit: "c1", FieldNameVersion: 1}).IsError())
+	require.True(t, rollback(map[string]interface{}{}).IsError(), "no previous version yet")
+	require.Equal(t, current, stateOf(), "a refused state is not restored")
+
+	resp = rollback(map[string]interface{}{FieldNameCommit: "c1"})
+	require.False(t, resp.IsError())
+	require.Equal(t, int64(6), resp.Data["serial"])
+	require.JSONEq(t, `{"version": 4, "serial": 6, "lineage": "l1", "resources": [{"name": "a"}]}`, stateOf())
+
+	// The state replaced by the snapshot is a version: rolling back to it goes the same way.
+	resp = rollback(map[string]interface{}{})
+	require.False(t, resp.IsError())
+	require.Equal(t, 1, resp.Data[FieldNameVersion])
+	require.Equal(t, int64(7), resp.Data["serial"])
+	require.JSONEq(t, `{"version": 4, "serial": 7, "lineage": "l1", "resources": []}`, stateOf())
+
+	versions, err := getStateVersions(ctx, storage)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	require.Equal(t, stateSourceRestore, versions[0].ReplacedBy)
+	require.Equal(t, int64(5), versions[0].Serial)
+	require.Equal(t, stateSourceRollback, versions[1].ReplacedBy)
+	require.Equal(t, int64(6), versions[1].Serial)
+}
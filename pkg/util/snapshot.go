@@ -0,0 +1,77 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Snapshot describes one stored copy of a state entry.
+type Snapshot struct {
+	Commit string    `json:"commit"`
+	Time   time.Time `json:"time"`
+	Size   int       `json:"size"`
+}
+
+// SnapshotStore keeps copies of a storage entry keyed by commit hash: the values under
+// Prefix + commit and the list of snapshots, oldest first, under IndexKey. Only the last Max
+// snapshots are kept.
+type SnapshotStore struct {
+	IndexKey string
+	Prefix   string
+	Max      int
+}
+
+// List returns the stored snapshots, oldest first.
+func (s SnapshotStore) List(ctx context.Context, storage logical.Storage) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	if err := GetJSON(ctx, storage, s.IndexKey, &snapshots); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// Get returns the value of the snapshot of commit; nil if there is none.
+func (s SnapshotStore) Get(ctx context.Context, storage logical.Storage, commit string) ([]byte, error) {
+	entry, err := storage.Get(ctx, s.Prefix+commit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get key %q from storage: %w", s.Prefix+commit, err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	return entry.Value, nil
+}
+
+// Save stores value as the snapshot of commit, replacing an earlier snapshot of the same
+// commit, and deletes the snapshots beyond Max.
+func (s SnapshotStore) Save(ctx context.Context, storage logical.Storage, commit string, value []byte) error {
+	if commit == "" {
+		return fmt.Errorf("snapshot without commit")
+	}
+	snapshots, err := s.List(ctx, storage)
+	if err != nil {
+		return err
+	}
+	if err := storage.Put(ctx, &logical.StorageEntry{Key: s.Prefix + commit, Value: value}); err != nil {
+		return err
+	}
+	kept := make([]Snapshot, 0, len(snapshots)+1)
+	for _, snapshot := range snapshots {
+		if snapshot.Commit != commit {
+			kept = append(kept, snapshot)
+		}
+	}
+	kept = append(kept, Snapshot{Commit: commit, Time: time.Now().UTC(), Size: len(value)})
+	if s.Max > 0 && len(kept) > s.Max {
+		for _, snapshot := range kept[:len(kept)-s.Max] {
+			if err := storage.Delete(ctx, s.Prefix+snapshot.Commit); err != nil {
+				return err
+			}
+		}
+		kept = kept[len(kept)-s.Max:]
+	}
+	return PutJSON(ctx, storage, s.IndexKey, kept)
+}
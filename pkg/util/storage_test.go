@@ -109,3 +109,33 @@ func Test_ProhibitedWriteNilStringMap(t *testing.T) {
 
 	require.Error(t, err)
 }
+
+func Test_SnapshotStore(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	store := SnapshotStore{IndexKey: "snapshots", Prefix: "snapshot/", Max: 2}
+
+	require.NoError(t, store.Save(ctx, storage, "c1", []byte("s1")))
+	require.NoError(t, store.Save(ctx, storage, "c2", []byte("s2")))
+	require.NoError(t, store.Save(ctx, storage, "c1", []byte("s1b")))
+	require.NoError(t, store.Save(ctx, storage, "c3", []byte("s3")))
+	require.Error(t, store.Save(ctx, storage, "", []byte("s")))
+
+	snapshots, err := store.List(ctx, storage)
+	require.NoError(t, err)
+	var commits []string
+	for _, s := range snapshots {
+		commits = append(commits, s.Commit)
+	}
+	require.Equal(t, []string{"c1", "c3"}, commits)
+
+	value, err := store.Get(ctx, storage, "c1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("s1b"), value)
+	value, err = store.Get(ctx, storage, "c2")
+	require.NoError(t, err)
+	require.Nil(t, value)
+	keys, err := storage.List(ctx, "snapshot/")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"c1", "c3"}, keys)
+}
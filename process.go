@@ -7,6 +7,10 @@ import (
 	"github.com/go-git/go-git/v6"
 	"github.com/go-git/go-git/v6/plumbing"
 	"github.com/hashicorp/vault/sdk/logical"
+
+	"github.com/trublast/vault-plugin-gitops/pkg/engine"
+	trdlGit "github.com/trublast/vault-plugin-gitops/pkg/git"
+	"github.com/trublast/vault-plugin-gitops/pkg/pgp"
 )
 
 // processCommitWithRepo checkouts the repository to the given commit and runs the active engine.
@@ -23,7 +27,26 @@ func (b *backend) processCommitWithRepoAtHead(ctx context.Context, storage logic
 	if err != nil {
 		return fmt.Errorf("getting worktree: %w", err)
 	}
-	return b.engine.ProcessCommit(ctx, storage, wt.Filesystem, b.Logger())
+	head, err := gitRepo.Head()
+	if err != nil {
+		return fmt.Errorf("getting HEAD: %w", err)
+	}
+	commitObj, err := gitRepo.CommitObject(head.Hash())
+	if err != nil {
+		return fmt.Errorf("getting HEAD commit: %w", err)
+	}
+	commit := engine.Commit{
+		Hash:    commitObj.Hash.String(),
+		Message: commitObj.Message,
+		VerifySignatures: func(n int) error {
+			trustedPGPPublicKeys, err := pgp.GetTrustedPGPPublicKeys(ctx, storage)
+			if err != nil {
+				return fmt.Errorf("unable to get trusted public keys: %w", err)
+			}
+			return trdlGit.VerifyCommitSignatures(gitRepo, commitObj.Hash.String(), trustedPGPPublicKeys, n, b.Logger())
+		},
+	}
+	return b.engine.ProcessCommit(ctx, storage, wt.Filesystem, commit, b.Logger())
 }
 
 // checkoutRepoToCommit checkouts the repository worktree to the given commit.